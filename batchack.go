@@ -0,0 +1,252 @@
+package stompingophers
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// BatchAcker acks a subscription's messages in batches: every size
+// messages, or interval after the first unacked message, whichever comes
+// first, and whenever the subscription's flow control window is full.  In
+// the client ack mode only the latest message of a batch is acked, which
+// acks the rest.
+//
+// Pending acks are flushed when the subscription is unsubscribed, or the
+// client disconnects.
+type BatchAcker struct {
+	client   *Client
+	sub      Subscription
+	size     int
+	interval time.Duration
+
+	// Transactional acks each batch in a transaction, available from Tx,
+	// so that messages sent while handling the batch are committed
+	// atomically with its ack.  The interval is not used, so a batch is
+	// not committed while it is being handled.
+	Transactional bool
+
+	mu      sync.Mutex
+	pending []string
+	batched int
+	timer   *time.Timer
+	tx      *Tx
+	err     error
+}
+
+// NewBatchAcker returns a batch acker for sub.  A zero interval acks by
+// size only.
+func NewBatchAcker(c *Client, sub Subscription, size int, interval time.Duration) (*BatchAcker, error) {
+	if sub.AckMode == AckModeAuto {
+		return nil, errors.New("batch acking requires a client ack mode")
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	b := &BatchAcker{
+		client:   c,
+		sub:      sub,
+		size:     size,
+		interval: interval,
+	}
+
+	if c.ackers == nil {
+		c.ackers = newAckerSet()
+	}
+	c.ackers.add(sub.ID, b)
+
+	return b, nil
+}
+
+// Ack adds msg to the batch, flushing it if full.  An error from an
+// earlier, timed, flush is returned here.
+func (b *BatchAcker) Ack(msg ServerFrame) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		err := b.err
+		b.err = nil
+		return err
+	}
+
+	if b.sub.AckMode == AckModeClient {
+		b.pending = append(b.pending[:0], ackID(msg))
+	} else {
+		b.pending = append(b.pending, ackID(msg))
+	}
+	b.batched++
+
+	// No more messages are received while the window is full, so the
+	// batch is flushed then, whatever its size.
+	if b.batched >= b.size || b.windowFull() {
+		return b.flush()
+	}
+
+	if b.interval > 0 && !b.Transactional && b.timer == nil {
+		b.timer = time.AfterFunc(b.interval, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			b.timer = nil
+			if err := b.flush(); err != nil && b.err == nil {
+				b.err = err
+			}
+		})
+	}
+
+	return nil
+}
+
+// windowFull reports whether the subscription's flow control window is
+// full, of messages not yet acked.
+func (b *BatchAcker) windowFull() bool {
+	stats, ok := b.client.FlowStats(b.sub.ID)
+	return ok && stats.Unacked >= stats.MaxUnacked
+}
+
+// Tx returns the transaction of the current batch, beginning it if
+// needed.  Only used when Transactional.
+func (b *BatchAcker) Tx() (*Tx, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.currentTx()
+}
+
+func (b *BatchAcker) currentTx() (*Tx, error) {
+	if b.tx == nil {
+		tx, err := b.client.Begin()
+		if err != nil {
+			return nil, err
+		}
+		b.tx = tx
+	}
+
+	return b.tx, nil
+}
+
+// Flush acks the pending messages now.  Outside a transaction, messages
+// whose acks fail to be sent stay pending.
+func (b *BatchAcker) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flush()
+}
+
+func (b *BatchAcker) flush() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	pending, batched := b.pending, b.batched
+	b.pending = nil
+	b.batched = 0
+
+	if !b.Transactional {
+		for i, id := range pending {
+			if err := b.client.Ack(id, "", ""); err != nil {
+				// The unsent acks are retried by the next flush.
+				b.pending = pending[i:]
+				b.batched = len(b.pending)
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(pending) == 0 && b.tx == nil {
+		return nil
+	}
+
+	// A batch whose transaction fails is acked again by the next flush,
+	// in a new transaction.
+	tx, err := b.currentTx()
+	if err != nil {
+		b.pending, b.batched = pending, batched
+		return err
+	}
+	b.tx = nil
+
+	for _, id := range pending {
+		if err = tx.Ack(id, ""); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Abort()
+		b.pending, b.batched = pending, batched
+		return err
+	}
+
+	return nil
+}
+
+// Close flushes the pending messages, and stops flushing the
+// subscription's batches.
+func (b *BatchAcker) Close() error {
+	b.client.ackers.remove(b.sub.ID)
+
+	return b.Flush()
+}
+
+type ackerSet struct {
+	mu     sync.Mutex
+	ackers map[string]*BatchAcker
+}
+
+func newAckerSet() *ackerSet {
+	return &ackerSet{ackers: map[string]*BatchAcker{}}
+}
+
+func (as *ackerSet) add(subID string, b *BatchAcker) {
+	as.mu.Lock()
+	as.ackers[subID] = b
+	as.mu.Unlock()
+}
+
+func (as *ackerSet) remove(subID string) *BatchAcker {
+	if as == nil {
+		return nil
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	b := as.ackers[subID]
+	delete(as.ackers, subID)
+
+	return b
+}
+
+// flush flushes the acker of subID, or of every subscription if subID is
+// empty, returning the first error.
+func (as *ackerSet) flush(subID string) error {
+	if as == nil {
+		return nil
+	}
+
+	as.mu.Lock()
+	var ackers []*BatchAcker
+	for id, b := range as.ackers {
+		if subID == "" || id == subID {
+			ackers = append(ackers, b)
+		}
+	}
+	as.mu.Unlock()
+
+	var firstErr error
+	for _, b := range ackers {
+		if err := b.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,210 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"errors"
+	"time"
+)
+
+func Test_BatchAckerSize(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	b, err := NewBatchAcker(client, Subscription{ID: "0", AckMode: AckModeClient}, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"m1", "m2", "m3", "m4"} {
+		if err := b.Ack(testMessage(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sf := <-frames
+	if sf.Command != CmdAck || string(sf.Headers[HeaderID]) != "ack-m3" {
+		t.Error("Expected: ACK ack-m3\nGot:", sf.Command, string(sf.Headers[HeaderID]))
+	}
+
+	// The remainder is flushed on unsubscribing.
+	if _, err := client.Unsubscribe("0", ""); err != nil {
+		t.Fatal(err)
+	}
+	expectCommand(t, frames, CmdAck, "")
+	expectCommand(t, frames, CmdUnsubscribe, "")
+}
+
+func Test_BatchAckerInterval(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	b, err := NewBatchAcker(client, Subscription{ID: "0", AckMode: AckModeClientIndividual}, 100, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Ack(testMessage("m1"))
+	b.Ack(testMessage("m2"))
+
+	for _, id := range []string{"ack-m1", "ack-m2"} {
+		select {
+		case sf := <-frames:
+			if string(sf.Headers[HeaderID]) != id {
+				t.Error("Expected:", id, "\nGot:", string(sf.Headers[HeaderID]))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected acks after the interval")
+		}
+	}
+}
+
+func Test_BatchAckerTransactional(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	b, err := NewBatchAcker(client, Subscription{ID: "0", AckMode: AckModeClient}, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Transactional = true
+
+	for _, id := range []string{"m1", "m2"} {
+		tx, err := b.Tx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Send("/queue/out", []byte(id), "")
+		if err := b.Ack(testMessage(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sf := <-frames
+	txn := string(sf.Headers[HeaderTransaction])
+	if sf.Command != CmdBegin {
+		t.Fatal("Expected: BEGIN\nGot:", sf.Command)
+	}
+	expectCommand(t, frames, CmdSend, txn)
+	expectCommand(t, frames, CmdSend, txn)
+	expectCommand(t, frames, CmdAck, txn)
+	expectCommand(t, frames, CmdCommit, txn)
+}
+
+func Test_BatchAckerAutoMode(t *testing.T) {
+	client, _ := recordCommands(t)
+
+	_, err := NewBatchAcker(client, Subscription{ID: "0", AckMode: AckModeAuto}, 10, 0)
+	if err == nil {
+		t.Error("Expected error batch acking an auto ack subscription")
+	}
+}
+
+func Test_BatchAckerFailedAcksStayPending(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	failed := false
+	client.sendInterceptors = []SendInterceptor{SendInterceptorFunc(func(f *OutboundFrame) error {
+		if string(f.Headers[HeaderID]) == "ack-m2" && !failed {
+			failed = true
+			return errors.New("unavailable")
+		}
+		return nil
+	})}
+
+	b, err := NewBatchAcker(client, Subscription{ID: "0", AckMode: AckModeClientIndividual}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"m1", "m2", "m3"} {
+		b.Ack(testMessage(id))
+	}
+
+	if err := b.Flush(); err == nil {
+		t.Error("Expected the failed ack's error")
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"ack-m1", "ack-m2", "ack-m3"} {
+		select {
+		case sf := <-frames:
+			if string(sf.Headers[HeaderID]) != id {
+				t.Error("Expected:", id, "\nGot:", string(sf.Headers[HeaderID]))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected:", id, "\nGot: nothing")
+		}
+	}
+}
+
+func Test_BatchAckerFailedCommitStaysPending(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	failed := false
+	client.sendInterceptors = []SendInterceptor{SendInterceptorFunc(func(f *OutboundFrame) error {
+		if f.Command == CmdCommit && !failed {
+			failed = true
+			return errors.New("unavailable")
+		}
+		return nil
+	})}
+
+	b, err := NewBatchAcker(client, Subscription{ID: "0", AckMode: AckModeClientIndividual}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Transactional = true
+	b.Ack(testMessage("m1"))
+
+	if err := b.Flush(); err == nil {
+		t.Error("Expected the failed commit's error")
+	}
+	sf := <-frames
+	failedTxn := string(sf.Headers[HeaderTransaction])
+	expectCommand(t, frames, CmdAck, failedTxn)
+
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	sf = <-frames
+	txn := string(sf.Headers[HeaderTransaction])
+	if sf.Command != CmdBegin || txn == failedTxn {
+		t.Fatal("Expected: BEGIN of a new transaction\nGot:", sf.Command, txn)
+	}
+	if sf = <-frames; sf.Command != CmdAck || string(sf.Headers[HeaderID]) != "ack-m1" {
+		t.Error("Expected: ACK ack-m1\nGot:", sf.Command, string(sf.Headers[HeaderID]))
+	}
+	expectCommand(t, frames, CmdCommit, txn)
+}
+
+func Test_BatchAckerFlushesFullWindow(t *testing.T) {
+	client, frames := recordCommands(t)
+	client.windows = newWindowSet()
+	client.windows.add("0", AckModeClientIndividual, 2)
+
+	b, err := NewBatchAcker(client, Subscription{ID: "0", AckMode: AckModeClientIndividual}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Transactional = true
+
+	for _, id := range []string{"m1", "m2"} {
+		msg := testMessage(id, Header{Key: HeaderSubscription, Value: "0"})
+		client.windows.acquire(msg)
+		if err := b.Ack(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sf := <-frames
+	txn := string(sf.Headers[HeaderTransaction])
+	if sf.Command != CmdBegin {
+		t.Fatal("Expected: BEGIN\nGot:", sf.Command)
+	}
+	expectCommand(t, frames, CmdAck, txn)
+	expectCommand(t, frames, CmdAck, txn)
+	expectCommand(t, frames, CmdCommit, txn)
+
+	if stats, _ := client.FlowStats("0"); stats.Unacked != 0 {
+		t.Error("Expected: window released\nGot:", stats)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/russmack/stompingophers/server"
+)
+
+const adminUsage = `Usage:
+
+	stompd admin [-addr URL] [-user USER] COMMAND
+
+The passcode of USER is read from $STOMPD_ADMIN_PASSWORD, if set, and
+otherwise from the first line of standard input.
+
+Commands:
+
+	destinations             list destinations
+	connections              list connections, and their subscriptions
+	browse DEST [LIMIT]      print a queue's waiting messages
+	purge DEST               discard a queue's waiting messages
+	move FROM TO [LIMIT]     move a queue's waiting messages
+	close SESSION            close a connection
+`
+
+const adminPasswordEnv = "STOMPD_ADMIN_PASSWORD"
+
+// adminClient calls the management HTTP API of a running stompd.
+type adminClient struct {
+	addr     string
+	user     string
+	password string
+}
+
+// runAdmin runs the admin subcommand, with its arguments.
+func runAdmin(args []string) error {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), adminUsage)
+		fs.PrintDefaults()
+	}
+
+	var a adminClient
+	fs.StringVar(&a.addr, "addr", "http://localhost:61680", "URL of the admin API")
+	fs.StringVar(&a.user, "user", "", "login, unless the admin API is insecure")
+	fs.Parse(args)
+
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if a.user != "" {
+		password, err := adminPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+		a.password = password
+	}
+
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+
+	switch args[0] {
+	case "destinations":
+		var dests []server.DestinationInfo
+		if err := a.call(http.MethodGet, "/destinations", nil, &dests); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tTYPE\tDEPTH\tIN FLIGHT\tCONSUMERS\tENQUEUED\tDEQUEUED\tEXPIRED\tIN/S\tOUT/S")
+		for _, d := range dests {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%.2f\t%.2f\n",
+				d.Name, d.Type, d.Depth, d.InFlight, d.Consumers,
+				d.Enqueued, d.Dequeued, d.Expired, d.EnqueueRate, d.DequeueRate)
+		}
+		return w.Flush()
+
+	case "connections":
+		var conns []server.ConnectionInfo
+		if err := a.call(http.MethodGet, "/connections", nil, &conns); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SESSION\tREMOTE\tUSER\tCONNECTED\tSUBSCRIPTIONS")
+		for _, c := range conns {
+			subs := make([]string, 0, len(c.Subscriptions))
+			for _, sub := range c.Subscriptions {
+				subs = append(subs, fmt.Sprintf("%s:%s(%s,%d unacked)", sub.ID, sub.Destination, sub.Ack, sub.Unacked))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				c.Session, c.Remote, c.User, c.ConnectedAt.Format("2006-01-02T15:04:05"), strings.Join(subs, " "))
+		}
+		return w.Flush()
+
+	case "browse":
+		var msgs []server.MessageInfo
+		q := url.Values{"destination": {arg(1)}, "limit": {arg(2)}}
+		if err := a.call(http.MethodGet, "/messages", q, &msgs); err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(msgs)
+
+	case "purge":
+		var result map[string]int
+		if err := a.call(http.MethodPost, "/purge", url.Values{"destination": {arg(1)}}, &result); err != nil {
+			return err
+		}
+		fmt.Println("purged", result["purged"])
+
+	case "move":
+		var result map[string]int
+		q := url.Values{"from": {arg(1)}, "to": {arg(2)}, "limit": {arg(3)}}
+		if err := a.call(http.MethodPost, "/move", q, &result); err != nil {
+			return err
+		}
+		fmt.Println("moved", result["moved"])
+
+	case "close":
+		if err := a.call(http.MethodDelete, "/connections/"+url.PathEscape(arg(1)), nil, nil); err != nil {
+			return err
+		}
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	return nil
+}
+
+// adminPassword returns the passcode in $STOMPD_ADMIN_PASSWORD, or else
+// the first line read from r.  It is not taken as a flag, which would be
+// seen by other users, in the process list.
+func adminPassword(r io.Reader) (string, error) {
+	if password, ok := os.LookupEnv(adminPasswordEnv); ok {
+		return password, nil
+	}
+
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("failed reading passcode: %s", err)
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// call makes an API request, decoding its JSON response into v.
+func (a *adminClient) call(method, path string, query url.Values, v any) error {
+	u := strings.TrimSuffix(a.addr, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return fmt.Errorf("failed creating request: %s", err)
+	}
+	if a.user != "" {
+		req.SetBasicAuth(a.user, a.password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed calling admin api: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed reading admin api response: %s", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body, &apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return fmt.Errorf("failed %s %s: %s", method, path, apiErr.Error)
+	}
+
+	if v == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed parsing admin api response: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"os"
+	"strings"
+)
+
+func Test_adminPassword(t *testing.T) {
+	// Restored after the test.
+	t.Setenv(adminPasswordEnv, "")
+	os.Unsetenv(adminPasswordEnv)
+
+	for stdin, want := range map[string]string{
+		"from-stdin\r\nmore\n": "from-stdin",
+		"no-newline":           "no-newline",
+	} {
+		got, err := adminPassword(strings.NewReader(stdin))
+		if err != nil || got != want {
+			t.Error("Expected:", want, "\nGot:", got, err)
+		}
+	}
+	if _, err := adminPassword(strings.NewReader("")); err == nil {
+		t.Error("Expected an error without a passcode")
+	}
+
+	t.Setenv(adminPasswordEnv, "from-env")
+	if got, err := adminPassword(strings.NewReader("from-stdin\n")); err != nil || got != "from-env" {
+		t.Error("Expected: from-env\nGot:", got, err)
+	}
+}
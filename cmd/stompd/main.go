@@ -0,0 +1,242 @@
+// Command stompd is a lightweight STOMP broker, for small deployments
+// and development environments.
+//
+// Usage:
+//
+//	stompd [-config stompd.json]
+//	stompd admin [-addr URL] [-user USER] COMMAND
+//
+// Destinations starting /topic/ are topics, all others are queues.  See
+// stompd.json for the configuration file's settings, all of which are
+// optional.  The admin subcommand manages a running broker, through its
+// admin API, see server.AdminHandler.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/russmack/stompingophers/server"
+)
+
+type config struct {
+	// Listen is the TCP address to listen on.
+	Listen string `json:"listen"`
+	// Name is sent to clients in the server header.
+	Name string `json:"name"`
+	// AdminListen, if set, is the TCP address of the management HTTP API.
+	AdminListen string `json:"admin_listen"`
+	// InsecureAdmin serves the management API to anyone.  Otherwise it
+	// needs both HtpasswdFile and ACLFile, and denies every request
+	// without them.
+	InsecureAdmin bool `json:"insecure_admin"`
+	// HeartBeatMs is the heart-beat interval offered to clients, zero is
+	// none.
+	HeartBeatMs int `json:"heart_beat_ms"`
+	// MaxBodySize limits frame bodies, in bytes.
+	MaxBodySize int `json:"max_body_size"`
+	// MaxOutbound is the frames queued to a client before deliveries to
+	// it pause.
+	MaxOutbound int `json:"max_outbound"`
+	// LogLevel is one of debug, info, warn or error.
+	LogLevel string `json:"log_level"`
+
+	// ExpiryDestination, if set, is where expired queue messages are
+	// moved, instead of discarded.
+	ExpiryDestination string `json:"expiry_destination"`
+	// ExpirySweepMs is how often expired messages are swept.
+	ExpirySweepMs int `json:"expiry_sweep_ms"`
+
+	// DataDir, if set, persists queue messages in a write-ahead log
+	// there, so they survive restarts.
+	DataDir string `json:"data_dir"`
+	// Sync is when the log is synced: always, interval or never.
+	Sync string `json:"sync"`
+	// SyncEveryMs is the interval of the interval sync policy.
+	SyncEveryMs int `json:"sync_every_ms"`
+	// SegmentSize is the size of log files, in bytes.
+	SegmentSize int64 `json:"segment_size"`
+
+	// HtpasswdFile, if set, authenticates connections by their login and
+	// passcode.
+	HtpasswdFile string `json:"htpasswd_file"`
+	// ACLFile, if set, grants users permissions on destinations, see
+	// server.ParseACL.
+	ACLFile string `json:"acl_file"`
+}
+
+var syncPolicies = map[string]server.SyncPolicy{
+	"always":   server.SyncAlways,
+	"interval": server.SyncInterval,
+	"never":    server.SyncNever,
+}
+
+func defaultConfig() config {
+	return config{
+		Listen:        ":61613",
+		Name:          "stompd",
+		HeartBeatMs:   10000,
+		MaxBodySize:   server.DefaultMaxBodySize,
+		MaxOutbound:   server.DefaultMaxOutbound,
+		LogLevel:      "info",
+		ExpirySweepMs: 1000,
+		Sync:          "always",
+		SyncEveryMs:   1000,
+		SegmentSize:   server.DefaultSegmentSize,
+	}
+}
+
+// loadConfig reads the configuration file at path, over the defaults.
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed reading config: %s", err)
+	}
+
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed parsing config: %s", err)
+	}
+
+	if _, ok := syncPolicies[cfg.Sync]; !ok {
+		return cfg, fmt.Errorf("failed parsing config, unknown sync policy: %s", cfg.Sync)
+	}
+
+	return cfg, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := runAdmin(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	configPath := flag.String("config", "", "path of the JSON configuration file")
+	flag.Parse()
+
+	// run returns, closing what it opened, before exiting.
+	if err := run(*configPath); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// run serves the broker configured by the file at configPath, until it
+// is signalled to stop, or fails.
+func run(configPath string) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return fmt.Errorf("failed parsing log level: %s", err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	options := &server.Options{
+		Name:        cfg.Name,
+		HeartBeat:   time.Duration(cfg.HeartBeatMs) * time.Millisecond,
+		MaxBodySize: cfg.MaxBodySize,
+		MaxOutbound: cfg.MaxOutbound,
+		Logger:      logger,
+
+		ExpiryDestination: cfg.ExpiryDestination,
+		ExpirySweep:       time.Duration(cfg.ExpirySweepMs) * time.Millisecond,
+
+		InsecureAdmin: cfg.InsecureAdmin,
+	}
+
+	if cfg.DataDir != "" {
+		wal, err := server.OpenWAL(server.WALOptions{
+			Dir:         cfg.DataDir,
+			SegmentSize: cfg.SegmentSize,
+			Sync:        syncPolicies[cfg.Sync],
+			SyncEvery:   time.Duration(cfg.SyncEveryMs) * time.Millisecond,
+		})
+		if err != nil {
+			return err
+		}
+		defer wal.Close()
+
+		options.WAL = wal
+	}
+
+	if cfg.HtpasswdFile != "" {
+		auth, err := server.LoadHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return err
+		}
+		options.Authenticator = auth
+	}
+	if cfg.ACLFile != "" {
+		acl, err := server.LoadACL(cfg.ACLFile)
+		if err != nil {
+			return err
+		}
+		options.ACL = acl
+	}
+
+	srv := server.New(options)
+	defer srv.Close()
+
+	var admin *http.Server
+	if cfg.AdminListen != "" {
+		// Listening first, so a busy address fails the start up.
+		ln, err := net.Listen("tcp", cfg.AdminListen)
+		if err != nil {
+			return fmt.Errorf("failed listening for admin api: %s", err)
+		}
+		admin = &http.Server{Handler: srv.AdminHandler()}
+		defer admin.Close()
+
+		if !cfg.InsecureAdmin && (options.Authenticator == nil || options.ACL == nil) {
+			logger.Warn("stompd admin api denies every request, without htpasswd_file and acl_file")
+		}
+
+		logger.Info("stompd admin api listening", slog.String("addr", ln.Addr().String()))
+		go func() {
+			if err := admin.Serve(ln); err != nil && err != http.ErrServerClosed {
+				logger.Error("stompd admin api failed", slog.Any("error", err))
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(signals)
+		close(signals)
+	}()
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		logger.Info("stompd shutting down", slog.String("signal", sig.String()))
+		srv.Close()
+	}()
+
+	err = srv.ListenAndServe(cfg.Listen)
+	if err != nil && err != server.ErrServerClosed {
+		return fmt.Errorf("failed serving: %s", err)
+	}
+
+	return nil
+}
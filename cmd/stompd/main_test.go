@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/russmack/stompingophers/server"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "stompd.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_loadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != defaultConfig() {
+		t.Error("Expected:", defaultConfig(), "\nGot:", cfg)
+	}
+}
+
+func Test_loadConfig(t *testing.T) {
+	path := writeConfig(t, `{"listen": ":61614", "sync": "interval", "data_dir": "/var/lib/stompd"}`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaultConfig()
+	want.Listen = ":61614"
+	want.Sync = "interval"
+	want.DataDir = "/var/lib/stompd"
+	if cfg != want {
+		t.Error("Expected:", want, "\nGot:", cfg)
+	}
+	if syncPolicies[cfg.Sync] != server.SyncInterval {
+		t.Error("Expected:", server.SyncInterval, "\nGot:", syncPolicies[cfg.Sync])
+	}
+}
+
+func Test_loadConfigErrors(t *testing.T) {
+	tests := []struct {
+		path string
+		err  string
+	}{
+		{filepath.Join(t.TempDir(), "missing.json"), "failed reading config"},
+		{writeConfig(t, `{"listen": `), "failed parsing config"},
+		{writeConfig(t, `{"heart_beat_ms": "often"}`), "failed parsing config"},
+		{writeConfig(t, `{"sync": "sometimes"}`), "unknown sync policy"},
+	}
+
+	for _, tt := range tests {
+		_, err := loadConfig(tt.path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Error("Expected:", tt.err, "\nGot:", err)
+		}
+	}
+}
+
+func Test_runFails(t *testing.T) {
+	path := writeConfig(t, `{"listen": "no-port", "data_dir": "`+t.TempDir()+`", "log_level": "error"}`)
+
+	if err := run(path); err == nil || !strings.Contains(err.Error(), "failed serving") {
+		t.Error("Expected: failed serving\nGot:", err)
+	}
+}
@@ -0,0 +1,150 @@
+package stompingophers
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	ContentTypeJSON = "application/json"
+	ContentTypeGob  = "application/x-gob"
+)
+
+// Codec marshals values to and from message bodies of one content-type.
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(GobCodec{})
+}
+
+// RegisterCodec makes a codec available for decoding messages of its
+// content-type, replacing any codec previously registered for it.  This is
+// the extension point for encodings such as protobuf or msgpack.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[mediaType(c.ContentType())] = c
+}
+
+// CodecFor returns the codec registered for contentType, ignoring any
+// parameters, such as charset.
+func CodecFor(contentType string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[mediaType(contentType)]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content-type: %q", contentType)
+	}
+
+	return c, nil
+}
+
+// mediaType strips parameters from a content-type.
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string { return ContentTypeJSON }
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type GobCodec struct{}
+
+func (GobCodec) ContentType() string { return ContentTypeGob }
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(v)
+	return b.Bytes(), err
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Decode unmarshals the frame's payload into v, with the codec registered
+// for the frame's content-type.
+func (sf *ServerFrame) Decode(v interface{}) error {
+	ct, ok := sf.Headers[HeaderContentType]
+	if !ok {
+		return errors.New("failed decoding, frame has no content-type")
+	}
+
+	if _, ok := sf.Headers[HeaderEncryption]; ok {
+		return errors.New("failed decoding, body is encrypted")
+	}
+	if enc, ok := sf.Headers[HeaderContentEncoding]; ok {
+		return fmt.Errorf("failed decoding, body has undecoded content-encoding: %s", enc)
+	}
+
+	c, err := CodecFor(string(ct))
+	if err != nil {
+		return fmt.Errorf("failed decoding: %s", err)
+	}
+
+	err = c.Unmarshal(sf.Payload(), v)
+	if err != nil {
+		return fmt.Errorf("failed decoding %s: %s", c.ContentType(), err)
+	}
+
+	return nil
+}
+
+// SendValue encodes v with the client's codec, and sends it with the
+// codec's content-type.
+func (c *Client) SendValue(queue string, v interface{}, rcpt, txn string, userDef ...Header) ([]byte, error) {
+	codec := c.codec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	return c.SendValueWith(codec, queue, v, rcpt, txn, userDef...)
+}
+
+// SendValueWith is like SendValue, with the given codec.
+func (c *Client) SendValueWith(codec Codec, queue string, v interface{}, rcpt, txn string, userDef ...Header) ([]byte, error) {
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding %s: %s", codec.ContentType(), err)
+	}
+
+	userDef = append(userDef, Header{Key: HeaderContentType, Value: codec.ContentType()})
+
+	return c.Send(queue, body, rcpt, txn, userDef...)
+}
+
+func (tx *Tx) SendValue(queue string, v interface{}, rcpt string, userDef ...Header) ([]byte, error) {
+	if err := tx.active(); err != nil {
+		return nil, err
+	}
+
+	return tx.client.SendValue(queue, v, rcpt, tx.ID, userDef...)
+}
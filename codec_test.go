@@ -0,0 +1,95 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bufio"
+	"bytes"
+	"net"
+)
+
+type testOrder struct {
+	ID    int
+	Items []string
+}
+
+// sendAndReceive sends v with codec, and parses the frame as the broker
+// would receive it.
+func sendAndReceive(t *testing.T, codec Codec, v interface{}) ServerFrame {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+
+	frames := make(chan ServerFrame, 1)
+	go func() {
+		frames <- readTestFrame(t, bufio.NewReader(srvconn))
+	}()
+
+	client := Client{connection: cliconn, codec: codec}
+
+	_, err := client.SendValue("/queue/orders", v, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return <-frames
+}
+
+func Test_SendValueDecode(t *testing.T) {
+	for _, codec := range []Codec{nil, GobCodec{}} {
+		sent := testOrder{ID: 7, Items: []string{"a", "b\x00c"}}
+
+		sf := sendAndReceive(t, codec, sent)
+
+		var got testOrder
+		err := sf.Decode(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.ID != sent.ID || len(got.Items) != 2 || got.Items[1] != sent.Items[1] {
+			t.Error("Expected:", sent, "\nGot:", got)
+		}
+	}
+}
+
+func Test_SendValueContentType(t *testing.T) {
+	sf := sendAndReceive(t, nil, testOrder{ID: 1})
+
+	ct := string(sf.Headers[HeaderContentType])
+	if ct != ContentTypeJSON {
+		t.Error("Expected:", ContentTypeJSON, "\nGot:", ct)
+	}
+}
+
+func Test_DecodeUnknownContentType(t *testing.T) {
+	sf := newServerFrame(CmdMessage)
+	sf.Headers[HeaderContentType] = []byte("application/x-unknown")
+
+	var v testOrder
+	if err := sf.Decode(&v); err == nil {
+		t.Error("Expected error decoding unknown content-type")
+	}
+}
+
+func Test_Payload(t *testing.T) {
+	sf, err := ParseResponse([]byte("MESSAGE\ncontent-length:3\n\na\x00b\x00\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte("a\x00b")
+	if !bytes.Equal(sf.Payload(), expected) {
+		t.Error("Expected:", expected, "\nGot:", sf.Payload())
+	}
+}
+
+func Test_CodecForParameters(t *testing.T) {
+	c, err := CodecFor("Application/JSON; charset=utf-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ContentType() != ContentTypeJSON {
+		t.Error("Expected:", ContentTypeJSON, "\nGot:", c.ContentType())
+	}
+}
@@ -0,0 +1,183 @@
+package stompingophers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	// HeaderContentEncoding names the compression applied to a body.
+	HeaderContentEncoding = "content-encoding"
+
+	EncodingGzip = "gzip"
+	// EncodingZstd and EncodingSnappy are not built in, as they need
+	// third party packages, but their compressors may be registered under
+	// these names.
+	EncodingZstd   = "zstd"
+	EncodingSnappy = "snappy"
+
+	// DefaultMaxDecompressedSize limits the size bodies are decompressed
+	// to, unless Options.MaxDecompressedSize is set.
+	DefaultMaxDecompressedSize = 64 << 20
+)
+
+var ErrDecompressedTooLarge = errors.New("decompressed body is too large")
+
+// Compressor compresses message bodies.  Name is the value of the
+// content-encoding header it handles.  Only gzip is built in; zstd and
+// snappy compressors may be registered, under EncodingZstd and
+// EncodingSnappy, with RegisterCompressor.
+//
+// Decompress returns ErrDecompressedTooLarge, without decompressing all
+// of a body, if it decompresses to more than limit bytes.
+type Compressor interface {
+	Name() string
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte, limit int) ([]byte, error)
+}
+
+// Compression configures compression of sent bodies.
+type Compression struct {
+	Compressor Compressor
+
+	// Bodies smaller than Threshold bytes are sent uncompressed.
+	Threshold int
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(GzipCompressor{})
+}
+
+// RegisterCompressor makes a compressor available for decompressing
+// received bodies with its content-encoding.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	compressors[c.Name()] = c
+}
+
+func compressorFor(name string) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	c, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("no compressor registered for content-encoding: %q", name)
+	}
+
+	return c, nil
+}
+
+// GzipCompressor compresses with gzip.  A zero Level is the default
+// compression level.
+type GzipCompressor struct {
+	Level int
+}
+
+func (GzipCompressor) Name() string { return EncodingGzip }
+
+func (g GzipCompressor) Compress(b []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(b []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// One byte over the limit tells a body at the limit from a larger one.
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, ErrDecompressedTooLarge
+	}
+
+	return out, nil
+}
+
+// compress compresses body if it meets the threshold, adding the
+// content-encoding header.  Bodies which already have a content-encoding
+// are left alone.
+func (cp *Compression) compress(body []byte, userDef []Header) ([]byte, []Header, error) {
+	if cp == nil || cp.Compressor == nil || len(body) < cp.Threshold {
+		return body, userDef, nil
+	}
+	for _, h := range userDef {
+		if h.Key == HeaderContentEncoding {
+			return body, userDef, nil
+		}
+	}
+
+	b, err := cp.Compressor.Compress(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed compressing body: %s", err)
+	}
+
+	userDef = append(userDef, Header{Key: HeaderContentEncoding, Value: cp.Compressor.Name()})
+
+	return b, userDef, nil
+}
+
+func (c *Client) maxDecompressedSize() int {
+	if c.maxDecompressed > 0 {
+		return c.maxDecompressed
+	}
+	return DefaultMaxDecompressedSize
+}
+
+// decompressFrame replaces a compressed body with its decompressed form,
+// of at most limit bytes, removing the content-encoding header.
+func decompressFrame(sf *ServerFrame, limit int) error {
+	enc, ok := sf.Headers[HeaderContentEncoding]
+	if !ok {
+		return nil
+	}
+
+	c, err := compressorFor(string(enc))
+	if err != nil {
+		return err
+	}
+
+	b, err := c.Decompress(sf.Payload(), limit)
+	if err != nil {
+		return fmt.Errorf("failed decompressing %s body: %s", enc, err)
+	}
+
+	sf.Body = b
+	sf.Headers[HeaderContentLength] = []byte(strconv.Itoa(len(b)))
+	delete(sf.Headers, HeaderContentEncoding)
+
+	return nil
+}
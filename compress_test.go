@@ -0,0 +1,102 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+)
+
+func Test_CompressionRoundTrip(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+
+	big := bytes.Repeat([]byte("unconfirmed transaction "), 100)
+
+	go func() {
+		r := bufio.NewReader(srvconn)
+		for i := 0; i < 2; i++ {
+			// Relay the SEND back as a MESSAGE, as a broker would.
+			b, err := readFrame(r)
+			if err != nil {
+				return
+			}
+			srvconn.Write(append([]byte("MESSAGE"), b[len(CmdSend):]...))
+		}
+	}()
+
+	client := Client{
+		connection:  cliconn,
+		compression: &Compression{Compressor: GzipCompressor{}, Threshold: 64},
+	}
+
+	frameChan, _ := client.ReceiveFrames()
+
+	// Sent from another goroutine, as net.Pipe is unbuffered.
+	go func() {
+		client.Send("/queue/nooq", big, "", "")
+		client.Send("/queue/nooq", []byte("small"), "", "")
+	}()
+
+	sf := <-frameChan
+	if !bytes.Equal(sf.Payload(), big) {
+		t.Error("Expected decompressed body of", len(big), "bytes, got:", len(sf.Payload()))
+	}
+	if _, ok := sf.Headers[HeaderContentEncoding]; ok {
+		t.Error("Expected content-encoding header removed")
+	}
+
+	sf = <-frameChan
+	if string(sf.Payload()) != "small" {
+		t.Error("Expected: small\nGot:", string(sf.Payload()))
+	}
+}
+
+func Test_CompressThreshold(t *testing.T) {
+	cp := &Compression{Compressor: GzipCompressor{}, Threshold: 10}
+
+	b, h, err := cp.compress([]byte("tiny"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "tiny" || len(h) != 0 {
+		t.Error("Expected body below threshold left alone")
+	}
+
+	b, h, err = cp.compress(bytes.Repeat([]byte("a"), 100), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 1 || h[0].Value != EncodingGzip || len(b) >= 100 {
+		t.Error("Expected gzip compressed body, got headers:", h)
+	}
+}
+
+func Test_DecompressLimit(t *testing.T) {
+	bomb, err := GzipCompressor{}.Compress(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (GzipCompressor{}).Decompress(bomb, 1<<10); err != ErrDecompressedTooLarge {
+		t.Error("Expected:", ErrDecompressedTooLarge, "\nGot:", err)
+	}
+	if b, err := (GzipCompressor{}).Decompress(bomb, 1<<20); err != nil || len(b) != 1<<20 {
+		t.Error("Expected: a body at the limit\nGot:", len(b), err)
+	}
+
+	// Too large, it is left compressed.
+	sf := newServerFrame(CmdMessage)
+	sf.Headers[HeaderContentEncoding] = []byte(EncodingGzip)
+	sf.Headers[HeaderContentLength] = []byte(strconv.Itoa(len(bomb)))
+	sf.Body = append(bomb, byteNull)
+	if err := decompressFrame(&sf, 1<<10); err == nil {
+		t.Error("Expected: an error\nGot: nil")
+	}
+	if string(sf.Headers[HeaderContentEncoding]) != EncodingGzip || !bytes.Equal(sf.Payload(), bomb) {
+		t.Error("Expected: the compressed body\nGot:", len(sf.Payload()), "bytes")
+	}
+}
@@ -0,0 +1,362 @@
+package stompingophers
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupeStore records the keys of messages which have been processed.
+type DedupeStore interface {
+	// Contains reports whether key has been recorded.
+	Contains(key string) (bool, error)
+	// Add records key.
+	Add(key string) error
+}
+
+// Dedupe returns middleware which skips messages already processed,
+// identified by keyHeader, or by message-id if keyHeader is empty.
+// Skipped messages are acked without invoking the handler.  Messages are
+// recorded only once the handler succeeds, so failures are retried.
+// Copies handled concurrently are skipped while the first is in flight.
+func Dedupe(store DedupeStore, keyHeader string) Middleware {
+	if keyHeader == "" {
+		keyHeader = HeaderMessageID
+	}
+
+	// inflight holds the keys being handled, in memory only, so that a
+	// message whose handling is cut short is handled again.
+	inflight := NewMemoryDedupeStore(0, 0)
+
+	return func(next Handler) Handler {
+		return func(msg ServerFrame) error {
+			key, ok := msg.Headers[keyHeader]
+			if !ok {
+				return next(msg)
+			}
+
+			claimed, _ := inflight.AddIfAbsent(string(key))
+			if !claimed {
+				return nil
+			}
+			defer inflight.Remove(string(key))
+
+			seen, err := store.Contains(string(key))
+			if err != nil {
+				return fmt.Errorf("failed checking dedupe store: %s", err)
+			}
+			if seen {
+				return nil
+			}
+
+			err = next(msg)
+			if err != nil {
+				return err
+			}
+
+			return store.Add(string(key))
+		}
+	}
+}
+
+// MemoryDedupeStore keeps up to a capacity of keys, for up to a time to
+// live, evicting the least recently used keys first.
+type MemoryDedupeStore struct {
+	capacity int
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+type dedupeEntry struct {
+	key   string
+	added time.Time
+}
+
+// NewMemoryDedupeStore returns a store of at most capacity keys, each
+// kept for ttl.  Zero capacity or ttl are unlimited.
+func NewMemoryDedupeStore(capacity int, ttl time.Duration) *MemoryDedupeStore {
+	return &MemoryDedupeStore{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		keys:     map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupeStore) Contains(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.contains(key, time.Now()), nil
+}
+
+func (s *MemoryDedupeStore) Add(key string) error {
+	s.add(key, time.Now())
+	return nil
+}
+
+func (s *MemoryDedupeStore) AddIfAbsent(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.contains(key, now) {
+		return false, nil
+	}
+	s.insert(key, now)
+
+	return true, nil
+}
+
+func (s *MemoryDedupeStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.keys[key]; ok {
+		s.order.Remove(e)
+		delete(s.keys, key)
+	}
+
+	return nil
+}
+
+// contains reports whether key is held, and unexpired, marking it the
+// most recently used.  The lock must be held.
+func (s *MemoryDedupeStore) contains(key string, now time.Time) bool {
+	e, ok := s.keys[key]
+	if !ok {
+		return false
+	}
+	if s.expired(e.Value.(*dedupeEntry), now) {
+		s.order.Remove(e)
+		delete(s.keys, key)
+		return false
+	}
+
+	s.order.MoveToFront(e)
+
+	return true
+}
+
+func (s *MemoryDedupeStore) add(key string, added time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.insert(key, added)
+}
+
+// insert holds key, evicting the least recently used keys beyond the
+// capacity.  The lock must be held.
+func (s *MemoryDedupeStore) insert(key string, added time.Time) {
+	if e, ok := s.keys[key]; ok {
+		e.Value.(*dedupeEntry).added = added
+		s.order.MoveToFront(e)
+		return
+	}
+
+	s.keys[key] = s.order.PushFront(&dedupeEntry{key: key, added: added})
+
+	for s.capacity > 0 && s.order.Len() > s.capacity {
+		e := s.order.Back()
+		s.order.Remove(e)
+		delete(s.keys, e.Value.(*dedupeEntry).key)
+	}
+}
+
+func (s *MemoryDedupeStore) expired(e *dedupeEntry, now time.Time) bool {
+	return s.ttl > 0 && now.Sub(e.added) > s.ttl
+}
+
+// Len returns the number of keys held, including any expired but not yet
+// evicted.
+func (s *MemoryDedupeStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
+
+// compactDedupeLines is the fewest lines a dedupe file is compacted at.
+const compactDedupeLines = 1024
+
+// FileDedupeStore is a MemoryDedupeStore whose keys are appended to a
+// file, so they survive restarts.  The file is compacted when opened, and
+// once it holds more than twice as many lines as keys held.
+type FileDedupeStore struct {
+	*MemoryDedupeStore
+
+	mu   sync.Mutex
+	path string
+	file *os.File
+	// lines written to the file.
+	lines int
+}
+
+// OpenFileDedupeStore loads the unexpired keys from path, creating it if
+// needed.
+func OpenFileDedupeStore(path string, capacity int, ttl time.Duration) (*FileDedupeStore, error) {
+	mem := NewMemoryDedupeStore(capacity, ttl)
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		now := time.Now()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// Each line is unix nanoseconds added, or - for a removed
+			// key, then a space and the quoted key.
+			line := scanner.Text()
+			i := strings.IndexByte(line, ' ')
+			if i < 0 {
+				continue
+			}
+			key, err := strconv.Unquote(line[i+1:])
+			if err != nil {
+				continue
+			}
+			if line[:i] == "-" {
+				mem.Remove(key)
+				continue
+			}
+			ns, err := strconv.ParseInt(line[:i], 10, 64)
+			if err != nil {
+				continue
+			}
+			e := &dedupeEntry{key: key, added: time.Unix(0, ns)}
+			if !mem.expired(e, now) {
+				mem.add(e.key, e.added)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed reading dedupe store: %s", err)
+		}
+	}
+
+	s := &FileDedupeStore{MemoryDedupeStore: mem, path: path}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// compact rewrites the file with only the keys held, oldest first, and
+// appends to the rewritten file from then on.  The lock must be held, if
+// the store is in use.
+func (s *FileDedupeStore) compact() error {
+	tmp := s.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.MemoryDedupeStore.mu.Lock()
+	w := bufio.NewWriter(f)
+	for e := s.order.Back(); e != nil; e = e.Prev() {
+		d := e.Value.(*dedupeEntry)
+		fmt.Fprintf(w, "%d %s\n", d.added.UnixNano(), strconv.Quote(d.key))
+	}
+	lines := s.order.Len()
+	s.MemoryDedupeStore.mu.Unlock()
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = f
+	s.lines = lines
+
+	return nil
+}
+
+func (s *FileDedupeStore) Add(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if err := s.write(strconv.FormatInt(now.UnixNano(), 10), key); err != nil {
+		return err
+	}
+	s.add(key, now)
+
+	return nil
+}
+
+func (s *FileDedupeStore) AddIfAbsent(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added, _ := s.MemoryDedupeStore.AddIfAbsent(key)
+	if !added {
+		return false, nil
+	}
+
+	if err := s.write(strconv.FormatInt(time.Now().UnixNano(), 10), key); err != nil {
+		s.MemoryDedupeStore.Remove(key)
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *FileDedupeStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.write("-", key); err != nil {
+		return err
+	}
+	s.MemoryDedupeStore.Remove(key)
+
+	return nil
+}
+
+// write appends a line to the file, compacting it if it has grown to
+// hold mostly expired, evicted or removed keys.  A failed compaction is
+// retried later.  The lock must be held.
+func (s *FileDedupeStore) write(prefix, key string) error {
+	_, err := fmt.Fprintf(s.file, "%s %s\n", prefix, strconv.Quote(key))
+	if err != nil {
+		return fmt.Errorf("failed writing dedupe store: %s", err)
+	}
+	s.lines++
+
+	if s.lines >= compactDedupeLines && s.lines > 2*s.Len() {
+		if err := s.compact(); err != nil {
+			s.lines = s.Len()
+		}
+	}
+
+	return nil
+}
+
+func (s *FileDedupeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
@@ -0,0 +1,222 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+func Test_DedupeSkipsDuplicates(t *testing.T) {
+	store := NewMemoryDedupeStore(10, time.Minute)
+
+	calls := 0
+	fail := true
+	h := Chain(func(msg ServerFrame) error {
+		calls++
+		if fail {
+			fail = false
+			return errors.New("transient")
+		}
+		return nil
+	}, Dedupe(store, "order-id"))
+
+	msg := testMessage("m1", Header{Key: "order-id", Value: "o-1"})
+
+	if err := h(msg); err == nil {
+		t.Error("Expected first attempt to fail")
+	}
+	// Failure is not recorded, so the redelivery is handled.
+	if err := h(msg); err != nil {
+		t.Error(err)
+	}
+	// A duplicate, with a different message-id but the same business key.
+	if err := h(testMessage("m2", Header{Key: "order-id", Value: "o-1"})); err != nil {
+		t.Error(err)
+	}
+
+	if calls != 2 {
+		t.Error("Expected handler called 2 times, got:", calls)
+	}
+}
+
+func Test_MemoryDedupeStoreEviction(t *testing.T) {
+	s := NewMemoryDedupeStore(2, 0)
+
+	s.Add("a")
+	s.Add("b")
+	s.Contains("a") // a is now the most recently used.
+	s.Add("c")
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		if ok, _ := s.Contains(key); ok != expected {
+			t.Error("Key", key, "expected:", expected, "\nGot:", ok)
+		}
+	}
+
+	s = NewMemoryDedupeStore(0, time.Minute)
+	s.add("old", time.Now().Add(-time.Hour))
+	if ok, _ := s.Contains("old"); ok {
+		t.Error("Expected expired key to be absent")
+	}
+}
+
+func Test_FileDedupeStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedupe")
+
+	s, err := OpenFileDedupeStore(path, 100, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add("m1")
+	s.Add("m2")
+	s.Close()
+
+	s, err = OpenFileDedupeStore(path, 100, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, key := range []string{"m1", "m2"} {
+		if ok, _ := s.Contains(key); !ok {
+			t.Error("Expected key to survive reopening:", key)
+		}
+	}
+	if ok, _ := s.Contains("m3"); ok {
+		t.Error("Expected m3 to be absent")
+	}
+}
+
+func Test_DedupeConcurrentCopies(t *testing.T) {
+	store := NewMemoryDedupeStore(10, time.Minute)
+
+	var mu sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	h := Chain(func(msg ServerFrame) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return nil
+	}, Dedupe(store, "order-id"))
+
+	var wg sync.WaitGroup
+	for _, id := range []string{"m1", "m2", "m3"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			h(testMessage(id, Header{Key: "order-id", Value: "o-1"}))
+		}(id)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Error("Expected handler called 1 time, got:", calls)
+	}
+}
+
+func Test_FileDedupeStoreKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedupe")
+
+	s, err := OpenFileDedupeStore(path, 100, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a\nb", "c d", "removed"} {
+		if added, err := s.AddIfAbsent(key); !added || err != nil {
+			t.Error("Expected key added:", key, "\nGot:", added, err)
+		}
+	}
+	if added, _ := s.AddIfAbsent("c d"); added {
+		t.Error("Expected key present: c d")
+	}
+	if err := s.Remove("removed"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenFileDedupeStore(path, 100, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for key, expected := range map[string]bool{"a\nb": true, "a": false, "b": false, "c d": true, "removed": false} {
+		if ok, _ := s.Contains(key); ok != expected {
+			t.Error("Key", key, "expected:", expected, "\nGot:", ok)
+		}
+	}
+}
+
+func Test_FileDedupeStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedupe")
+
+	s, err := OpenFileDedupeStore(path, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 5*compactDedupeLines; i++ {
+		key := string(rune('a' + i%26))
+		if err := s.Add(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Add("last")
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(b, []byte("\n")); lines >= compactDedupeLines {
+		t.Error("Expected fewer than:", compactDedupeLines, "lines\nGot:", lines)
+	}
+	if !bytes.HasSuffix(b, []byte(`"last"`+"\n")) {
+		t.Error("Expected writes after compaction to be kept")
+	}
+}
+
+func Test_DedupeHandlingCutShort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedupe")
+
+	s, err := OpenFileDedupeStore(path, 100, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testMessage("m1", Header{Key: "order-id", Value: "o-1"})
+
+	// The process exits while the first copy is handled, and restarts.
+	var restarted *FileDedupeStore
+	h := Chain(func(msg ServerFrame) error {
+		s.Close()
+		restarted, err = OpenFileDedupeStore(path, 100, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("exited")
+	}, Dedupe(s, "order-id"))
+	h(msg)
+	defer restarted.Close()
+
+	handled := false
+	h = Chain(func(msg ServerFrame) error {
+		handled = true
+		return nil
+	}, Dedupe(restarted, "order-id"))
+
+	if err := h(msg); err != nil || !handled {
+		t.Error("Expected the redelivered copy handled\nGot:", handled, err)
+	}
+	if ok, _ := restarted.Contains("o-1"); !ok {
+		t.Error("Expected the key recorded once handled")
+	}
+}
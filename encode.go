@@ -0,0 +1,229 @@
+package stompingophers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// headerOrder is the order headers are encoded in, by command, as
+// declared by the server frame builders.  Other headers follow, sorted.
+var headerOrder = map[string][]string{
+	CmdConnected: {HeaderVersion, HeaderHeartBeat, HeaderSession, HeaderServer},
+	CmdMessage: {HeaderDestination, HeaderMessageID, HeaderSubscription, HeaderAck,
+		HeaderContentLength, HeaderContentType},
+	CmdReceipt: {HeaderReceiptID},
+	CmdError:   {HeaderMessage, HeaderReceiptID, HeaderContentLength, HeaderContentType},
+}
+
+// requiredHeaders must have a value for a frame to be encoded.
+var requiredHeaders = map[string][]string{
+	CmdConnected: {HeaderVersion},
+	CmdMessage:   {HeaderDestination, HeaderMessageID, HeaderSubscription},
+	CmdReceipt:   {HeaderReceiptID},
+}
+
+// NewConnectedFrame returns a CONNECTED frame.  Empty values are not sent.
+func NewConnectedFrame(version, session, server, heartBeat string) ServerFrame {
+	sf := newCmdConnected()
+
+	sf.Headers[HeaderVersion] = []byte(version)
+	setOptional(sf.Headers, HeaderSession, session)
+	setOptional(sf.Headers, HeaderServer, server)
+	setOptional(sf.Headers, HeaderHeartBeat, heartBeat)
+
+	return sf
+}
+
+// NewMessageFrame returns a MESSAGE frame, delivering body to a
+// subscription.
+func NewMessageFrame(destination, messageID, subscription string, body []byte) ServerFrame {
+	sf := newCmdMessage()
+
+	sf.Headers[HeaderDestination] = []byte(destination)
+	sf.Headers[HeaderMessageID] = []byte(messageID)
+	sf.Headers[HeaderSubscription] = []byte(subscription)
+	sf.Headers[HeaderContentLength] = []byte(strconv.Itoa(len(body)))
+	sf.Body = body
+
+	return sf
+}
+
+func NewReceiptFrame(receiptID string) ServerFrame {
+	sf := newCmdReceipt()
+
+	sf.Headers[HeaderReceiptID] = []byte(receiptID)
+
+	return sf
+}
+
+// NewErrorFrame returns an ERROR frame, with detail as its body.
+// receiptID is that of the frame in error, if it asked for a receipt.
+func NewErrorFrame(message, receiptID string, detail []byte) ServerFrame {
+	sf := newCmdError()
+
+	setOptional(sf.Headers, HeaderMessage, message)
+	setOptional(sf.Headers, HeaderReceiptID, receiptID)
+	if len(detail) > 0 {
+		sf.Headers[HeaderContentType] = []byte(ContentTypeText)
+	}
+	sf.Headers[HeaderContentLength] = []byte(strconv.Itoa(len(detail)))
+	sf.Body = detail
+
+	return sf
+}
+
+func setOptional(h map[string][]byte, key, value string) {
+	if value != "" {
+		h[key] = []byte(value)
+	}
+}
+
+// Encode formats a server frame for the wire.  Headers with nil values
+// are not sent, so the frame builders' optional headers may be left
+// unset.  The body is Payload(), and content-length is set from it when
+// the body is not empty, or the header is present.  Header names and
+// values are escaped, except in CONNECTED frames.
+func (sf *ServerFrame) Encode() ([]byte, error) {
+	var b bytes.Buffer
+
+	if err := sf.encode(&b); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// WriteTo writes the encoded frame to w.
+func (sf *ServerFrame) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+
+	if err := sf.encode(&b); err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
+
+func (sf *ServerFrame) encode(b *bytes.Buffer) error {
+	if sf.Command == "" {
+		return fmt.Errorf("failed encoding frame, no command")
+	}
+	for _, k := range requiredHeaders[sf.Command] {
+		if sf.Headers[k] == nil {
+			return fmt.Errorf("failed encoding %s frame, missing header: %s", sf.Command, k)
+		}
+	}
+
+	body := sf.Payload()
+	escaped := sf.Command != CmdConnected
+
+	b.WriteString(sf.Command)
+	b.WriteByte(byteLineFeed)
+
+	writeHeader := func(k string, v []byte) {
+		if k == HeaderContentLength {
+			if _, ok := sf.Headers[k]; !ok && len(body) == 0 {
+				return
+			}
+			v = []byte(strconv.Itoa(len(body)))
+		} else if v == nil {
+			return
+		}
+
+		writeEscaped(b, []byte(k), escaped)
+		b.WriteByte(byteColon)
+		writeEscaped(b, v, escaped)
+		b.WriteByte(byteLineFeed)
+	}
+
+	order := headerOrder[sf.Command]
+	done := make(map[string]bool, len(order)+1)
+	for _, k := range order {
+		writeHeader(k, sf.Headers[k])
+		done[k] = true
+	}
+
+	if !done[HeaderContentLength] {
+		writeHeader(HeaderContentLength, nil)
+		done[HeaderContentLength] = true
+	}
+
+	rest := make([]string, 0, len(sf.Headers))
+	for k := range sf.Headers {
+		if !done[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	for _, k := range rest {
+		writeHeader(k, sf.Headers[k])
+	}
+
+	b.WriteByte(byteLineFeed)
+	b.Write(body)
+	b.WriteByte(byteNull)
+	b.WriteByte(byteLineFeed)
+
+	return nil
+}
+
+// writeEscaped writes a header name or value, escaped as STOMP 1.2
+// requires when escaped is true.
+func writeEscaped(b *bytes.Buffer, s []byte, escaped bool) {
+	if !escaped || bytes.IndexAny(s, "\r\n:\\") < 0 {
+		b.Write(s)
+		return
+	}
+
+	for _, c := range s {
+		switch c {
+		case '\r':
+			b.WriteString(`\r`)
+		case byteLineFeed:
+			b.WriteString(`\n`)
+		case byteColon:
+			b.WriteString(`\c`)
+		case '\\':
+			b.WriteString(`\\`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// UnescapeHeader decodes STOMP 1.2 header escapes, in a header name or
+// value.  Undefined escapes are kept as they are, for peers which do not
+// escape.
+func UnescapeHeader(s []byte) []byte {
+	if bytes.IndexByte(s, '\\') < 0 {
+		return s
+	}
+
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			out = append(out, s[i])
+			continue
+		}
+
+		switch s[i+1] {
+		case 'r':
+			out = append(out, '\r')
+		case 'n':
+			out = append(out, byteLineFeed)
+		case 'c':
+			out = append(out, byteColon)
+		case '\\':
+			out = append(out, '\\')
+		default:
+			out = append(out, s[i], s[i+1])
+		}
+		i++
+	}
+
+	return out
+}
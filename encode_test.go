@@ -0,0 +1,124 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+func Test_EncodeMessage(t *testing.T) {
+	sf := NewMessageFrame("/queue/a", "id:1", "0", []byte("a\x00b"))
+	sf.Headers["zebra"] = []byte("line\nbreak")
+	sf.Headers["apple"] = []byte(`back\slash`)
+	sf.Headers[HeaderAck] = []byte("ack-1")
+
+	b, err := sf.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "MESSAGE\n" +
+		"destination:/queue/a\n" +
+		"message-id:id\\c1\n" +
+		"subscription:0\n" +
+		"ack:ack-1\n" +
+		"content-length:3\n" +
+		"apple:back\\\\slash\n" +
+		"zebra:line\\nbreak\n" +
+		"\n" +
+		"a\x00b\x00\n"
+	if string(b) != expected {
+		t.Error("Expected:", expected, "\nGot:", string(b))
+	}
+
+	// Round trips through the client's reader and parser.
+	raw, err := readFrame(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseResponse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range sf.Headers {
+		if v != nil && !bytes.Equal(parsed.Headers[k], v) {
+			t.Error("Expected:", k, string(v), "\nGot:", string(parsed.Headers[k]))
+		}
+	}
+	if !bytes.Equal(parsed.Payload(), []byte("a\x00b")) {
+		t.Error("Expected: a\\x00b\nGot:", parsed.Payload())
+	}
+}
+
+func Test_EncodeConnectedNotEscaped(t *testing.T) {
+	sf := NewConnectedFrame("1.2", "s:1", "", "0,0")
+
+	var buf bytes.Buffer
+	if _, err := sf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "CONNECTED\nversion:1.2\nheart-beat:0,0\nsession:s:1\n\n\x00\n"
+	if buf.String() != expected {
+		t.Error("Expected:", expected, "\nGot:", buf.String())
+	}
+}
+
+func Test_EncodeReceiptAndError(t *testing.T) {
+	sf := NewReceiptFrame("r-1")
+	b, _ := sf.Encode()
+	if string(b) != "RECEIPT\nreceipt-id:r-1\n\n\x00\n" {
+		t.Error("Expected: RECEIPT\nGot:", string(b))
+	}
+
+	sf = NewErrorFrame("bad frame", "r-2", []byte("detail"))
+	b, _ = sf.Encode()
+	expected := "ERROR\nmessage:bad frame\nreceipt-id:r-2\ncontent-length:6\ncontent-type:text/plain\n\ndetail\x00\n"
+	if string(b) != expected {
+		t.Error("Expected:", expected, "\nGot:", string(b))
+	}
+
+	sf = newCmdMessage()
+	if _, err := sf.Encode(); err == nil || !strings.Contains(err.Error(), HeaderDestination) {
+		t.Error("Expected: missing destination error\nGot:", err)
+	}
+}
+
+func Test_ParseResponseHeaders(t *testing.T) {
+	sf, err := ParseResponse([]byte("RECEIPT\r\n\r\n\x00"))
+	if err != nil || sf.Command != CmdReceipt || len(sf.Headers) != 0 {
+		t.Error("Expected: RECEIPT without headers\nGot:", sf.String(), err)
+	}
+
+	sf, err = ParseResponse([]byte("MESSAGE\nk:first\nk:second\nv:a\\cb\n\n\x00"))
+	if err != nil || string(sf.Headers["k"]) != "first" || string(sf.Headers["v"]) != "a:b" {
+		t.Error("Expected: first of repeated, unescaped\nGot:", sf.String(), err)
+	}
+
+	sf, err = ParseResponse([]byte("CONNECTED\nsession:a\\cb\n\n\x00"))
+	if err != nil || string(sf.Headers[HeaderSession]) != `a\cb` {
+		t.Error("Expected: CONNECTED not unescaped\nGot:", sf.String(), err)
+	}
+
+	for _, bad := range []string{"", "\n", "MESSAGE\nno-colon\n\n\x00", "MESSAGE\nk:v"} {
+		if _, err := ParseResponse([]byte(bad)); err == nil {
+			t.Error("Expected: error\nGot: nil, for", bad)
+		}
+	}
+}
+
+func Test_formatRequestEscapes(t *testing.T) {
+	var b bytes.Buffer
+	formatRequest(newCmdAck("ID:1", "", ""), &b)
+	if !strings.Contains(b.String(), "id:ID\\c1\n") {
+		t.Error("Expected: escaped id\nGot:", b.String())
+	}
+
+	b.Reset()
+	formatRequest(newCmdConnect("a:1", &Options{}), &b)
+	if !strings.Contains(b.String(), "host:a:1\n") {
+		t.Error("Expected: CONNECT not escaped\nGot:", b.String())
+	}
+}
@@ -0,0 +1,223 @@
+package stompingophers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// HeaderEncryption names the cipher a body is encrypted with.
+	HeaderEncryption = "encryption"
+	// HeaderKeyID identifies the key a body is encrypted with.
+	HeaderKeyID = "key-id"
+	// HeaderSignature holds the base64 Ed25519 signature of a body, and
+	// the headers needed to decode it.
+	HeaderSignature = "signature"
+
+	EncryptionAESGCM = "aes-gcm"
+)
+
+var (
+	ErrMissingSignature = errors.New("message is not signed")
+	ErrBadSignature     = errors.New("message signature is invalid")
+	ErrNotEncrypted     = errors.New("message is not encrypted")
+)
+
+// signedHeaders are signed with the body, as they change how it is
+// decoded.
+var signedHeaders = []string{HeaderContentType, HeaderContentEncoding, HeaderEncryption, HeaderKeyID}
+
+// KeyProvider supplies AES keys, of 16, 24 or 32 bytes, by id, so keys can
+// be rotated while messages encrypted with older keys are in flight.
+type KeyProvider interface {
+	// EncryptionKey returns the key, and its id, to encrypt bodies with.
+	EncryptionKey() (string, []byte, error)
+	// DecryptionKey returns the key with the given id.
+	DecryptionKey(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider over a fixed set of keys, encrypting with
+// the key CurrentID.
+type StaticKeys struct {
+	CurrentID string
+	Keys      map[string][]byte
+}
+
+func (k StaticKeys) EncryptionKey() (string, []byte, error) {
+	key, err := k.DecryptionKey(k.CurrentID)
+	return k.CurrentID, key, err
+}
+
+func (k StaticKeys) DecryptionKey(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %q", id)
+	}
+	return key, nil
+}
+
+// Envelope encrypts and signs sent bodies, and verifies and decrypts
+// received bodies, so brokers cannot read or alter them.
+type Envelope struct {
+	// Keys, if set, encrypts sent bodies with AES-GCM, and unencrypted
+	// messages are rejected.
+	Keys KeyProvider
+
+	// SigningKey, if set, signs sent bodies, with their content-type,
+	// content-encoding and encryption headers.
+	SigningKey ed25519.PrivateKey
+
+	// VerifyKey, if set, is used to verify received bodies, and unsigned
+	// messages are rejected.
+	VerifyKey ed25519.PublicKey
+
+	// OnReject is given messages which fail verification or decryption,
+	// to ack or nack them.  Rejected messages are never delivered.
+	OnReject func(msg ServerFrame, err error)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// signed returns the bytes a signature is of: the signed headers, looked
+// up by header, then the body, each length prefixed.
+func signed(body []byte, header func(string) []byte) []byte {
+	var b []byte
+	for _, k := range signedHeaders {
+		v := header(k)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	b = binary.AppendUvarint(b, uint64(len(body)))
+	return append(b, body...)
+}
+
+// seal encrypts then signs body, of the given content type, adding the
+// envelope headers.
+func (e *Envelope) seal(body []byte, contentType string, userDef []Header) ([]byte, []Header, error) {
+	if e == nil {
+		return body, userDef, nil
+	}
+
+	if e.Keys != nil {
+		id, key, err := e.Keys.EncryptionKey()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed getting encryption key: %s", err)
+		}
+
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed creating cipher: %s", err)
+		}
+
+		nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(body)+gcm.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, nil, fmt.Errorf("failed creating nonce: %s", err)
+		}
+
+		// The key id is authenticated, so it cannot be swapped.
+		body = gcm.Seal(nonce, nonce, body, []byte(id))
+
+		userDef = append(userDef,
+			Header{Key: HeaderEncryption, Value: EncryptionAESGCM},
+			Header{Key: HeaderKeyID, Value: id})
+	}
+
+	if e.SigningKey != nil {
+		header := func(k string) []byte {
+			if k == HeaderContentType {
+				return []byte(contentType)
+			}
+			// The last of repeated headers is sent.
+			for i := len(userDef) - 1; i >= 0; i-- {
+				if userDef[i].Key == k {
+					return []byte(userDef[i].Value)
+				}
+			}
+			return nil
+		}
+		sig := ed25519.Sign(e.SigningKey, signed(body, header))
+		userDef = append(userDef, Header{Key: HeaderSignature, Value: base64.StdEncoding.EncodeToString(sig)})
+	}
+
+	return body, userDef, nil
+}
+
+// open verifies then decrypts the frame's body, removing the envelope
+// headers.  Messages without a signature, or encryption, the envelope
+// expects are rejected, so they cannot be injected in the clear.
+func (e *Envelope) open(sf *ServerFrame) error {
+	if e == nil {
+		return nil
+	}
+	body := sf.Payload()
+
+	if e.VerifyKey != nil {
+		sig, ok := sf.Headers[HeaderSignature]
+		if !ok {
+			return ErrMissingSignature
+		}
+		header := func(k string) []byte { return sf.Headers[k] }
+		s, err := base64.StdEncoding.DecodeString(string(sig))
+		if err != nil || !ed25519.Verify(e.VerifyKey, signed(body, header), s) {
+			return ErrBadSignature
+		}
+		delete(sf.Headers, HeaderSignature)
+	}
+
+	if e.Keys == nil {
+		return nil
+	}
+	alg, ok := sf.Headers[HeaderEncryption]
+	if !ok {
+		return ErrNotEncrypted
+	}
+	if string(alg) != EncryptionAESGCM {
+		return fmt.Errorf("unsupported encryption: %q", alg)
+	}
+
+	id := string(sf.Headers[HeaderKeyID])
+	key, err := e.Keys.DecryptionKey(id)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	if len(body) < gcm.NonceSize() {
+		return errors.New("encrypted body is too short")
+	}
+
+	b, err := gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():], []byte(id))
+	if err != nil {
+		return fmt.Errorf("failed decrypting body: %s", err)
+	}
+
+	sf.Body = b
+	sf.Headers[HeaderContentLength] = []byte(strconv.Itoa(len(b)))
+	delete(sf.Headers, HeaderEncryption)
+	delete(sf.Headers, HeaderKeyID)
+
+	return nil
+}
+
+// reject passes a message which failed opening to the OnReject handler.
+func (e *Envelope) reject(sf ServerFrame, err error) {
+	if e != nil && e.OnReject != nil {
+		e.OnReject(sf, err)
+	}
+}
@@ -0,0 +1,135 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bytes"
+	"crypto/ed25519"
+	"strconv"
+)
+
+func testEnvelope(t *testing.T) *Envelope {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Envelope{
+		Keys: StaticKeys{
+			CurrentID: "k2",
+			Keys: map[string][]byte{
+				"k1": bytes.Repeat([]byte{1}, 32),
+				"k2": bytes.Repeat([]byte{2}, 32),
+			},
+		},
+		SigningKey: priv,
+		VerifyKey:  pub,
+	}
+}
+
+// sealedFrame seals body as a MESSAGE frame, as a broker would deliver it.
+func sealedFrame(t *testing.T, e *Envelope, body []byte) ServerFrame {
+	b, h, err := e.seal(body, ContentTypeText, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf := newServerFrame(CmdMessage)
+	sf.Headers[HeaderContentType] = []byte(ContentTypeText)
+	for _, j := range h {
+		sf.Headers[j.Key] = []byte(j.Value)
+	}
+	sf.Headers[HeaderContentLength] = []byte(strconv.Itoa(len(b)))
+	sf.Body = append(b, byteNull)
+
+	return sf
+}
+
+func Test_EnvelopeRoundTrip(t *testing.T) {
+	e := testEnvelope(t)
+
+	sf := sealedFrame(t, e, []byte("secret"))
+	if bytes.Contains(sf.Body, []byte("secret")) {
+		t.Error("Expected body to be encrypted")
+	}
+	if string(sf.Headers[HeaderKeyID]) != "k2" {
+		t.Error("Expected key-id: k2\nGot:", string(sf.Headers[HeaderKeyID]))
+	}
+
+	if err := e.open(&sf); err != nil {
+		t.Fatal(err)
+	}
+	if string(sf.Payload()) != "secret" {
+		t.Error("Expected: secret\nGot:", string(sf.Payload()))
+	}
+}
+
+func Test_EnvelopeRotatedKey(t *testing.T) {
+	e := testEnvelope(t)
+
+	old := *e
+	old.Keys = StaticKeys{CurrentID: "k1", Keys: e.Keys.(StaticKeys).Keys}
+
+	sf := sealedFrame(t, &old, []byte("older"))
+	if err := e.open(&sf); err != nil {
+		t.Fatal(err)
+	}
+	if string(sf.Payload()) != "older" {
+		t.Error("Expected: older\nGot:", string(sf.Payload()))
+	}
+}
+
+func Test_EnvelopeTampered(t *testing.T) {
+	e := testEnvelope(t)
+
+	sf := sealedFrame(t, e, []byte("secret"))
+	sf.Body[len(sf.Body)-2] ^= 0xff
+	if err := e.open(&sf); err != ErrBadSignature {
+		t.Error("Expected:", ErrBadSignature, "\nGot:", err)
+	}
+
+	sf = sealedFrame(t, e, []byte("secret"))
+	delete(sf.Headers, HeaderSignature)
+	if err := e.open(&sf); err != ErrMissingSignature {
+		t.Error("Expected:", ErrMissingSignature, "\nGot:", err)
+	}
+
+	// The headers decoding the body are signed with it.
+	sf = sealedFrame(t, e, []byte("secret"))
+	sf.Headers[HeaderContentType] = []byte(ContentTypeJSON)
+	if err := e.open(&sf); err != ErrBadSignature {
+		t.Error("Expected:", ErrBadSignature, "\nGot:", err)
+	}
+
+	// Without signatures, tampering is still caught by the cipher.
+	e.SigningKey, e.VerifyKey = nil, nil
+	sf = sealedFrame(t, e, []byte("secret"))
+	sf.Body[0] ^= 0xff
+	if err := e.open(&sf); err == nil {
+		t.Error("Expected decryption of tampered body to fail")
+	}
+}
+
+func Test_EnvelopeRejectsPlaintext(t *testing.T) {
+	e := testEnvelope(t)
+
+	// Encrypted, but not signed.
+	plain := &Envelope{Keys: e.Keys}
+	sf := sealedFrame(t, plain, []byte("injected"))
+	if err := e.open(&sf); err != ErrMissingSignature {
+		t.Error("Expected:", ErrMissingSignature, "\nGot:", err)
+	}
+
+	// Signed, but not encrypted.
+	plain = &Envelope{SigningKey: e.SigningKey}
+	sf = sealedFrame(t, plain, []byte("injected"))
+	if err := e.open(&sf); err != ErrNotEncrypted {
+		t.Error("Expected:", ErrNotEncrypted, "\nGot:", err)
+	}
+
+	// Neither, with only Keys expected.
+	sf = sealedFrame(t, &Envelope{}, []byte("injected"))
+	if err := (&Envelope{Keys: e.Keys}).open(&sf); err != ErrNotEncrypted {
+		t.Error("Expected:", ErrNotEncrypted, "\nGot:", err)
+	}
+}
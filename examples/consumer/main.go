@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"log"
+	"log/slog"
+	"time"
 
 	stomper "github.com/russmack/stompingophers"
 )
@@ -44,6 +46,7 @@ func connect() *stomper.Client {
 			SendInterval: 4000,
 			RecvTimeout:  4000,
 		},
+		Logger: slog.Default(),
 	}
 
 	client, resp, err := stomper.Connect(conn, &options)
@@ -80,6 +83,16 @@ func subscribe(client *stomper.Client) stomper.Subscription {
 func consumer(client *stomper.Client, sub stomper.Subscription) {
 	defer client.Disconnect()
 
+	var acker *stomper.BatchAcker
+	if sub.AckMode != stomper.AckModeAuto {
+		var err error
+		acker, err = stomper.NewBatchAcker(client, sub, 100, 500*time.Millisecond)
+		if err != nil {
+			log.Fatal("failed creating batch acker: " + err.Error())
+		}
+		defer acker.Close()
+	}
+
 	recvChan, errChan := client.Receive()
 
 	for {
@@ -93,9 +106,8 @@ func consumer(client *stomper.Client, sub stomper.Subscription) {
 				continue
 			}
 
-			if sub.AckMode != stomper.AckModeAuto {
-				msgAckID := string(f.Headers["ack"])
-				err = client.Ack(msgAckID, "", "")
+			if acker != nil {
+				err = acker.Ack(f)
 				if err != nil {
 					fmt.Println("failed sending ack:", err)
 					continue
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"strconv"
 
 	//"github.com/pkg/profile"
@@ -35,6 +36,7 @@ func producer() {
 			SendInterval: 5000,
 			RecvTimeout:  5000,
 		},
+		Logger: slog.Default(),
 	}
 
 	client, resp, err := stomper.Connect(conn, &options)
@@ -0,0 +1,25 @@
+package stompingophers
+
+// HeaderSelector is the SUBSCRIBE header asking the broker to deliver only
+// messages matching a selector, such as "type = 'order' AND priority > 4".
+const HeaderSelector = "selector"
+
+// Selector returns the header subscribing to only the messages matching
+// expr, for Subscribe.  See package selector for the syntax.
+func Selector(expr string) Header {
+	return Header{Key: HeaderSelector, Value: expr}
+}
+
+// Filter returns middleware which skips messages not matching match, such
+// as a parsed selector's Matches, for brokers without selectors.  Skipped
+// messages are acked without invoking the handler.
+func Filter(match func(headers map[string][]byte) bool) Middleware {
+	return func(next Handler) Handler {
+		return func(msg ServerFrame) error {
+			if !match(msg.Headers) {
+				return nil
+			}
+			return next(msg)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"github.com/russmack/stompingophers/selector"
+)
+
+func Test_Filter(t *testing.T) {
+	var handled []string
+	h := Chain(func(msg ServerFrame) error {
+		handled = append(handled, string(msg.Headers[HeaderMessageID]))
+		return nil
+	}, Filter(selector.MustParse("type = 'order' AND priority > 4").Matches))
+
+	for _, msg := range []ServerFrame{
+		testMessage("m1", Header{Key: "type", Value: "order"}, Priority(9)),
+		testMessage("m2", Header{Key: "type", Value: "order"}, Priority(1)),
+		testMessage("m3", Priority(9)),
+	} {
+		if err := h(msg); err != nil {
+			t.Error("Expected: nil\nGot:", err)
+		}
+	}
+
+	if len(handled) != 1 || handled[0] != "m1" {
+		t.Error("Expected: [m1]\nGot:", handled)
+	}
+}
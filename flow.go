@@ -0,0 +1,176 @@
+package stompingophers
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderActiveMQPrefetch = "activemq.prefetchSize"
+	HeaderPrefetchCount    = "prefetch-count"
+)
+
+// FlowStats describes a subscription's flow control window.
+type FlowStats struct {
+	MaxUnacked int
+	Unacked    int
+
+	Delivered uint64
+	Acked     uint64
+
+	// Pauses counts the times reading paused on a full window, and
+	// Paused is the total time spent paused.
+	Pauses uint64
+	Paused time.Duration
+}
+
+// window tracks a subscription's unacked messages, by ack id, in the
+// order they were delivered.
+type window struct {
+	ackMode int
+	stats   FlowStats
+	ids     []string
+	closed  bool
+}
+
+type windowSet struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	windows map[string]*window
+}
+
+func newWindowSet() *windowSet {
+	ws := &windowSet{windows: map[string]*window{}}
+	ws.cond = sync.NewCond(&ws.mu)
+	return ws
+}
+
+// withPrefetch asks the broker not to send more than n unacked messages,
+// unless the caller has set its own prefetch.  Brokers ignore it in the
+// auto ack mode, when only the client's window limits the messages
+// received, until they are released.
+func withPrefetch(userDef []Header, n int) []Header {
+	for _, h := range userDef {
+		if h.Key == HeaderActiveMQPrefetch || h.Key == HeaderPrefetchCount {
+			return userDef
+		}
+	}
+
+	v := strconv.Itoa(n)
+	return append(userDef,
+		Header{Key: HeaderActiveMQPrefetch, Value: v},
+		Header{Key: HeaderPrefetchCount, Value: v})
+}
+
+func (ws *windowSet) add(subID string, ackMode, max int) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.windows[subID] = &window{ackMode: ackMode, stats: FlowStats{MaxUnacked: max}}
+}
+
+func (ws *windowSet) remove(subID string) {
+	if ws == nil {
+		return
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if w, ok := ws.windows[subID]; ok {
+		w.closed = true
+		delete(ws.windows, subID)
+		ws.cond.Broadcast()
+	}
+}
+
+// acquire counts msg against its subscription's window, first waiting
+// while the window is full.
+func (ws *windowSet) acquire(msg ServerFrame) {
+	if ws == nil {
+		return
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	w, ok := ws.windows[string(msg.Headers[HeaderSubscription])]
+	if !ok {
+		return
+	}
+
+	if len(w.ids) >= w.stats.MaxUnacked {
+		w.stats.Pauses++
+		start := time.Now()
+		for len(w.ids) >= w.stats.MaxUnacked && !w.closed {
+			ws.cond.Wait()
+		}
+		w.stats.Paused += time.Since(start)
+		if w.closed {
+			return
+		}
+	}
+
+	w.ids = append(w.ids, ackID(msg))
+	w.stats.Delivered++
+}
+
+// release frees the window slot of the message with ackID, and in the
+// client ack mode those of all earlier messages too.
+func (ws *windowSet) release(ackID string) {
+	if ws == nil {
+		return
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for _, w := range ws.windows {
+		for i, id := range w.ids {
+			if id != ackID {
+				continue
+			}
+
+			if w.ackMode == AckModeClient {
+				w.stats.Acked += uint64(i + 1)
+				w.ids = append(w.ids[:0], w.ids[i+1:]...)
+			} else {
+				w.stats.Acked++
+				w.ids = append(w.ids[:i], w.ids[i+1:]...)
+			}
+			ws.cond.Broadcast()
+
+			return
+		}
+	}
+}
+
+// Release frees msg's slot in its subscription's flow control window.
+// Acking and nacking do so too, as do Consume and WorkerPool, so this is
+// only needed in the auto ack mode, when receiving with ReceiveFrames, to
+// say that the message has been processed.  Until then it fills a slot.
+func (c *Client) Release(msg ServerFrame) {
+	c.windows.release(ackID(msg))
+}
+
+// FlowStats returns the flow control state of the subscription, false if
+// it has no window.
+func (c *Client) FlowStats(subID string) (FlowStats, bool) {
+	if c.windows == nil {
+		return FlowStats{}, false
+	}
+
+	c.windows.mu.Lock()
+	defer c.windows.mu.Unlock()
+
+	w, ok := c.windows.windows[subID]
+	if !ok {
+		return FlowStats{}, false
+	}
+
+	stats := w.stats
+	stats.Unacked = len(w.ids)
+
+	return stats, true
+}
@@ -0,0 +1,133 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bufio"
+	"net"
+	"strconv"
+	"time"
+)
+
+func Test_FlowWindow(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+
+	subscribed := make(chan ServerFrame, 1)
+
+	go func() {
+		r := bufio.NewReader(srvconn)
+		subscribed <- readTestFrame(t, r)
+		go func() {
+			for {
+				if _, err := readFrame(r); err != nil {
+					return
+				}
+			}
+		}()
+
+		for i := 1; i <= 3; i++ {
+			srvconn.Write([]byte("MESSAGE\nsubscription:0\nack:a" + strconv.Itoa(i) + "\n\nx\000\n"))
+		}
+	}()
+
+	client := Client{connection: cliconn}
+
+	sub, _, err := client.SubscribeWindow("/queue/work", "", AckModeClientIndividual, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf := <-subscribed
+	if string(sf.Headers[HeaderActiveMQPrefetch]) != "2" {
+		t.Error("Expected prefetch: 2\nGot:", string(sf.Headers[HeaderActiveMQPrefetch]))
+	}
+
+	frameChan, _ := client.ReceiveFrames()
+	<-frameChan
+	second := <-frameChan
+
+	select {
+	case <-frameChan:
+		t.Fatal("Expected third message held while the window is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stats, _ := client.FlowStats(sub.ID)
+	if stats.Unacked != 2 || stats.Pauses != 1 {
+		t.Error("Expected 2 unacked and 1 pause, got:", stats)
+	}
+
+	if err := client.Ack(ackID(second), "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case sf := <-frameChan:
+		if ackID(sf) != "a3" {
+			t.Error("Expected: a3\nGot:", ackID(sf))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected third message once a slot was released")
+	}
+
+	stats, _ = client.FlowStats(sub.ID)
+	if stats.Delivered != 3 || stats.Acked != 1 || stats.Unacked != 2 {
+		t.Error("Expected 3 delivered, 1 acked, 2 unacked, got:", stats)
+	}
+}
+
+func Test_FlowWindowCumulativeRelease(t *testing.T) {
+	ws := newWindowSet()
+	ws.add("0", AckModeClient, 10)
+
+	for i := 1; i <= 4; i++ {
+		msg := testMessage("m"+strconv.Itoa(i), Header{Key: HeaderSubscription, Value: "0"})
+		ws.acquire(msg)
+	}
+
+	ws.release("ack-m3")
+
+	if n := len(ws.windows["0"].ids); n != 1 {
+		t.Error("Expected 1 unacked after cumulative ack, got:", n)
+	}
+}
+
+func Test_FlowWindowAutoConsume(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+
+	go func() {
+		r := bufio.NewReader(srvconn)
+		readTestFrame(t, r)
+		go func() {
+			for {
+				if _, err := readFrame(r); err != nil {
+					return
+				}
+			}
+		}()
+
+		for i := 1; i <= 3; i++ {
+			srvconn.Write([]byte("MESSAGE\nsubscription:0\nmessage-id:m" + strconv.Itoa(i) + "\n\nx\000\n"))
+		}
+	}()
+
+	client := Client{connection: cliconn, maxUnacked: 1}
+
+	handled := make(chan string, 3)
+	go client.Consume("/queue/work", AckModeAuto, func(msg ServerFrame) error {
+		handled <- string(msg.Headers[HeaderMessageID])
+		return nil
+	})
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("Expected every message handled without releasing, got:", i-1)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package stompingophers
+
+import (
+	"fmt"
+)
+
+// Handler processes a received MESSAGE frame.
+type Handler func(msg ServerFrame) error
+
+// Middleware wraps a handler, to add behaviour around it.
+type Middleware func(Handler) Handler
+
+// Chain wraps h in mw, the first middleware being the outermost.
+func Chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Consume subscribes to queue, and passes each message to h until the
+// connection fails.  In the client ack modes a message is acked when h
+// returns nil, and nacked when it returns an error.
+func (c *Client) Consume(queue string, ackMode int, h Handler) error {
+	_, _, err := c.Subscribe(queue, "", ackMode)
+	if err != nil {
+		return err
+	}
+
+	frameChan, errChan := c.ReceiveFrames()
+
+	for sf := range frameChan {
+		if sf.Command == CmdError {
+			return fmt.Errorf("server error: %s", sf.Headers[HeaderMessage])
+		}
+		if sf.Command != CmdMessage {
+			continue
+		}
+
+		err := c.settle(sf, ackMode, c.runHandler(h, sf))
+		if err != nil {
+			return err
+		}
+	}
+
+	return <-errChan
+}
+
+// settle acks or nacks msg according to the result of handling it.
+func (c *Client) settle(msg ServerFrame, ackMode int, herr error) error {
+	if ackMode == AckModeAuto {
+		c.Release(msg)
+		return nil
+	}
+
+	if herr != nil {
+		return c.Nack(ackID(msg), "", "")
+	}
+
+	return c.Ack(ackID(msg), "", "")
+}
+
+// ackID returns the id with which to ack or nack msg: the ack header in
+// STOMP 1.2, otherwise the message-id.
+func ackID(msg ServerFrame) string {
+	if v, ok := msg.Headers[HeaderAck]; ok {
+		return string(v)
+	}
+
+	return string(msg.Headers[HeaderMessageID])
+}
+
+// serverHeaders are set by the broker on delivery, and are not copied
+// when a message is sent on again.
+var serverHeaders = map[string]bool{
+	HeaderDestination:   true,
+	HeaderMessageID:     true,
+	HeaderSubscription:  true,
+	HeaderAck:           true,
+	HeaderContentLength: true,
+	HeaderContentType:   true,
+	HeaderRedelivered:   true,
+	"expires":           true,
+	"priority":          true,
+	"timestamp":         true,
+}
+
+// userHeaders returns msg's application headers, and its content-type.
+func userHeaders(msg ServerFrame) []Header {
+	h := make([]Header, 0, len(msg.Headers))
+	for k, v := range msg.Headers {
+		if serverHeaders[k] {
+			continue
+		}
+		h = append(h, Header{Key: k, Value: string(v)})
+	}
+	if ct, ok := msg.Headers[HeaderContentType]; ok {
+		h = append(h, Header{Key: HeaderContentType, Value: string(ct)})
+	}
+
+	return h
+}
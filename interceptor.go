@@ -0,0 +1,228 @@
+package stompingophers
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// OutboundFrame is a client frame about to be sent, as seen by send
+// interceptors.  A nil header value is not sent.
+type OutboundFrame struct {
+	Command string
+	Headers map[string][]byte
+	Body    []byte
+}
+
+// SendInterceptor inspects, and may mutate, frames before they are sent.
+// Returning an error rejects the frame, which is not sent, and the error
+// is returned to the caller.
+type SendInterceptor interface {
+	InterceptSend(f *OutboundFrame) error
+}
+
+// ReceiveInterceptor inspects, and may mutate, received frames before
+// they are delivered.  Returning an error rejects the frame, which is not
+// delivered.
+type ReceiveInterceptor interface {
+	InterceptReceive(sf *ServerFrame) error
+}
+
+// SentInterceptor may be implemented by a SendInterceptor needing the
+// outcome of a frame it intercepted.  Sent is called once the frame is
+// written, or rejected, with the error, if any.
+type SentInterceptor interface {
+	Sent(f *OutboundFrame, err error)
+}
+
+type SendInterceptorFunc func(f *OutboundFrame) error
+
+func (fn SendInterceptorFunc) InterceptSend(f *OutboundFrame) error {
+	return fn(f)
+}
+
+type ReceiveInterceptorFunc func(sf *ServerFrame) error
+
+func (fn ReceiveInterceptorFunc) InterceptReceive(sf *ServerFrame) error {
+	return fn(sf)
+}
+
+// fields returns the known headers, by name, in the order they are
+// written.
+func (h *headers) fields() []struct {
+	name  string
+	value *[]byte
+} {
+	return []struct {
+		name  string
+		value *[]byte
+	}{
+		{HeaderAcceptVersion, &h.AcceptVersion},
+		{HeaderHost, &h.Host},
+		{HeaderContentLength, &h.ContentLength},
+		{HeaderReceipt, &h.Receipt},
+		{HeaderReceiptID, &h.ReceiptID},
+		{HeaderDestination, &h.Destination},
+		{HeaderContentType, &h.ContentType},
+		{HeaderID, &h.ID},
+		{HeaderAck, &h.Ack},
+		{HeaderTransaction, &h.Transaction},
+		{HeaderHeartBeat, &h.HeartBeat},
+	}
+}
+
+func (f *frame) outbound() *OutboundFrame {
+	of := &OutboundFrame{
+		Command: f.command,
+		Headers: make(map[string][]byte, len(f.headers.UserDefined)+4),
+		Body:    f.body,
+	}
+
+	for _, fld := range f.headers.fields() {
+		if *fld.value != nil {
+			of.Headers[fld.name] = *fld.value
+		}
+	}
+	for k, v := range f.headers.UserDefined {
+		of.Headers[k] = v
+	}
+
+	return of
+}
+
+// setOutbound replaces the frame's command, headers and body with those
+// of of.  A frame whose body changed has its content-length updated.
+func (f *frame) setOutbound(of *OutboundFrame) {
+	hadLength := f.headers.ContentLength != nil
+	bodyLen := len(f.body)
+
+	f.command = of.Command
+	f.body = of.Body
+
+	hs := headers{}
+	for _, fld := range hs.fields() {
+		if v, ok := of.Headers[fld.name]; ok && v != nil {
+			*fld.value = v
+		}
+	}
+	for k, v := range of.Headers {
+		if v == nil || hs.known(k) {
+			continue
+		}
+		if hs.UserDefined == nil {
+			hs.UserDefined = map[string][]byte{}
+		}
+		hs.UserDefined[k] = v
+	}
+	f.headers = hs
+
+	if hadLength && len(f.body) != bodyLen {
+		f.headers.ContentLength = []byte(strconv.Itoa(len(f.body)))
+	}
+}
+
+func (h *headers) known(name string) bool {
+	for _, fld := range h.fields() {
+		if fld.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// send passes f through the send interceptors, compresses and seals a
+// SEND frame's body, then sends it.  A nil frame is a heart-beat, and
+// is sent as is.
+func (c *Client) send(f *frame) (resp []byte, err error) {
+	if f != nil && len(c.sendInterceptors) > 0 {
+		of := f.outbound()
+		for n, i := range c.sendInterceptors {
+			if ierr := i.InterceptSend(of); ierr != nil {
+				c.log(slog.LevelDebug, "stomp frame rejected by interceptor",
+					slog.String("command", f.command), slog.Any("error", ierr))
+				err = fmt.Errorf("frame rejected: %s", ierr)
+				afterSend(c.sendInterceptors[:n], of, err)
+				return nil, err
+			}
+		}
+		f.setOutbound(of)
+
+		defer func() { afterSend(c.sendInterceptors, of, err) }()
+	}
+
+	if f != nil && f.command == CmdSend && (c.compression != nil || c.envelope != nil) {
+		err := c.encodeBody(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if f != nil && c.logEnabled(slog.LevelDebug) {
+		of := f.outbound()
+		c.logFrame("stomp frame sent", of.Command, of.Headers, len(of.Body))
+	}
+
+	start := time.Now()
+
+	resp, n, err := sendRequestN(c.connection, f)
+	if err != nil {
+		c.log(slog.LevelError, "stomp send failed", slog.Any("error", err))
+		return resp, err
+	}
+
+	if c.metrics != nil {
+		c.recordSent(f, n, resp, time.Since(start))
+	}
+
+	return resp, nil
+}
+
+// afterSend tells the interceptors which intercepted of how sending it ended.
+func afterSend(is []SendInterceptor, of *OutboundFrame, err error) {
+	for _, i := range is {
+		if si, ok := i.(SentInterceptor); ok {
+			si.Sent(of, err)
+		}
+	}
+}
+
+// encodeBody compresses, then seals, the body of a SEND frame.
+func (c *Client) encodeBody(f *frame) error {
+	userDef := make([]Header, 0, len(f.headers.UserDefined))
+	for k, v := range f.headers.UserDefined {
+		userDef = append(userDef, Header{Key: k, Value: string(v)})
+	}
+
+	body, userDef, err := c.compression.compress(f.body, userDef)
+	if err != nil {
+		return err
+	}
+	body, userDef, err = c.envelope.seal(body, string(f.headers.ContentType), userDef)
+	if err != nil {
+		return fmt.Errorf("failed sealing envelope: %s", err)
+	}
+
+	if f.headers.UserDefined == nil && len(userDef) > 0 {
+		f.headers.UserDefined = make(map[string][]byte, len(userDef))
+	}
+	for _, j := range userDef {
+		f.headers.UserDefined[j.Key] = []byte(j.Value)
+	}
+	f.body = body
+	f.headers.ContentLength = []byte(strconv.Itoa(len(body)))
+
+	return nil
+}
+
+// interceptReceive passes sf through the receive interceptors, in order,
+// stopping at the first to reject it.
+func (c *Client) interceptReceive(sf *ServerFrame) error {
+	for _, i := range c.receiveInterceptors {
+		if err := i.InterceptReceive(sf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"errors"
+	"net"
+	"time"
+)
+
+func Test_SendInterceptors(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	var order []string
+	client.sendInterceptors = []SendInterceptor{
+		SendInterceptorFunc(func(f *OutboundFrame) error {
+			order = append(order, "first")
+			f.Headers["x-trace"] = []byte("t1")
+			return nil
+		}),
+		SendInterceptorFunc(func(f *OutboundFrame) error {
+			order = append(order, "second:"+string(f.Headers["x-trace"]))
+			if f.Command == CmdSend {
+				f.Body = append(f.Body, "!"...)
+			}
+			if string(f.Headers[HeaderDestination]) == "/queue/forbidden" {
+				return errors.New("forbidden destination")
+			}
+			return nil
+		}),
+	}
+
+	if _, err := client.Send("/queue/forbidden", []byte("hi"), "", ""); err == nil {
+		t.Error("Expected rejected frame to fail sending")
+	}
+	if _, err := client.Send("/queue/nooq", []byte("hi"), "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	sf := <-frames
+	if string(sf.Headers[HeaderDestination]) != "/queue/nooq" {
+		t.Fatal("Expected the rejected frame not to be sent, got:", sf.String())
+	}
+	if string(sf.Headers["x-trace"]) != "t1" {
+		t.Error("Expected injected header, got:", sf.String())
+	}
+	if string(sf.Payload()) != "hi!" || string(sf.Headers[HeaderContentLength]) != "3" {
+		t.Error("Expected mutated body with updated content-length, got:", sf.String())
+	}
+
+	expected := []string{"first", "second:t1", "first", "second:t1"}
+	if len(order) != len(expected) {
+		t.Fatal("Expected:", expected, "\nGot:", order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Error("Expected:", expected, "\nGot:", order)
+		}
+	}
+}
+
+func Test_ReceiveInterceptors(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+
+	go func() {
+		srvconn.Write([]byte("MESSAGE\nmessage-id:1\n\nskip\000\n"))
+		srvconn.Write([]byte("MESSAGE\nmessage-id:2\n\nkeep\000\n"))
+	}()
+
+	client := Client{
+		connection: cliconn,
+		receiveInterceptors: []ReceiveInterceptor{
+			ReceiveInterceptorFunc(func(sf *ServerFrame) error {
+				if string(sf.Payload()) == "skip" {
+					return errors.New("invalid")
+				}
+				return nil
+			}),
+			ReceiveInterceptorFunc(func(sf *ServerFrame) error {
+				sf.Headers["validated"] = []byte("true")
+				return nil
+			}),
+		},
+	}
+
+	frameChan, _ := client.ReceiveFrames()
+
+	select {
+	case sf := <-frameChan:
+		if string(sf.Headers[HeaderMessageID]) != "2" || string(sf.Headers["validated"]) != "true" {
+			t.Error("Expected only message 2, validated, got:", sf.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a message")
+	}
+
+}
@@ -0,0 +1,141 @@
+package stompingophers
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// redactedHeaders have their values replaced when frames are logged.
+var redactedHeaders = map[string]bool{
+	HeaderLogin:     true,
+	HeaderPasscode:  true,
+	HeaderSignature: true,
+}
+
+// logEnabled reports whether the client logs at level.
+func (c *Client) logEnabled(level slog.Level) bool {
+	return c.logger != nil && c.logger.Enabled(context.Background(), level)
+}
+
+func (c *Client) log(level slog.Level, msg string, args ...any) {
+	if c.logEnabled(level) {
+		c.logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// logFrame logs a frame sent or received, at debug level.  Bodies are
+// never logged, only their size.
+func (c *Client) logFrame(msg, command string, headers map[string][]byte, bodyLen int) {
+	if !c.logEnabled(slog.LevelDebug) {
+		return
+	}
+
+	attrs := make([]any, 0, len(headers))
+	for k, v := range headers {
+		if redactedHeaders[k] {
+			attrs = append(attrs, slog.String(k, "[redacted]"))
+			continue
+		}
+		attrs = append(attrs, slog.String(k, string(v)))
+	}
+
+	c.logger.Debug(msg,
+		slog.String("command", command),
+		slog.Group("headers", attrs...),
+		slog.Int("body_bytes", bodyLen))
+}
+
+// received logs, and counts, a frame read by Receive or ReceiveFrames,
+// of size bytes.
+func (c *Client) received(sf ServerFrame, size int) {
+	c.logFrame("stomp frame received", sf.Command, sf.Headers, len(sf.Payload()))
+	if c.metrics != nil {
+		c.metrics.FrameReceived(sf.Command, size)
+	}
+
+	if sf.Command == CmdError {
+		c.log(slog.LevelError, "stomp server error",
+			slog.String("message", string(sf.Headers[HeaderMessage])))
+	}
+}
+
+// activityReader records the time of each read, to detect missed
+// heart-beats.
+type activityReader struct {
+	r    io.Reader
+	last *int64
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(a.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// reader returns the connection, recording read activity when the client
+// monitors heart-beats.
+func (c *Client) reader() io.Reader {
+	if c.lastRead == nil {
+		return c.connection
+	}
+	return activityReader{r: c.connection, last: c.lastRead}
+}
+
+// negotiateHeartBeat returns the interval at which the server will send
+// heart-beats, given the client's heart-beat and the server's CONNECTED
+// heart-beat header, zero if it will not.
+func negotiateHeartBeat(hb HeartBeat, serverHeader []byte) time.Duration {
+	parts := strings.SplitN(string(serverHeader), ",", 2)
+	if len(parts) != 2 {
+		return 0
+	}
+
+	sx, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || sx == 0 || hb.RecvTimeout == 0 {
+		return 0
+	}
+	if hb.RecvTimeout > sx {
+		sx = hb.RecvTimeout
+	}
+
+	return time.Duration(sx) * time.Millisecond
+}
+
+// monitorHeartBeat logs each interval in which nothing was read from the
+// server, allowing it twice the negotiated interval, as network latency
+// can delay heart-beats.  Intervals before the client starts reading are
+// not counted.
+func (c *Client) monitorHeartBeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			last := atomic.LoadInt64(c.lastRead)
+			if last == 0 {
+				continue
+			}
+			if since := now.Sub(time.Unix(0, last)); since > 2*interval {
+				c.heartBeatMissed(since)
+			}
+		}
+	}
+}
+
+func (c *Client) heartBeatMissed(since time.Duration) {
+	if c.metrics != nil {
+		c.metrics.HeartBeatMissed()
+	}
+	c.log(slog.LevelWarn, "stomp heart-beat missed",
+		slog.Duration("since_last_read", since))
+}
@@ -0,0 +1,147 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bufio"
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the logger and the test to share.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+// connectMock connects a client to a mock server, which replies to
+// CONNECT with the given heart-beat, then discards every later frame.
+func connectMock(t *testing.T, options *Options, heartBeat string) (Client, net.Conn) {
+	cliconn, srvconn := net.Pipe()
+	t.Cleanup(func() {
+		cliconn.Close()
+		srvconn.Close()
+	})
+
+	go func() {
+		r := bufio.NewReader(srvconn)
+		readTestFrame(t, r)
+		srvconn.Write([]byte("CONNECTED\nversion:1.2\nserver:MockMQ/1.00.0\nheart-beat:" + heartBeat + "\n\n\000\n"))
+		for {
+			if _, err := readFrame(r); err != nil {
+				return
+			}
+		}
+	}()
+
+	client, _, err := Connect(cliconn, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, srvconn
+}
+
+func Test_LoggerEvents(t *testing.T) {
+	var buf syncBuffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	client, _ := connectMock(t, &Options{Logger: logger}, "0,0")
+
+	_, err := client.Send("/queue/nooq", []byte("top secret body"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, expected := range []string{
+		`msg="stomp connected"`,
+		"version=1.2",
+		`msg="stomp frame sent" command=SEND`,
+		"body_bytes=15",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Error("Expected log to contain:", expected, "\nGot:", out)
+		}
+	}
+	if strings.Contains(out, "top secret") {
+		t.Error("Expected body to be redacted, got:", out)
+	}
+}
+
+func Test_LoggerRawReceive(t *testing.T) {
+	var buf syncBuffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	client, srvconn := connectMock(t, &Options{Logger: logger}, "0,0")
+
+	recvChan, _ := client.Receive()
+	go srvconn.Write([]byte("MESSAGE\ndestination:/queue/nooq\nmessage-id:1\nsubscription:0\n\nhi\000"))
+	<-recvChan
+
+	if out := buf.String(); !strings.Contains(out, `msg="stomp frame received" command=MESSAGE`) {
+		t.Error("Expected received frame logged\nGot:", out)
+	}
+}
+
+func Test_LoggerHeartBeatMissed(t *testing.T) {
+	var buf syncBuffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	options := &Options{
+		Logger:    logger,
+		HeartBeat: &HeartBeat{RecvTimeout: 20},
+	}
+	client, srvconn := connectMock(t, options, "20,0")
+
+	// Stops the monitor, as Disconnect would without a mock receipt.
+	defer client.closeOnce.Do(func() { close(client.closed) })
+
+	client.ReceiveFrames()
+	srvconn.Write([]byte("\n"))
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(buf.String(), "stomp heart-beat missed") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected heart-beat miss to be logged, got:", buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_negotiateHeartBeat(t *testing.T) {
+	tests := []struct {
+		recv     int
+		server   string
+		expected time.Duration
+	}{
+		{5000, "1000,0", 5 * time.Second},
+		{1000, "5000,0", 5 * time.Second},
+		{0, "5000,0", 0},
+		{5000, "0,5000", 0},
+		{5000, "", 0},
+	}
+
+	for _, tt := range tests {
+		d := negotiateHeartBeat(HeartBeat{RecvTimeout: tt.recv}, []byte(tt.server))
+		if d != tt.expected {
+			t.Error("Expected:", tt.expected, "\nGot:", d, "for", tt.recv, tt.server)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package stompingophers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CommandHeartBeat labels heart-beats in metrics, which have no command.
+const CommandHeartBeat = "HEARTBEAT"
+
+// Metrics is told of client activity, for collection.  Implementations
+// must be safe for concurrent use.
+type Metrics interface {
+	// Connected is called on each successful Connect.
+	Connected()
+	FrameSent(command string, bytes int)
+	FrameReceived(command string, bytes int)
+	// ReceiptLatency is the round trip of a frame requesting a receipt.
+	ReceiptLatency(d time.Duration)
+	HeartBeatMissed()
+	HandlerDuration(d time.Duration, err error)
+}
+
+// recordSent records a frame sent, and the receipt for it, if any.
+func (c *Client) recordSent(f *frame, n int, resp []byte, d time.Duration) {
+	if f == nil {
+		c.metrics.FrameSent(CommandHeartBeat, n)
+		return
+	}
+
+	c.metrics.FrameSent(f.command, n)
+
+	if resp != nil {
+		c.metrics.FrameReceived(frameCommand(resp), len(resp))
+		if f.headers.Receipt != nil {
+			c.metrics.ReceiptLatency(d)
+		}
+	}
+}
+
+// frameCommand returns the command of a raw frame.
+func frameCommand(b []byte) string {
+	b = bytes.TrimLeft(b, "\r\n")
+	if i := bytes.IndexByte(b, byteLineFeed); i >= 0 {
+		b = b[:i]
+	}
+	return string(bytes.TrimRight(b, "\r"))
+}
+
+// runHandler runs h, recording its duration.
+func (c *Client) runHandler(h Handler, msg ServerFrame) error {
+	if c.metrics == nil {
+		return h(msg)
+	}
+
+	start := time.Now()
+	err := h(msg)
+	c.metrics.HandlerDuration(time.Since(start), err)
+
+	return err
+}
+
+// DefaultBuckets are the upper bounds, in seconds, of latency histograms.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// PrometheusMetrics collects metrics in memory, and serves them over HTTP
+// in the Prometheus text exposition format, without depending on the
+// Prometheus client.
+type PrometheusMetrics struct {
+	mu sync.Mutex
+
+	connects       uint64
+	framesSent     map[string]uint64
+	framesReceived map[string]uint64
+	bytesSent      uint64
+	bytesReceived  uint64
+	heartBeatsMiss uint64
+	receipts       *histogram
+	handlers       map[string]*histogram
+	buckets        []float64
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		framesSent:     map[string]uint64{},
+		framesReceived: map[string]uint64{},
+		receipts:       newHistogram(DefaultBuckets),
+		handlers:       map[string]*histogram{},
+		buckets:        DefaultBuckets,
+	}
+}
+
+func (m *PrometheusMetrics) Connected() {
+	m.mu.Lock()
+	m.connects++
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) FrameSent(command string, bytes int) {
+	m.mu.Lock()
+	m.framesSent[command]++
+	m.bytesSent += uint64(bytes)
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) FrameReceived(command string, bytes int) {
+	m.mu.Lock()
+	m.framesReceived[command]++
+	m.bytesReceived += uint64(bytes)
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) ReceiptLatency(d time.Duration) {
+	m.mu.Lock()
+	m.receipts.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) HeartBeatMissed() {
+	m.mu.Lock()
+	m.heartBeatsMiss++
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) HandlerDuration(d time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	m.mu.Lock()
+	h, ok := m.handlers[result]
+	if !ok {
+		h = newHistogram(m.buckets)
+		m.handlers[result] = h
+	}
+	h.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	m.writeText(&b)
+
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
+
+func (m *PrometheusMetrics) writeText(b *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeCounter(b, "stomp_connects_total", "Successful connects.", m.connects)
+	writeLabelledCounter(b, "stomp_frames_sent_total", "Frames sent, by command.", "command", m.framesSent)
+	writeLabelledCounter(b, "stomp_frames_received_total", "Frames received, by command.", "command", m.framesReceived)
+	writeCounter(b, "stomp_bytes_sent_total", "Bytes sent.", m.bytesSent)
+	writeCounter(b, "stomp_bytes_received_total", "Bytes received.", m.bytesReceived)
+	writeCounter(b, "stomp_heartbeats_missed_total", "Intervals without a heart-beat from the server.", m.heartBeatsMiss)
+
+	writeHistogramHeader(b, "stomp_receipt_latency_seconds", "Round trip of frames requesting a receipt.")
+	writeHistogram(b, "stomp_receipt_latency_seconds", "", m.receipts)
+
+	writeHistogramHeader(b, "stomp_handler_duration_seconds", "Message handler durations, by result.")
+	for _, result := range sortedKeys(m.handlers) {
+		writeHistogram(b, "stomp_handler_duration_seconds", `result="`+result+`"`, m.handlers[result])
+	}
+}
+
+func writeCounter(b *bytes.Buffer, name, help string, v uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+func writeLabelledCounter(b *bytes.Buffer, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(b, "%s{%s=%s} %d\n", name, label, strconv.Quote(k), values[k])
+	}
+}
+
+func writeHistogramHeader(b *bytes.Buffer, name, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+}
+
+func writeHistogram(b *bytes.Buffer, name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	for i, upper := range h.buckets {
+		fmt.Fprintf(b, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,84 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+func Test_PrometheusMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+
+	client, _ := connectMock(t, &Options{Metrics: metrics}, "0,0")
+	connectMock(t, &Options{Metrics: metrics}, "0,0")
+
+	_, err := client.Send("/queue/nooq", []byte("hello"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.runHandler(func(ServerFrame) error { return nil }, ServerFrame{})
+	client.runHandler(func(ServerFrame) error { return errors.New("boom") }, ServerFrame{})
+	metrics.ReceiptLatency(30 * time.Millisecond)
+
+	srv := httptest.NewServer(metrics)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	out := string(b)
+
+	for _, expected := range []string{
+		"stomp_connects_total 2\n",
+		`stomp_frames_sent_total{command="CONNECT"} 2` + "\n",
+		`stomp_frames_sent_total{command="SEND"} 1` + "\n",
+		`stomp_frames_received_total{command="CONNECTED"} 2` + "\n",
+		`stomp_receipt_latency_seconds_bucket{le="0.025"} 0` + "\n",
+		`stomp_receipt_latency_seconds_bucket{le="0.05"} 1` + "\n",
+		"stomp_receipt_latency_seconds_count 1\n",
+		`stomp_handler_duration_seconds_count{result="error"} 1` + "\n",
+		`stomp_handler_duration_seconds_count{result="ok"} 1` + "\n",
+		"# TYPE stomp_handler_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Error("Expected metrics to contain:", expected, "\nGot:", out)
+		}
+	}
+}
+
+func Test_frameCommand(t *testing.T) {
+	tests := map[string]string{
+		"MESSAGE\nfoo:bar\n\nbody\000": "MESSAGE",
+		"\nRECEIPT\r\n\n\000":          "RECEIPT",
+		"\n":                           "",
+	}
+
+	for raw, expected := range tests {
+		if got := frameCommand([]byte(raw)); got != expected {
+			t.Error("Expected:", expected, "\nGot:", got)
+		}
+	}
+}
+
+func Test_PrometheusMetricsWriteTo(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	metrics.Connected()
+
+	var w io.WriterTo = metrics
+	var b strings.Builder
+	n, err := w.WriteTo(&b)
+	if err != nil || n != int64(b.Len()) {
+		t.Error("Expected:", b.Len(), "bytes\nGot:", n, err)
+	}
+	if !strings.Contains(b.String(), "stomp_connects_total 1\n") {
+		t.Error("Expected metrics to contain: stomp_connects_total 1\nGot:", b.String())
+	}
+}
@@ -0,0 +1,162 @@
+package stompingophers
+
+import (
+	"fmt"
+	"sync"
+)
+
+// WorkerPool consumes a destination, running the handler on several
+// workers, with a bound on messages received but not yet settled.
+//
+// In the client ack mode, where an ack covers all earlier messages, only
+// the highest message whose predecessors have all completed is acked, so
+// a message is never acked before it has been handled.
+type WorkerPool struct {
+	client      *Client
+	queue       string
+	ackMode     int
+	workers     int
+	maxInFlight int
+	handler     Handler
+}
+
+type poolJob struct {
+	seq uint64
+	msg ServerFrame
+	err error
+}
+
+// NewWorkerPool returns a pool of workers handling messages from queue,
+// with at most maxInFlight messages unsettled at once.
+func NewWorkerPool(c *Client, queue string, ackMode, workers, maxInFlight int, h Handler) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxInFlight < workers {
+		maxInFlight = workers
+	}
+
+	return &WorkerPool{
+		client:      c,
+		queue:       queue,
+		ackMode:     ackMode,
+		workers:     workers,
+		maxInFlight: maxInFlight,
+		handler:     h,
+	}
+}
+
+// Run subscribes, and handles messages until the connection fails.  Once
+// the in-flight limit is reached, no more frames are read from the
+// connection until a message is settled.
+func (p *WorkerPool) Run() error {
+	_, _, err := p.client.Subscribe(p.queue, "", p.ackMode)
+	if err != nil {
+		return err
+	}
+
+	frameChan, errChan := p.client.ReceiveFrames()
+
+	jobs := make(chan poolJob)
+	results := make(chan poolJob, p.maxInFlight)
+	slots := make(chan struct{}, p.maxInFlight)
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j.err = p.client.runHandler(p.handler, j.msg)
+				results <- j
+			}
+		}()
+	}
+
+	settled := make(chan error, 1)
+	go func() {
+		settled <- p.settle(results, slots)
+	}()
+
+	var runErr error
+	var seq uint64
+
+	for sf := range frameChan {
+		if sf.Command == CmdError {
+			runErr = fmt.Errorf("server error: %s", sf.Headers[HeaderMessage])
+			break
+		}
+		if sf.Command != CmdMessage {
+			continue
+		}
+
+		slots <- struct{}{}
+		jobs <- poolJob{seq: seq, msg: sf}
+		seq++
+	}
+
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	if err := <-settled; err != nil && runErr == nil {
+		runErr = err
+	}
+	if runErr == nil {
+		runErr = <-errChan
+	}
+
+	return runErr
+}
+
+// settle acks and nacks handled messages, freeing a slot for each.  The
+// first ack error is returned once results is closed.
+func (p *WorkerPool) settle(results chan poolJob, slots chan struct{}) error {
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	pending := map[uint64]poolJob{}
+	var next uint64
+
+	for j := range results {
+		if p.ackMode != AckModeClient {
+			record(p.client.settle(j.msg, p.ackMode, j.err))
+			<-slots
+			continue
+		}
+
+		pending[j.seq] = j
+
+		// Advance over the contiguous completed messages, acking only the
+		// last success before each failure, and at the end.
+		var last *poolJob
+		for {
+			c, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-slots
+
+			if c.err == nil {
+				last = &c
+				continue
+			}
+			if last != nil {
+				record(p.client.Ack(ackID(last.msg), "", ""))
+				last = nil
+			}
+			record(p.client.Nack(ackID(c.msg), "", ""))
+		}
+		if last != nil {
+			record(p.client.Ack(ackID(last.msg), "", ""))
+		}
+	}
+
+	return firstErr
+}
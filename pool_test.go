@@ -0,0 +1,118 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bufio"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+func Test_WorkerPoolCumulativeAck(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+
+	acks := make(chan ServerFrame, 4)
+
+	go func() {
+		defer srvconn.Close()
+
+		r := bufio.NewReader(srvconn)
+		readTestFrame(t, r) // SUBSCRIBE
+
+		for i := 1; i <= 3; i++ {
+			srvconn.Write([]byte("MESSAGE\nack:a" + strconv.Itoa(i) + "\n\n" + strconv.Itoa(i) + "\000\n"))
+		}
+		for {
+			b, err := readFrame(r)
+			if err != nil {
+				return
+			}
+			sf, _ := ParseResponse(b)
+			acks <- sf
+		}
+	}()
+
+	client := Client{connection: cliconn}
+
+	release := make(chan struct{})
+	var handled int32
+
+	p := NewWorkerPool(&client, "/queue/work", AckModeClient, 3, 3, func(msg ServerFrame) error {
+		if string(msg.Payload()) == "1" {
+			<-release
+		}
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+	go p.Run()
+
+	// 2 and 3 complete, but cannot be acked while 1 is being handled.
+	for atomic.LoadInt32(&handled) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case sf := <-acks:
+		t.Fatal("Expected no ack before message 1 completes, got:", sf.String())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	select {
+	case sf := <-acks:
+		if sf.Command != CmdAck || string(sf.Headers[HeaderID]) != "a3" {
+			t.Error("Expected: ACK a3\nGot:", sf.Command, string(sf.Headers[HeaderID]))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected cumulative ack of a3")
+	}
+}
+
+func Test_WorkerPoolInFlightLimit(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+
+	sent := make(chan int, 10)
+
+	go func() {
+		r := bufio.NewReader(srvconn)
+		readTestFrame(t, r) // SUBSCRIBE
+		go func() {
+			for {
+				if _, err := readFrame(r); err != nil {
+					return
+				}
+			}
+		}()
+
+		for i := 1; i <= 5; i++ {
+			_, err := srvconn.Write([]byte("MESSAGE\nack:a" + strconv.Itoa(i) + "\n\nx\000\n"))
+			if err != nil {
+				return
+			}
+			sent <- i
+		}
+	}()
+
+	client := Client{connection: cliconn}
+
+	block := make(chan struct{})
+	defer close(block)
+
+	p := NewWorkerPool(&client, "/queue/work", AckModeClientIndividual, 2, 2, func(msg ServerFrame) error {
+		<-block
+		return nil
+	})
+	go p.Run()
+
+	// Two in flight, one waiting for a slot, and one held by the
+	// connection's reader, which then stops reading.
+	time.Sleep(50 * time.Millisecond)
+	if n := len(sent); n != 4 {
+		t.Error("Expected 4 messages accepted by the client, got:", n)
+	}
+}
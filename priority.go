@@ -0,0 +1,16 @@
+package stompingophers
+
+import "strconv"
+
+const (
+	// HeaderPriority is a message's priority, from 0 to 9, highest last.
+	HeaderPriority = "priority"
+
+	// DefaultPriority is the priority of messages without one.
+	DefaultPriority = 4
+)
+
+// Priority returns the header giving a sent message priority p, for Send.
+func Priority(p int) Header {
+	return Header{Key: HeaderPriority, Value: strconv.Itoa(p)}
+}
@@ -0,0 +1,259 @@
+package stompingophers
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderRedelivered is set by brokers on messages delivered before.
+	HeaderRedelivered = "redelivered"
+	// HeaderDeliveryCount is the number of earlier deliveries, as set by
+	// some brokers.
+	HeaderDeliveryCount = "delivery-count"
+	// HeaderRetryAttempt is the attempt number of a re-sent message.
+	HeaderRetryAttempt = "retry-attempt"
+
+	HeaderDeadLetterDestination = "dead-letter-original-destination"
+	HeaderDeadLetterMessageID   = "dead-letter-original-message-id"
+	HeaderDeadLetterReason      = "dead-letter-reason"
+	HeaderDeadLetterAttempts    = "dead-letter-attempts"
+)
+
+const (
+	// RetryNack retries by nacking, for the broker to redeliver.
+	RetryNack int = 0
+	// RetryResend retries by acking, and sending a copy of the message
+	// back to its destination.
+	RetryResend int = 1
+)
+
+// DefaultMaxAttempts is the attempts of a RetryPolicy without MaxAttempts.
+const DefaultMaxAttempts = 3
+
+// maxTrackedAttempts bounds the messages whose attempts are counted
+// locally, the least recently failed being forgotten first.
+const maxTrackedAttempts = 10000
+
+// RetryPolicy configures the Retry middleware.
+type RetryPolicy struct {
+	// MaxAttempts is the number of deliveries, including the first, before
+	// the message is dead-lettered.  DefaultMaxAttempts if zero or less.
+	MaxAttempts int
+
+	// Backoff returns the delay before resending after the given attempt,
+	// in RetryResend mode.  Nil resends immediately.  Unless given to the
+	// broker on DelayHeader, the delay is waited in the handler, so no
+	// frames, heart-beats included, are received on the connection
+	// meanwhile.  It is not used in RetryNack mode, where the broker's
+	// redelivery paces retries.
+	Backoff func(attempt int) time.Duration
+
+	// Mode is RetryNack or RetryResend.
+	Mode int
+
+	// DelayHeader, in RetryResend mode, is a header on which the backoff
+	// is given to the broker in milliseconds, instead of waiting locally;
+	// such as AMQ_SCHEDULED_DELAY for ActiveMQ.
+	DelayHeader string
+
+	// DeadLetter is the destination for messages which exhaust their
+	// attempts.  If empty, such messages are dropped.
+	DeadLetter string
+}
+
+// ExponentialBackoff doubles the delay from initial with each attempt, up
+// to max.
+func ExponentialBackoff(initial, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := initial
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// retrier counts attempts locally, for brokers which only say whether a
+// message has been redelivered.
+type retrier struct {
+	client *Client
+	policy RetryPolicy
+
+	mu sync.Mutex
+	// attempts holds the failed messages' counts, by message-id, most
+	// recently failed first, up to maxTracked.
+	attempts   map[string]*list.Element
+	order      *list.List
+	maxTracked int
+}
+
+type retryCount struct {
+	key string
+	n   int
+}
+
+// Retry returns middleware which retries failed messages according to p,
+// then dead-letters them, with failure metadata, and acks the original.
+func Retry(c *Client, p RetryPolicy) Middleware {
+	r := newRetrier(c, p)
+
+	return func(next Handler) Handler {
+		return func(msg ServerFrame) error {
+			return r.handle(next, msg)
+		}
+	}
+}
+
+func newRetrier(c *Client, p RetryPolicy) *retrier {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultMaxAttempts
+	}
+
+	return &retrier{
+		client:     c,
+		policy:     p,
+		attempts:   map[string]*list.Element{},
+		order:      list.New(),
+		maxTracked: maxTrackedAttempts,
+	}
+}
+
+func (r *retrier) handle(next Handler, msg ServerFrame) error {
+	key := string(msg.Headers[HeaderMessageID])
+	attempt := r.attempt(key, msg)
+
+	err := next(msg)
+	if err == nil {
+		r.forget(key)
+		return nil
+	}
+
+	if attempt >= r.policy.MaxAttempts {
+		r.forget(key)
+		return r.deadLetter(msg, attempt, err)
+	}
+
+	if r.policy.Mode == RetryResend {
+		r.forget(key)
+
+		var delay time.Duration
+		if r.policy.Backoff != nil {
+			delay = r.policy.Backoff(attempt)
+		}
+		return r.resend(msg, attempt, delay)
+	}
+
+	// Returning the error nacks the message.
+	return err
+}
+
+// attempt returns the delivery attempt number of msg, starting at 1.
+func (r *retrier) attempt(key string, msg ServerFrame) int {
+	for _, h := range []string{HeaderRetryAttempt, HeaderDeliveryCount, "x-delivery-count"} {
+		if v, ok := msg.Headers[h]; ok {
+			if n, err := strconv.Atoi(string(v)); err == nil {
+				if h == HeaderRetryAttempt {
+					return n
+				}
+				return n + 1
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.attempts[key]; ok {
+		c := e.Value.(*retryCount)
+		c.n++
+		r.order.MoveToFront(e)
+		return c.n
+	}
+
+	c := &retryCount{key: key, n: 1}
+	if string(msg.Headers[HeaderRedelivered]) == "true" {
+		// Delivered before this consumer started counting.
+		c.n = 2
+	}
+	r.attempts[key] = r.order.PushFront(c)
+
+	// Messages redelivered elsewhere, or never, are forgotten.
+	for r.order.Len() > r.maxTracked {
+		e := r.order.Back()
+		r.order.Remove(e)
+		delete(r.attempts, e.Value.(*retryCount).key)
+	}
+
+	return c.n
+}
+
+func (r *retrier) forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.attempts[key]; ok {
+		r.order.Remove(e)
+		delete(r.attempts, key)
+	}
+}
+
+// resend sends a copy of msg back to its destination, for the next
+// attempt.  Returning nil acks the original.
+func (r *retrier) resend(msg ServerFrame, attempt int, delay time.Duration) error {
+	h := withoutHeader(userHeaders(msg), HeaderRetryAttempt)
+	h = append(h, Header{Key: HeaderRetryAttempt, Value: strconv.Itoa(attempt + 1)})
+
+	if r.policy.DelayHeader != "" {
+		h = append(h, Header{Key: r.policy.DelayHeader, Value: strconv.FormatInt(int64(delay/time.Millisecond), 10)})
+	} else {
+		time.Sleep(delay)
+	}
+
+	_, err := r.client.Send(string(msg.Headers[HeaderDestination]), msg.Payload(), "", "", h...)
+	return err
+}
+
+// deadLetter sends msg, with why it failed, to the dead-letter
+// destination.  Returning nil acks the original.
+func (r *retrier) deadLetter(msg ServerFrame, attempt int, cause error) error {
+	if r.policy.DeadLetter == "" {
+		return nil
+	}
+
+	h := withoutHeader(userHeaders(msg), HeaderRetryAttempt)
+	h = append(h,
+		Header{Key: HeaderDeadLetterDestination, Value: string(msg.Headers[HeaderDestination])},
+		Header{Key: HeaderDeadLetterMessageID, Value: string(msg.Headers[HeaderMessageID])},
+		Header{Key: HeaderDeadLetterReason, Value: headerValue(cause.Error())},
+		Header{Key: HeaderDeadLetterAttempts, Value: strconv.Itoa(attempt)})
+
+	_, err := r.client.Send(r.policy.DeadLetter, msg.Payload(), "", "", h...)
+	return err
+}
+
+func withoutHeader(h []Header, key string) []Header {
+	out := h[:0]
+	for _, j := range h {
+		if j.Key != key {
+			out = append(out, j)
+		}
+	}
+	return out
+}
+
+// headerValue makes s safe to send as a header value.
+func headerValue(s string) string {
+	b := []byte(s)
+	for i := range b {
+		if b[i] == byteLineFeed || b[i] == '\r' {
+			b[i] = ' '
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,152 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"errors"
+	"time"
+)
+
+func testMessage(id string, h ...Header) ServerFrame {
+	sf := newServerFrame(CmdMessage)
+	sf.Headers[HeaderDestination] = []byte("/queue/work")
+	sf.Headers[HeaderMessageID] = []byte(id)
+	sf.Headers[HeaderAck] = []byte("ack-" + id)
+	for _, j := range h {
+		sf.Headers[j.Key] = []byte(j.Value)
+	}
+	sf.Body = []byte("job\x00")
+
+	return sf
+}
+
+var errJob = errors.New("job failed")
+
+func failing(msg ServerFrame) error {
+	return errJob
+}
+
+func Test_RetryNackThenDeadLetter(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	h := Chain(failing, Retry(client, RetryPolicy{MaxAttempts: 3, DeadLetter: "/queue/dlq"}))
+
+	msg := testMessage("m1")
+	for i := 1; i < 3; i++ {
+		if err := h(msg); err != errJob {
+			t.Error("Attempt", i, "expected:", errJob, "\nGot:", err)
+		}
+	}
+	if err := h(msg); err != nil {
+		t.Error("Expected dead-lettered message to be acked, got:", err)
+	}
+
+	sf := <-frames
+	if sf.Command != CmdSend || string(sf.Headers[HeaderDestination]) != "/queue/dlq" {
+		t.Fatal("Expected SEND to /queue/dlq, got:", sf.String())
+	}
+	expected := map[string]string{
+		HeaderDeadLetterDestination: "/queue/work",
+		HeaderDeadLetterMessageID:   "m1",
+		HeaderDeadLetterReason:      errJob.Error(),
+		HeaderDeadLetterAttempts:    "3",
+	}
+	for k, v := range expected {
+		if string(sf.Headers[k]) != v {
+			t.Error("Expected", k, ":", v, "\nGot:", string(sf.Headers[k]))
+		}
+	}
+	if string(sf.Payload()) != "job" {
+		t.Error("Expected: job\nGot:", string(sf.Payload()))
+	}
+}
+
+func Test_RetryResend(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	h := Chain(failing, Retry(client, RetryPolicy{
+		MaxAttempts: 5,
+		Mode:        RetryResend,
+		Backoff:     ExponentialBackoff(time.Second, time.Minute),
+		DelayHeader: "AMQ_SCHEDULED_DELAY",
+	}))
+
+	if err := h(testMessage("m1", Header{Key: HeaderRetryAttempt, Value: "2"})); err != nil {
+		t.Fatal(err)
+	}
+
+	sf := <-frames
+	if string(sf.Headers[HeaderRetryAttempt]) != "3" {
+		t.Error("Expected retry-attempt: 3\nGot:", string(sf.Headers[HeaderRetryAttempt]))
+	}
+	if string(sf.Headers["AMQ_SCHEDULED_DELAY"]) != "2000" {
+		t.Error("Expected delay: 2000\nGot:", string(sf.Headers["AMQ_SCHEDULED_DELAY"]))
+	}
+}
+
+func Test_RetryDeliveryCount(t *testing.T) {
+	client, _ := recordCommands(t)
+
+	h := Chain(failing, Retry(client, RetryPolicy{MaxAttempts: 3}))
+
+	// Third delivery, as counted by the broker, is the last.
+	if err := h(testMessage("m1", Header{Key: HeaderDeliveryCount, Value: "2"})); err != nil {
+		t.Error("Expected message to be dropped, got:", err)
+	}
+}
+
+func Test_ExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(100*time.Millisecond, time.Second)
+
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, e := range expected {
+		if d := b(i + 1); d != e*time.Millisecond {
+			t.Error("Attempt", i+1, "expected:", e*time.Millisecond, "\nGot:", d)
+		}
+	}
+}
+
+func Test_RetryDefaults(t *testing.T) {
+	client, _ := recordCommands(t)
+
+	backoff := func(attempt int) time.Duration { return time.Hour }
+	h := Chain(failing, Retry(client, RetryPolicy{Backoff: backoff}))
+
+	// Nacked without waiting, up to DefaultMaxAttempts.
+	msg := testMessage("m1")
+	for i := 1; i < DefaultMaxAttempts; i++ {
+		done := make(chan error, 1)
+		go func() { done <- h(msg) }()
+
+		select {
+		case err := <-done:
+			if err != errJob {
+				t.Error("Attempt", i, "expected:", errJob, "\nGot:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected nack mode not to wait for the backoff")
+		}
+	}
+	if err := h(msg); err != nil {
+		t.Error("Expected the last attempt dropped, got:", err)
+	}
+}
+
+func Test_RetryAttemptsBounded(t *testing.T) {
+	r := newRetrier(nil, RetryPolicy{})
+	r.maxTracked = 2
+
+	for _, id := range []string{"m1", "m2", "m1", "m3"} {
+		r.attempt(id, testMessage(id))
+	}
+
+	if len(r.attempts) != 2 || r.order.Len() != 2 {
+		t.Error("Expected: 2 tracked\nGot:", len(r.attempts), r.order.Len())
+	}
+	if _, ok := r.attempts["m2"]; ok {
+		t.Error("Expected the least recently failed forgotten")
+	}
+	if n := r.attempt("m1", testMessage("m1")); n != 3 {
+		t.Error("Expected: 3\nGot:", n)
+	}
+}
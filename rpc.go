@@ -0,0 +1,263 @@
+package stompingophers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderReplyTo       = "reply-to"
+	HeaderCorrelationID = "correlation-id"
+
+	// HeaderRPCError is set on a reply when the responder's handler failed.
+	HeaderRPCError = "rpc-error"
+
+	tempQueuePrefix = "/temp-queue/"
+)
+
+var (
+	ErrRequestTimeout  = errors.New("request timed out waiting for reply")
+	ErrRequesterClosed = errors.New("requester is closed")
+)
+
+// RemoteError is returned by a request when the responder's handler failed.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote handler failed: " + e.Message
+}
+
+// newID returns a random identifier, with the given prefix.
+func newID(prefix string) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to the clock, uniqueness within this process is enough.
+		return prefix + strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return prefix + hex.EncodeToString(b)
+}
+
+// Requester sends requests and waits for their correlated replies.
+// It consumes the client's receive stream, so the client should be
+// dedicated to the requester.
+type Requester struct {
+	client  *Client
+	replyTo string
+	sub     Subscription
+
+	mu      sync.Mutex
+	pending map[string]chan ServerFrame
+	seq     uint64
+	err     error
+}
+
+// NewRequester subscribes to the reply destination and starts matching
+// replies to requests.  If replyTo is empty a temporary queue is used,
+// otherwise replyTo is used as this client's own reply queue.
+func NewRequester(c *Client, replyTo string) (*Requester, error) {
+	if replyTo == "" {
+		replyTo = newID(tempQueuePrefix + "rpc-")
+	}
+
+	sub, _, err := c.Subscribe(replyTo, "", AckModeAuto)
+	if err != nil {
+		return nil, fmt.Errorf("failed subscribing to reply destination: %s", err)
+	}
+
+	r := &Requester{
+		client:  c,
+		replyTo: replyTo,
+		sub:     sub,
+		pending: map[string]chan ServerFrame{},
+	}
+
+	frameChan, errChan := c.ReceiveFrames()
+	go r.dispatch(frameChan, errChan)
+
+	return r, nil
+}
+
+// ReplyTo returns the destination replies are received on.
+func (r *Requester) ReplyTo() string {
+	return r.replyTo
+}
+
+func (r *Requester) dispatch(frameChan chan ServerFrame, errChan chan error) {
+	for sf := range frameChan {
+		if sf.Command == CmdError {
+			r.fail(fmt.Errorf("server error: %s", sf.Headers[HeaderMessage]))
+			return
+		}
+		if sf.Command != CmdMessage {
+			continue
+		}
+		r.client.Release(sf)
+
+		cid := string(sf.Headers[HeaderCorrelationID])
+
+		r.mu.Lock()
+		ch, ok := r.pending[cid]
+		delete(r.pending, cid)
+		r.mu.Unlock()
+
+		// Late replies, for requests that have timed out, are dropped.
+		if ok {
+			ch <- sf
+		}
+	}
+
+	r.fail(<-errChan)
+}
+
+// fail records err, and releases all waiting requests.
+func (r *Requester) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err == nil {
+		r.err = err
+	}
+	for cid, ch := range r.pending {
+		close(ch)
+		delete(r.pending, cid)
+	}
+}
+
+// Request sends body to queue, and waits up to timeout for the reply.
+func (r *Requester) Request(queue string, body []byte, timeout time.Duration, userDef ...Header) (ServerFrame, error) {
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return ServerFrame{}, r.err
+	}
+	r.seq++
+	cid := r.replyTo + "-" + strconv.FormatUint(r.seq, 10)
+	ch := make(chan ServerFrame, 1)
+	r.pending[cid] = ch
+	r.mu.Unlock()
+
+	userDef = append(userDef,
+		Header{Key: HeaderReplyTo, Value: r.replyTo},
+		Header{Key: HeaderCorrelationID, Value: cid})
+
+	_, err := r.client.Send(queue, body, "", "", userDef...)
+	if err != nil {
+		r.forget(cid)
+		return ServerFrame{}, fmt.Errorf("failed sending request: %s", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case sf, ok := <-ch:
+		if !ok {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return ServerFrame{}, r.err
+		}
+		if e, ok := sf.Headers[HeaderRPCError]; ok {
+			return sf, &RemoteError{Message: string(e)}
+		}
+		return sf, nil
+	case <-timer.C:
+		r.forget(cid)
+		return ServerFrame{}, ErrRequestTimeout
+	}
+}
+
+func (r *Requester) forget(cid string) {
+	r.mu.Lock()
+	delete(r.pending, cid)
+	r.mu.Unlock()
+}
+
+// Close unsubscribes from the reply destination.  Waiting requests fail
+// with ErrRequesterClosed.
+func (r *Requester) Close() error {
+	r.fail(ErrRequesterClosed)
+
+	_, err := r.client.Unsubscribe(r.sub.ID, "")
+	return err
+}
+
+// ResponderFunc handles a request, returning the body of the reply.
+type ResponderFunc func(req ServerFrame) ([]byte, error)
+
+// Responder serves requests arriving on a destination, sending each
+// reply to the request's reply-to destination.
+type Responder struct {
+	client  *Client
+	queue   string
+	handler ResponderFunc
+}
+
+func NewResponder(c *Client, queue string, h ResponderFunc) *Responder {
+	return &Responder{
+		client:  c,
+		queue:   queue,
+		handler: h,
+	}
+}
+
+// Serve subscribes to the responder's destination, and handles requests
+// until the connection fails.  Requests without a reply-to header are
+// handled, but no reply is sent.
+func (r *Responder) Serve() error {
+	_, _, err := r.client.Subscribe(r.queue, "", AckModeAuto)
+	if err != nil {
+		return fmt.Errorf("failed subscribing to request destination: %s", err)
+	}
+
+	frameChan, errChan := r.client.ReceiveFrames()
+
+	for sf := range frameChan {
+		if sf.Command == CmdError {
+			return fmt.Errorf("server error: %s", sf.Headers[HeaderMessage])
+		}
+		if sf.Command != CmdMessage {
+			continue
+		}
+
+		err := r.reply(sf)
+		r.client.Release(sf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return <-errChan
+}
+
+func (r *Responder) reply(req ServerFrame) error {
+	start := time.Now()
+	body, herr := r.handler(req)
+	if r.client.metrics != nil {
+		r.client.metrics.HandlerDuration(time.Since(start), herr)
+	}
+
+	replyTo := string(req.Headers[HeaderReplyTo])
+	if replyTo == "" {
+		return nil
+	}
+
+	userDef := []Header{{Key: HeaderCorrelationID, Value: string(req.Headers[HeaderCorrelationID])}}
+	if herr != nil {
+		body = nil
+		userDef = append(userDef, Header{Key: HeaderRPCError, Value: headerValue(herr.Error())})
+	}
+
+	_, err := r.client.Send(replyTo, body, "", "", userDef...)
+	if err != nil {
+		return fmt.Errorf("failed sending reply: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bufio"
+	"net"
+	"time"
+)
+
+// readTestFrame reads and parses the next frame a client wrote to srvconn.
+func readTestFrame(t *testing.T, r *bufio.Reader) ServerFrame {
+	b, err := readFrame(r)
+	if err != nil {
+		t.Error("failed reading client frame:", err)
+		return ServerFrame{}
+	}
+
+	sf, err := ParseResponse(b)
+	if err != nil {
+		t.Error("failed parsing client frame:", err)
+	}
+
+	return sf
+}
+
+func Test_Requester(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+
+	go func() {
+		r := bufio.NewReader(srvconn)
+
+		// Subscribe to the reply destination is sent before the request.
+		sub := readTestFrame(t, r)
+		req := readTestFrame(t, r)
+
+		if string(req.Headers[HeaderReplyTo]) != string(sub.Headers[HeaderDestination]) {
+			t.Error("Expected reply-to:", string(sub.Headers[HeaderDestination]),
+				"\nGot:", string(req.Headers[HeaderReplyTo]))
+		}
+
+		srvconn.Write([]byte("MESSAGE\n" +
+			"destination:" + string(req.Headers[HeaderReplyTo]) + "\n" +
+			"correlation-id:" + string(req.Headers[HeaderCorrelationID]) + "\n" +
+			"\npong\000\n"))
+	}()
+
+	client := Client{connection: cliconn}
+
+	rq, err := NewRequester(&client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf, err := rq.Request("/queue/rpc", []byte("ping"), time.Second)
+	if err != nil {
+		t.Fatal("failed request:", err)
+	}
+
+	expected := "pong\000"
+	if string(sf.Body) != expected {
+		t.Error("Expected:", expected, "\nGot:", string(sf.Body))
+	}
+}
+
+func Test_RequesterTimeout(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+
+	go func() {
+		r := bufio.NewReader(srvconn)
+		for {
+			if _, err := readFrame(r); err != nil {
+				return
+			}
+		}
+	}()
+
+	client := Client{connection: cliconn}
+
+	rq, err := NewRequester(&client, "/queue/replies")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = rq.Request("/queue/rpc", []byte("ping"), 20*time.Millisecond)
+	if err != ErrRequestTimeout {
+		t.Error("Expected:", ErrRequestTimeout, "\nGot:", err)
+	}
+}
+
+func Test_Responder(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+
+	replies := make(chan ServerFrame, 2)
+
+	go func() {
+		defer srvconn.Close()
+
+		r := bufio.NewReader(srvconn)
+		readTestFrame(t, r)
+
+		srvconn.Write([]byte("MESSAGE\n" +
+			"destination:/queue/rpc\n" +
+			"reply-to:/temp-queue/x\n" +
+			"correlation-id:c1\n" +
+			"\nping\000\n"))
+		replies <- readTestFrame(t, r)
+
+		srvconn.Write([]byte("MESSAGE\n" +
+			"destination:/queue/rpc\n" +
+			"reply-to:/temp-queue/x\n" +
+			"correlation-id:c2\n" +
+			"\nfail\000\n"))
+		replies <- readTestFrame(t, r)
+	}()
+
+	client := Client{connection: cliconn}
+
+	rs := NewResponder(&client, "/queue/rpc", func(req ServerFrame) ([]byte, error) {
+		if string(req.Body) == "fail\000" {
+			return nil, ErrRequestTimeout
+		}
+		return []byte("pong"), nil
+	})
+
+	err := rs.Serve()
+	if err == nil {
+		t.Error("Expected error when the connection closes")
+	}
+
+	sf := <-replies
+	if string(sf.Headers[HeaderDestination]) != "/temp-queue/x" ||
+		string(sf.Headers[HeaderCorrelationID]) != "c1" {
+		t.Error("Unexpected reply headers:", sf.String())
+	}
+
+	sf = <-replies
+	if string(sf.Headers[HeaderRPCError]) != ErrRequestTimeout.Error() {
+		t.Error("Expected rpc-error header, got:", sf.String())
+	}
+}
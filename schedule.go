@@ -0,0 +1,34 @@
+package stompingophers
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	// HeaderScheduledDelay asks the broker to hold a sent message, for
+	// the given milliseconds, as ActiveMQ does.
+	HeaderScheduledDelay = "AMQ_SCHEDULED_DELAY"
+	// HeaderDeliverAt asks the broker to hold a sent message until the
+	// given time, in milliseconds since the Unix epoch.
+	HeaderDeliverAt = "deliver-at"
+	// HeaderExpires is when a message expires, in milliseconds since the
+	// Unix epoch, zero being never.
+	HeaderExpires = "expires"
+)
+
+// Delay returns the header delaying a sent message by d, for Send.
+func Delay(d time.Duration) Header {
+	return Header{Key: HeaderScheduledDelay, Value: strconv.FormatInt(d.Milliseconds(), 10)}
+}
+
+// DeliverAt returns the header delaying a sent message until t, for Send.
+func DeliverAt(t time.Time) Header {
+	return Header{Key: HeaderDeliverAt, Value: strconv.FormatInt(t.UnixMilli(), 10)}
+}
+
+// Expires returns the header expiring a sent message at t, for Send.
+// Brokers discard messages not delivered before they expire.
+func Expires(t time.Time) Header {
+	return Header{Key: HeaderExpires, Value: strconv.FormatInt(t.UnixMilli(), 10)}
+}
@@ -0,0 +1,383 @@
+package selector
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokKeyword
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	// text is the identifier, the upper cased keyword, the unquoted
+	// string, or the operator.
+	text string
+	num  float64
+	pos  int
+}
+
+var keywords = map[string]bool{
+	"AND": true, "OR": true, "NOT": true,
+	"BETWEEN": true, "IN": true, "LIKE": true, "ESCAPE": true,
+	"IS": true, "NULL": true, "TRUE": true, "FALSE": true,
+}
+
+// lex splits a selector into tokens.  Identifiers may contain '-' and
+// '.', after their first character, as header names do.
+func lex(src string) ([]token, error) {
+	var toks []token
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(src) && isIdentPart(src[j]) {
+				j++
+			}
+			word := src[i:j]
+			if keywords[strings.ToUpper(word)] {
+				toks = append(toks, token{kind: tokKeyword, text: strings.ToUpper(word), pos: i})
+			} else {
+				toks = append(toks, token{kind: tokIdent, text: word, pos: i})
+			}
+			i = j
+
+		case c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(src) {
+					return nil, fmt.Errorf("unterminated string at %d", i)
+				}
+				if src[j] == '\'' {
+					if j+1 < len(src) && src[j+1] == '\'' {
+						b.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(src[j])
+				j++
+			}
+			toks = append(toks, token{kind: tokString, text: b.String(), pos: i})
+			i = j + 1
+
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])) ||
+			(c == '-' || c == '+') && i+1 < len(src) && (isDigit(src[i+1]) || src[i+1] == '.'):
+			j := i + 1
+			for j < len(src) && (isDigit(src[j]) || src[j] == '.' ||
+				src[j] == 'e' || src[j] == 'E' ||
+				(src[j] == '-' || src[j] == '+') && (src[j-1] == 'e' || src[j-1] == 'E')) {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at %d", src[i:j], i)
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[i:j], num: n, pos: i})
+			i = j
+
+		default:
+			op := ""
+			for _, o := range []string{"<>", "!=", "<=", ">=", "=", "<", ">", "(", ")", ","} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			if op == "!=" {
+				op = "<>"
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '.' || c == '-'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the given keyword or operator.
+func (p *parser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokKeyword || t.kind == tokOp) && t.text == text {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("expected %s", text)
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	t := p.peek()
+	at := "end"
+	if t.kind != tokEOF {
+		at = fmt.Sprintf("%q at %d", t.text, t.pos)
+	}
+	return fmt.Errorf(format+", got %s", append(args, at)...)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.accept("NOT") {
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *parser) parsePredicate() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind == tokOp {
+		switch t.text {
+		case "=", "<>", "<", "<=", ">", ">=":
+			p.next()
+			right, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return compareNode{op: t.text, left: left, right: right}, nil
+		}
+	}
+
+	if p.accept("IS") {
+		not := p.accept("NOT")
+		if err := p.expect("NULL"); err != nil {
+			return nil, err
+		}
+		var n node = isNullNode{left}
+		if not {
+			n = notNode{n}
+		}
+		return n, nil
+	}
+
+	not := p.accept("NOT")
+
+	var n node
+	switch {
+	case p.accept("BETWEEN"):
+		lo, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("AND"); err != nil {
+			return nil, err
+		}
+		hi, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		n = andNode{
+			compareNode{op: ">=", left: left, right: lo},
+			compareNode{op: "<=", left: left, right: hi},
+		}
+
+	case p.accept("IN"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		in := inNode{operand: left}
+		for {
+			v, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := v.(literal); !ok {
+				return nil, p.errorf("expected a literal in IN list")
+			}
+			in.values = append(in.values, v.(literal).v)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		n = in
+
+	case p.accept("LIKE"):
+		t := p.next()
+		if t.kind != tokString {
+			return nil, fmt.Errorf("expected a string LIKE pattern at %d", t.pos)
+		}
+		escape := ""
+		if p.accept("ESCAPE") {
+			e := p.next()
+			if e.kind != tokString || len(e.text) != 1 {
+				return nil, fmt.Errorf("expected a single character ESCAPE string at %d", e.pos)
+			}
+			escape = e.text
+		}
+		re, err := likePattern(t.text, escape)
+		if err != nil {
+			return nil, err
+		}
+		n = likeNode{operand: left, pattern: re}
+
+	default:
+		if not {
+			return nil, p.errorf("expected BETWEEN, IN or LIKE after NOT")
+		}
+		return left, nil
+	}
+
+	if not {
+		n = notNode{n}
+	}
+	return n, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokIdent:
+		return ident(t.text), nil
+	case tokString:
+		return literal{value{kind: kindString, s: t.text}}, nil
+	case tokNumber:
+		return literal{value{kind: kindNumber, n: t.num}}, nil
+	case tokKeyword:
+		switch t.text {
+		case "TRUE":
+			return literal{value{kind: kindBool, b: true}}, nil
+		case "FALSE":
+			return literal{value{kind: kindBool, b: false}}, nil
+		case "NULL":
+			return literal{value{kind: kindNull}}, nil
+		}
+	case tokOp:
+		if t.text == "(" {
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	}
+
+	return nil, fmt.Errorf("expected an identifier, literal or (, got %q at %d", t.text, t.pos)
+}
+
+// likePattern compiles a LIKE pattern, of % for any characters and _ for
+// one, to a regular expression.
+func likePattern(pattern, escape string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case escape != "" && string(r) == escape:
+			i++
+			if i == len(runes) {
+				return nil, fmt.Errorf("LIKE pattern %q ends with its escape", pattern)
+			}
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case r == '%':
+			b.WriteString(".*")
+		case r == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,363 @@
+// Package selector parses and evaluates message selectors, the SQL-92
+// conditional expression subset of JMS, against message headers, as in:
+//
+//	type = 'order' AND (priority > 4 OR region IN ('eu', 'uk'))
+//
+// Comparisons (=, <>, <, <=, >, >=), LIKE with % and _, and ESCAPE, IN,
+// BETWEEN, IS [NOT] NULL, AND, OR, NOT and parentheses are supported, but
+// not arithmetic.  Header values are text, compared as numbers with number
+// literals, as booleans with TRUE and FALSE, and as strings otherwise.
+// Absent headers are NULL, and as in SQL, comparisons with NULL are
+// unknown, which never match.
+//
+// The broker in package server filters subscriptions by their selector
+// header, and stompingophers.Filter filters messages locally.
+package selector
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Selector is a parsed selector.  It is safe for concurrent use.
+type Selector struct {
+	source string
+	root   node
+}
+
+// Parse parses a selector.
+func Parse(s string) (*Selector, error) {
+	toks, err := lex(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing selector: %s", err)
+	}
+
+	p := &parser{toks: toks}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.errorf("expected end")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing selector: %s", err)
+	}
+
+	return &Selector{source: s, root: root}, nil
+}
+
+// MustParse is Parse, panicking on error, for selectors known to be
+// valid.
+func MustParse(s string) *Selector {
+	sel, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return sel
+}
+
+func (s *Selector) String() string {
+	return s.source
+}
+
+// Matches reports whether the headers match the selector.
+func (s *Selector) Matches(headers map[string][]byte) bool {
+	return s.MatchesFunc(func(name string) ([]byte, bool) {
+		v, ok := headers[name]
+		return v, ok
+	})
+}
+
+// MatchesFunc reports whether the headers, looked up by get, match the
+// selector.
+func (s *Selector) MatchesFunc(get func(name string) ([]byte, bool)) bool {
+	v := s.root.eval(get)
+	return truth(v) == isTrue
+}
+
+type kind int
+
+const (
+	kindNull kind = iota
+	// kindText is a header value, converted to the kind it is compared
+	// with.
+	kindText
+	kindString
+	kindNumber
+	kindBool
+)
+
+type value struct {
+	kind kind
+	s    string
+	n    float64
+	b    bool
+}
+
+var (
+	null       = value{kind: kindNull}
+	trueValue  = value{kind: kindBool, b: true}
+	falseValue = value{kind: kindBool, b: false}
+)
+
+func boolValue(b bool) value {
+	if b {
+		return trueValue
+	}
+	return falseValue
+}
+
+type tristate int
+
+const (
+	isUnknown tristate = iota
+	isTrue
+	isFalse
+)
+
+func truth(v value) tristate {
+	switch v.kind {
+	case kindBool:
+		if v.b {
+			return isTrue
+		}
+		return isFalse
+	case kindText:
+		switch v.s {
+		case "true", "TRUE", "True":
+			return isTrue
+		case "false", "FALSE", "False":
+			return isFalse
+		}
+	}
+	return isUnknown
+}
+
+func tristateValue(t tristate) value {
+	switch t {
+	case isTrue:
+		return trueValue
+	case isFalse:
+		return falseValue
+	}
+	return null
+}
+
+// as converts text to kind k, reporting whether it could be.
+func (v value) as(k kind) (value, bool) {
+	if v.kind == k {
+		return v, true
+	}
+	if v.kind != kindText {
+		return v, false
+	}
+
+	switch k {
+	case kindString:
+		return value{kind: kindString, s: v.s}, true
+	case kindNumber:
+		n, err := strconv.ParseFloat(v.s, 64)
+		return value{kind: kindNumber, n: n}, err == nil
+	case kindBool:
+		t := truth(v)
+		return boolValue(t == isTrue), t != isUnknown
+	}
+	return v, false
+}
+
+type node interface {
+	eval(get func(string) ([]byte, bool)) value
+}
+
+type ident string
+
+func (n ident) eval(get func(string) ([]byte, bool)) value {
+	v, ok := get(string(n))
+	if !ok {
+		return null
+	}
+	return value{kind: kindText, s: string(v)}
+}
+
+type literal struct {
+	v value
+}
+
+func (n literal) eval(func(string) ([]byte, bool)) value {
+	return n.v
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) eval(get func(string) ([]byte, bool)) value {
+	l := truth(n.left.eval(get))
+	if l == isFalse {
+		return falseValue
+	}
+	r := truth(n.right.eval(get))
+	if r == isFalse {
+		return falseValue
+	}
+	if l == isTrue && r == isTrue {
+		return trueValue
+	}
+	return null
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) eval(get func(string) ([]byte, bool)) value {
+	l := truth(n.left.eval(get))
+	if l == isTrue {
+		return trueValue
+	}
+	r := truth(n.right.eval(get))
+	if r == isTrue {
+		return trueValue
+	}
+	if l == isFalse && r == isFalse {
+		return falseValue
+	}
+	return null
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) eval(get func(string) ([]byte, bool)) value {
+	switch truth(n.operand.eval(get)) {
+	case isTrue:
+		return falseValue
+	case isFalse:
+		return trueValue
+	}
+	return null
+}
+
+type isNullNode struct {
+	operand node
+}
+
+func (n isNullNode) eval(get func(string) ([]byte, bool)) value {
+	return boolValue(n.operand.eval(get).kind == kindNull)
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n compareNode) eval(get func(string) ([]byte, bool)) value {
+	return tristateValue(compare(n.op, n.left.eval(get), n.right.eval(get)))
+}
+
+// compare compares two values, converting text to the kind of the other,
+// or, for two texts, comparing them as numbers if both are.
+func compare(op string, l, r value) tristate {
+	if l.kind == kindNull || r.kind == kindNull {
+		return isUnknown
+	}
+
+	if l.kind == kindText && r.kind == kindText {
+		if ln, ok := l.as(kindNumber); ok {
+			if rn, ok := r.as(kindNumber); ok {
+				l, r = ln, rn
+			}
+		}
+	}
+	if l.kind == kindText {
+		k := r.kind
+		if k == kindText {
+			k = kindString
+		}
+		var ok bool
+		if l, ok = l.as(k); !ok {
+			return isUnknown
+		}
+	}
+	if r.kind == kindText {
+		var ok bool
+		if r, ok = r.as(l.kind); !ok {
+			return isUnknown
+		}
+	}
+	if l.kind != r.kind {
+		return isUnknown
+	}
+
+	var c int
+	switch l.kind {
+	case kindNumber:
+		c = cmp.Compare(l.n, r.n)
+	case kindString:
+		c = cmp.Compare(l.s, r.s)
+	case kindBool:
+		if op != "=" && op != "<>" {
+			return isUnknown
+		}
+		if l.b != r.b {
+			c = 1
+		}
+	}
+
+	var result bool
+	switch op {
+	case "=":
+		result = c == 0
+	case "<>":
+		result = c != 0
+	case "<":
+		result = c < 0
+	case "<=":
+		result = c <= 0
+	case ">":
+		result = c > 0
+	case ">=":
+		result = c >= 0
+	}
+	if result {
+		return isTrue
+	}
+	return isFalse
+}
+
+type inNode struct {
+	operand node
+	values  []value
+}
+
+func (n inNode) eval(get func(string) ([]byte, bool)) value {
+	v := n.operand.eval(get)
+	if v.kind == kindNull {
+		return null
+	}
+
+	result := isFalse
+	for _, x := range n.values {
+		switch compare("=", v, x) {
+		case isTrue:
+			return trueValue
+		case isUnknown:
+			result = isUnknown
+		}
+	}
+	return tristateValue(result)
+}
+
+type likeNode struct {
+	operand node
+	pattern *regexp.Regexp
+}
+
+func (n likeNode) eval(get func(string) ([]byte, bool)) value {
+	v, ok := n.operand.eval(get).as(kindString)
+	if !ok {
+		return null
+	}
+	return boolValue(n.pattern.MatchString(v.s))
+}
@@ -0,0 +1,115 @@
+package selector
+
+import (
+	"testing"
+)
+
+func Test_Matches(t *testing.T) {
+	headers := map[string][]byte{
+		"type":         []byte("order"),
+		"priority":     []byte("7"),
+		"amount":       []byte("12.5"),
+		"region":       []byte("eu-west"),
+		"content-type": []byte("application/json"),
+		"urgent":       []byte("true"),
+		"note":         []byte("50% off_now"),
+		"name":         []byte("O'Brien"),
+	}
+
+	tests := []struct {
+		selector string
+		match    bool
+	}{
+		{"type = 'order'", true},
+		{"type <> 'order'", false},
+		{"type != 'invoice'", true},
+		{"priority > 4", true},
+		{"priority >= 7 AND priority <= 7", true},
+		{"priority < 4.5", false},
+		{"amount = 12.5", true},
+		{"amount > 1e1", true},
+		{"priority > -1", true},
+		{"priority = '7'", true},
+		{"priority BETWEEN 5 AND 9", true},
+		{"priority NOT BETWEEN 5 AND 9", false},
+		{"region IN ('eu-west', 'us-east')", true},
+		{"region NOT IN ('eu-west', 'us-east')", false},
+		{"region LIKE 'eu-%'", true},
+		{"region LIKE 'eu_west'", true},
+		{"region LIKE 'eu'", false},
+		{"region NOT LIKE 'us%'", true},
+		{`note LIKE '50\% off\_%' ESCAPE '\'`, true},
+		{`note LIKE '50\% off\_' ESCAPE '\'`, false},
+		{"name = 'O''Brien'", true},
+		{"content-type = 'application/json'", true},
+		{"urgent", true},
+		{"urgent = TRUE", true},
+		{"NOT urgent", false},
+		{"missing IS NULL", true},
+		{"missing IS NOT NULL", false},
+		{"type IS NOT NULL", true},
+		{"type = 'order' AND (priority > 8 OR region LIKE 'eu%')", true},
+		{"type = 'order' and priority > 8 or region like 'us%'", false},
+
+		// Unknown, from NULL or mismatched kinds, never matches, nor does
+		// its negation.
+		{"missing = 'x'", false},
+		{"NOT missing = 'x'", false},
+		{"missing = 'x' OR type = 'order'", true},
+		{"missing = 'x' AND type = 'order'", false},
+		{"NOT (missing = 'x' AND type = 'invoice')", true},
+		{"type > 5", false},
+		{"NOT type > 5", false},
+		{"missing IN ('a')", false},
+		{"missing LIKE '%'", false},
+	}
+
+	for _, tt := range tests {
+		sel, err := Parse(tt.selector)
+		if err != nil {
+			t.Error("Expected:", tt.selector, "parsed\nGot:", err)
+			continue
+		}
+		if got := sel.Matches(headers); got != tt.match {
+			t.Error("Expected:", tt.selector, tt.match, "\nGot:", got)
+		}
+	}
+}
+
+func Test_ParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"type =",
+		"type = 'order",
+		"(type = 'a'",
+		"type = 'a')",
+		"priority BETWEEN 1",
+		"region IN ()",
+		"region IN (type)",
+		"region LIKE type",
+		"region LIKE 'a' ESCAPE 'ab'",
+		"region LIKE 'a!' ESCAPE '!'",
+		"type NOT = 'a'",
+		"type IS 'a'",
+		"type = 'a' AND",
+		"type # 'a'",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Error("Expected: error for", s, "\nGot: nil")
+		}
+	}
+}
+
+func Benchmark_Matches(b *testing.B) {
+	sel := MustParse("type = 'order' AND (priority > 4 OR region IN ('eu', 'uk')) AND region LIKE 'e%'")
+	headers := map[string][]byte{
+		"type":     []byte("order"),
+		"priority": []byte("2"),
+		"region":   []byte("eu"),
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sel.Matches(headers)
+	}
+}
@@ -0,0 +1,486 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBrowseLimit is the number of messages Browse returns, when not
+// given a limit.
+const DefaultBrowseLimit = 100
+
+var (
+	ErrUnknownDestination = errors.New("unknown destination")
+	ErrUnknownConnection  = errors.New("unknown connection")
+
+	errAdminUnconfigured = errors.New("admin api requires an authenticator and an acl")
+)
+
+// meter counts events, and their rate over the last minute.
+type meter struct {
+	total   uint64
+	buckets [60]uint64
+	secs    [60]int64
+}
+
+func (m *meter) mark(now time.Time) {
+	sec := now.Unix()
+	i := sec % 60
+	if m.secs[i] != sec {
+		m.secs[i] = sec
+		m.buckets[i] = 0
+	}
+	m.buckets[i]++
+	m.total++
+}
+
+// rate is the events per second, over the last minute.
+func (m *meter) rate(now time.Time) float64 {
+	sec := now.Unix()
+
+	var n uint64
+	for i, s := range m.secs {
+		if s > sec-60 && s <= sec {
+			n += m.buckets[i]
+		}
+	}
+
+	return float64(n) / 60
+}
+
+type DestinationInfo struct {
+	Name string `json:"name"`
+	// Type is queue or topic.
+	Type string `json:"type"`
+	// Depth is the messages waiting for a consumer.
+	Depth int `json:"depth"`
+	// InFlight is the messages delivered, and not yet acked.
+	InFlight int `json:"in_flight"`
+	// Scheduled is the messages held until they are due.
+	Scheduled int    `json:"scheduled"`
+	Consumers int    `json:"consumers"`
+	Enqueued  uint64 `json:"enqueued"`
+	Dequeued  uint64 `json:"dequeued"`
+	Expired   uint64 `json:"expired"`
+	// EnqueueRate, and DequeueRate, are per second over the last minute.
+	EnqueueRate float64 `json:"enqueue_rate"`
+	DequeueRate float64 `json:"dequeue_rate"`
+}
+
+type ConnectionInfo struct {
+	Session       string             `json:"session"`
+	Remote        string             `json:"remote"`
+	User          string             `json:"user"`
+	ConnectedAt   time.Time          `json:"connected_at"`
+	Subscriptions []SubscriptionInfo `json:"subscriptions"`
+}
+
+type SubscriptionInfo struct {
+	ID          string `json:"id"`
+	Destination string `json:"destination"`
+	Ack         string `json:"ack"`
+	Prefetch    int    `json:"prefetch"`
+	Unacked     int    `json:"unacked"`
+	Selector    string `json:"selector,omitempty"`
+}
+
+type MessageInfo struct {
+	ID          string            `json:"id"`
+	Headers     map[string]string `json:"headers"`
+	Body        []byte            `json:"body"`
+	Redelivered bool              `json:"redelivered"`
+}
+
+// Destinations lists the server's destinations, by name.
+func (s *Server) Destinations() []DestinationInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	infos := make([]DestinationInfo, 0, len(s.destinations))
+	for _, d := range s.destinations {
+		info := DestinationInfo{
+			Name:        d.name,
+			Type:        "queue",
+			Depth:       len(d.pending) + len(d.unmatched),
+			Scheduled:   d.scheduled,
+			Consumers:   len(d.subs),
+			Enqueued:    d.enqueued.total,
+			Dequeued:    d.dequeued.total,
+			Expired:     d.expired,
+			EnqueueRate: d.enqueued.rate(now),
+			DequeueRate: d.dequeued.rate(now),
+		}
+		if d.topic {
+			info.Type = "topic"
+		}
+		for _, sub := range d.subs {
+			info.Depth += len(sub.backlog)
+			info.InFlight += len(sub.unacked)
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Connections lists the server's connected clients, by session.
+func (s *Server) Connections() []ConnectionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]ConnectionInfo, 0, len(s.conns))
+	for c := range s.conns {
+		if c.connectedAt.IsZero() {
+			continue
+		}
+
+		info := ConnectionInfo{
+			Session:       c.session,
+			Remote:        c.netConn.RemoteAddr().String(),
+			User:          c.user,
+			ConnectedAt:   c.connectedAt,
+			Subscriptions: make([]SubscriptionInfo, 0, len(c.subs)),
+		}
+		for _, sub := range c.subs {
+			si := SubscriptionInfo{
+				ID:          sub.id,
+				Destination: sub.dest.name,
+				Ack:         sub.ackMode,
+				Prefetch:    sub.prefetch,
+				Unacked:     len(sub.unacked),
+			}
+			if sub.selector != nil {
+				si.Selector = sub.selector.String()
+			}
+			info.Subscriptions = append(info.Subscriptions, si)
+		}
+		sort.Slice(info.Subscriptions, func(i, j int) bool {
+			return info.Subscriptions[i].ID < info.Subscriptions[j].ID
+		})
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Session < infos[j].Session })
+	return infos
+}
+
+// Browse returns up to limit of a queue's waiting messages, oldest first,
+// without consuming them.  A limit of zero is DefaultBrowseLimit.
+func (s *Server) Browse(destination string, limit int) ([]MessageInfo, error) {
+	if limit <= 0 {
+		limit = DefaultBrowseLimit
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.destinations[destination]
+	if !ok {
+		return nil, ErrUnknownDestination
+	}
+
+	waiting := d.waiting()
+	n := min(limit, len(waiting))
+	infos := make([]MessageInfo, 0, n)
+	for _, m := range waiting[:n] {
+		info := MessageInfo{
+			ID:          m.id,
+			Headers:     make(map[string]string, len(m.headers)),
+			Body:        m.body,
+			Redelivered: m.redelivered,
+		}
+		for k, v := range m.headers {
+			info.Headers[k] = string(v)
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// Purge discards a queue's waiting, and scheduled, messages, returning
+// how many there were.  Messages delivered, and not yet acked, are kept.
+func (s *Server) Purge(destination string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.destinations[destination]
+	if !ok {
+		return 0, ErrUnknownDestination
+	}
+
+	purged := append(d.waiting(), s.unschedule(d)...)
+	for _, m := range purged {
+		s.forget(m)
+	}
+	d.pending = nil
+	d.unmatched = nil
+	n := len(purged)
+
+	return n, nil
+}
+
+// Move sends up to limit of a queue's waiting messages, oldest first, to
+// another destination, returning how many were moved.  A limit of zero is
+// all of them.  Moved messages are given new message ids.
+func (s *Server) Move(from, to string, limit int) (int, error) {
+	if to == "" || to == from {
+		return 0, fmt.Errorf("failed moving messages: invalid destination %q", to)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.destinations[from]
+	if !ok {
+		return 0, ErrUnknownDestination
+	}
+
+	// Unmatched messages are moved too, in order, and any left are
+	// found unmatched again when next dispatched.
+	d.pending = d.waiting()
+	d.unmatched = nil
+
+	n := len(d.pending)
+	if limit > 0 {
+		n = min(limit, n)
+	}
+	moving := d.pending[:n:n]
+	d.pending = d.pending[n:]
+
+	for i, m := range moving {
+		s.lastID++
+		moved := &message{
+			seq:         s.lastID,
+			id:          messageID(s.lastID),
+			destination: to,
+			headers:     m.headers,
+			body:        m.body,
+		}
+		moved.derive()
+
+		// The copy is persisted before the original is forgotten, so a
+		// crash between the two duplicates the message, rather than
+		// losing it.
+		if err := s.publish(moved); err != nil {
+			d.pending = append(moving[i:], d.pending...)
+			s.dispatch(d)
+			return i, fmt.Errorf("failed moving messages: %s", err)
+		}
+		s.forget(m)
+	}
+
+	return n, nil
+}
+
+// CloseConnection closes the connection of the given session.  Its
+// unacked messages are redelivered.
+func (s *Server) CloseConnection(session string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		if c.session == session {
+			c.netConn.Close()
+			return nil
+		}
+	}
+
+	return ErrUnknownConnection
+}
+
+// AdminHandler returns the management HTTP API, of JSON requests:
+//
+//	GET    /destinations
+//	GET    /connections
+//	DELETE /connections/{session}
+//	GET    /messages?destination=/queue/a&limit=100
+//	POST   /purge?destination=/queue/a
+//	POST   /move?from=/queue/a&to=/queue/b&limit=100
+//
+// It is meant to be served on its own port, see cmd/stompd.  Requests
+// must have basic auth credentials, checked by the Authenticator.
+// Destinations are managed by users the ACL grants admin on them, and
+// connections by users with admin on /, as granted by a /** pattern.
+// Without both an Authenticator and an ACL, every request is forbidden,
+// unless InsecureAdmin is set.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/destinations", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		user, ok := s.adminUser(w, r)
+		if !ok {
+			return
+		}
+
+		infos := []DestinationInfo{}
+		for _, info := range s.Destinations() {
+			if s.adminOf(user, info.Name) {
+				infos = append(infos, info)
+			}
+		}
+		writeJSON(w, http.StatusOK, infos)
+	})
+
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		if allowMethod(w, r, http.MethodGet) && s.adminAllowed(w, r, "/") {
+			writeJSON(w, http.StatusOK, s.Connections())
+		}
+	})
+
+	mux.HandleFunc("/connections/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodDelete) || !s.adminAllowed(w, r, "/") {
+			return
+		}
+		if err := s.CloseConnection(strings.TrimPrefix(r.URL.Path, "/connections/")); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+		dest := r.URL.Query().Get("destination")
+		if !allowMethod(w, r, http.MethodGet) || !s.adminAllowed(w, r, dest) {
+			return
+		}
+		limit, err := queryInt(r, "limit")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		msgs, err := s.Browse(dest, limit)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, msgs)
+	})
+
+	mux.HandleFunc("/purge", func(w http.ResponseWriter, r *http.Request) {
+		dest := r.URL.Query().Get("destination")
+		if !allowMethod(w, r, http.MethodPost) || !s.adminAllowed(w, r, dest) {
+			return
+		}
+
+		n, err := s.Purge(dest)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+	})
+
+	mux.HandleFunc("/move", func(w http.ResponseWriter, r *http.Request) {
+		from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+		if !allowMethod(w, r, http.MethodPost) || !s.adminAllowed(w, r, from) || !s.adminAllowed(w, r, to) {
+			return
+		}
+		limit, err := queryInt(r, "limit")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		n, err := s.Move(from, to, limit)
+		switch {
+		case err == ErrUnknownDestination:
+			writeError(w, http.StatusNotFound, err)
+		case err != nil && n == 0:
+			writeError(w, http.StatusBadRequest, err)
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+		default:
+			writeJSON(w, http.StatusOK, map[string]int{"moved": n})
+		}
+	})
+
+	return mux
+}
+
+// adminUser authenticates an admin request, writing the error response
+// on failure.
+func (s *Server) adminUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if s.options.InsecureAdmin {
+		return "", true
+	}
+
+	auth := s.options.Authenticator
+	if auth == nil || s.options.ACL == nil {
+		writeError(w, http.StatusForbidden, errAdminUnconfigured)
+		return "", false
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok || !auth.Authenticate(user, pass) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="stomp admin"`)
+		writeError(w, http.StatusUnauthorized, errors.New("authentication failed"))
+		return "", false
+	}
+
+	return user, true
+}
+
+func (s *Server) adminOf(user, destination string) bool {
+	return s.options.InsecureAdmin || s.options.ACL.Allowed(user, destination, PermAdmin)
+}
+
+// adminAllowed authenticates and authorizes an admin request on the
+// destination, writing the error response on failure.
+func (s *Server) adminAllowed(w http.ResponseWriter, r *http.Request, destination string) bool {
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return false
+	}
+	if !s.adminOf(user, destination) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("access denied to %s", destination))
+		return false
+	}
+	return true
+}
+
+// allowMethod checks a request's method, writing the error response
+// otherwise.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+func queryInt(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
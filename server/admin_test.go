@@ -0,0 +1,207 @@
+package server
+
+import (
+	"testing"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, target string, v any) int {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal("Expected: JSON\nGot:", rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func Test_AdminAPI(t *testing.T) {
+	srv := New(&Options{InsecureAdmin: true})
+	defer srv.Close()
+	h := srv.AdminHandler()
+
+	producer := connect(t, srv, nil)
+	for i := 0; i < 5; i++ {
+		producer.Send("/queue/a", []byte(strconv.Itoa(i)), "r", "", stomper.Header{Key: "k", Value: "v"})
+	}
+	frames := subscribe(t, connect(t, srv, nil), "/topic/t", stomper.AckModeAuto)
+	producer.Send("/topic/t", []byte("news"), "r", "")
+	next(t, frames)
+
+	var dests []DestinationInfo
+	if code := adminRequest(t, h, "GET", "/destinations", &dests); code != http.StatusOK {
+		t.Fatal("Expected: 200\nGot:", code)
+	}
+	if len(dests) != 2 || dests[0].Name != "/queue/a" || dests[0].Depth != 5 || dests[0].Enqueued != 5 ||
+		dests[0].EnqueueRate <= 0 || dests[0].Type != "queue" {
+		t.Error("Expected: /queue/a of depth 5\nGot:", dests)
+	}
+	if len(dests) == 2 && (dests[1].Type != "topic" || dests[1].Consumers != 1 || dests[1].Dequeued != 1) {
+		t.Error("Expected: /topic/t with a consumer\nGot:", dests[1])
+	}
+
+	var msgs []MessageInfo
+	adminRequest(t, h, "GET", "/messages?destination=/queue/a&limit=2", &msgs)
+	if len(msgs) != 2 || string(msgs[0].Body) != "0" || msgs[1].Headers["k"] != "v" {
+		t.Error("Expected: messages 0 and 1\nGot:", msgs)
+	}
+
+	var moved map[string]int
+	if code := adminRequest(t, h, "POST", "/move?from=/queue/a&to=/queue/b&limit=3", &moved); code != http.StatusOK || moved["moved"] != 3 {
+		t.Error("Expected: 3 moved\nGot:", code, moved)
+	}
+	adminRequest(t, h, "GET", "/messages?destination=/queue/b", &msgs)
+	if len(msgs) != 3 || string(msgs[2].Body) != "2" {
+		t.Error("Expected: messages 0 to 2 in /queue/b\nGot:", msgs)
+	}
+
+	var purged map[string]int
+	if adminRequest(t, h, "POST", "/purge?destination=/queue/a", &purged); purged["purged"] != 2 {
+		t.Error("Expected: 2 purged\nGot:", purged)
+	}
+	if code := adminRequest(t, h, "POST", "/purge?destination=/queue/none", nil); code != http.StatusNotFound {
+		t.Error("Expected: 404\nGot:", code)
+	}
+
+	var conns []ConnectionInfo
+	adminRequest(t, h, "GET", "/connections", &conns)
+	if len(conns) != 2 {
+		t.Fatal("Expected: 2 connections\nGot:", conns)
+	}
+	var sub ConnectionInfo
+	for _, c := range conns {
+		if len(c.Subscriptions) == 1 {
+			sub = c
+		}
+	}
+	if sub.Subscriptions == nil || sub.Subscriptions[0].Destination != "/topic/t" || sub.ConnectedAt.IsZero() {
+		t.Error("Expected: a subscription to /topic/t\nGot:", conns)
+	}
+
+	if code := adminRequest(t, h, "DELETE", "/connections/"+sub.Session, nil); code != http.StatusNoContent {
+		t.Error("Expected: 204\nGot:", code)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(srv.Connections()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(srv.Connections()); n != 1 {
+		t.Error("Expected: 1 connection\nGot:", n)
+	}
+}
+
+func Test_AdminAPIAuthorization(t *testing.T) {
+	acl := &ACL{}
+	acl.Grant("ops", "/**", PermAdmin)
+	acl.Grant("alice", "/queue/a", PermAdmin)
+
+	srv := New(&Options{
+		Authenticator: StaticAuthenticator{"ops": "o", "alice": "a"},
+		ACL:           acl,
+	})
+	defer srv.Close()
+	h := srv.AdminHandler()
+
+	producer := connect(t, srv, &stomper.Options{Login: "ops", Passcode: "o"})
+	producer.Send("/queue/a", []byte("a"), "r", "")
+	producer.Send("/queue/b", []byte("b"), "r", "")
+
+	request := func(user, pass, method, target string) (int, []DestinationInfo) {
+		req := httptest.NewRequest(method, target, nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		var dests []DestinationInfo
+		json.Unmarshal(rec.Body.Bytes(), &dests)
+		return rec.Code, dests
+	}
+
+	if code, _ := request("", "", "GET", "/destinations"); code != http.StatusUnauthorized {
+		t.Error("Expected: 401\nGot:", code)
+	}
+	if code, _ := request("alice", "wrong", "GET", "/destinations"); code != http.StatusUnauthorized {
+		t.Error("Expected: 401\nGot:", code)
+	}
+	if _, dests := request("alice", "a", "GET", "/destinations"); len(dests) != 1 || dests[0].Name != "/queue/a" {
+		t.Error("Expected: only /queue/a\nGot:", dests)
+	}
+	if _, dests := request("ops", "o", "GET", "/destinations"); len(dests) != 2 {
+		t.Error("Expected: 2 destinations\nGot:", dests)
+	}
+	if code, _ := request("alice", "a", "POST", "/purge?destination=/queue/b"); code != http.StatusForbidden {
+		t.Error("Expected: 403\nGot:", code)
+	}
+	if code, _ := request("alice", "a", "POST", "/move?from=/queue/a&to=/queue/b"); code != http.StatusForbidden {
+		t.Error("Expected: 403\nGot:", code)
+	}
+	if code, _ := request("alice", "a", "GET", "/connections"); code != http.StatusForbidden {
+		t.Error("Expected: 403\nGot:", code)
+	}
+	if code, _ := request("ops", "o", "GET", "/connections"); code != http.StatusOK {
+		t.Error("Expected: 200\nGot:", code)
+	}
+}
+
+func Test_AdminAPIDeniedByDefault(t *testing.T) {
+	acl := &ACL{}
+	acl.Grant("ops", "/**", PermAdmin)
+	auth := StaticAuthenticator{"ops": "o"}
+
+	for _, options := range []*Options{
+		nil,
+		{Authenticator: auth},
+		{ACL: acl},
+	} {
+		srv := New(options)
+		req := httptest.NewRequest("GET", "/connections", nil)
+		req.SetBasicAuth("ops", "o")
+		rec := httptest.NewRecorder()
+		srv.AdminHandler().ServeHTTP(rec, req)
+		srv.Close()
+
+		if rec.Code != http.StatusForbidden {
+			t.Error("Expected: 403\nGot:", rec.Code, "with", options)
+		}
+	}
+}
+
+func Test_MovePersisted(t *testing.T) {
+	dir := t.TempDir()
+
+	wal := openTestWAL(t, dir, SyncAlways)
+	srv := New(&Options{WAL: wal})
+	producer := connect(t, srv, nil)
+	for i := 0; i < 3; i++ {
+		producer.Send("/queue/a", []byte(strconv.Itoa(i)), "r", "")
+	}
+	if n, err := srv.Move("/queue/a", "/queue/dlq", 2); n != 2 || err != nil {
+		t.Error("Expected: 2 moved\nGot:", n, err)
+	}
+	if n, err := srv.Purge("/queue/a"); n != 1 || err != nil {
+		t.Error("Expected: 1 purged\nGot:", n, err)
+	}
+	srv.Close()
+	wal.Close()
+
+	wal = openTestWAL(t, dir, SyncAlways)
+	defer wal.Close()
+
+	msgs := wal.recoveredMessages()
+	if len(msgs) != 2 || msgs[0].destination != "/queue/dlq" || string(msgs[1].body) != "1" {
+		t.Error("Expected: messages 0 and 1 in /queue/dlq\nGot:", msgs)
+	}
+}
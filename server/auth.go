@@ -0,0 +1,303 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Authenticator checks the login and passcode headers of CONNECT frames.
+type Authenticator interface {
+	Authenticate(login, passcode string) bool
+}
+
+// StaticAuthenticator authenticates against a map of logins to passcodes.
+type StaticAuthenticator map[string]string
+
+func (a StaticAuthenticator) Authenticate(login, passcode string) bool {
+	want, ok := a[login]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(passcode)) == 1
+}
+
+// Htpasswd authenticates against an htpasswd style file, of login:hash
+// lines.  Hashes may be {SHA}, $apr1$ or $1$ MD5, or plain text marked
+// {PLAIN}.  bcrypt and crypt(3) DES hashes are not supported.
+type Htpasswd struct {
+	hashes map[string]string
+}
+
+// LoadHtpasswd reads an htpasswd file.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening htpasswd file: %s", err)
+	}
+	defer f.Close()
+
+	return ParseHtpasswd(f)
+}
+
+// ParseHtpasswd reads htpasswd lines.  Blank lines, and lines starting #,
+// are ignored.
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{hashes: map[string]string{}}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		login, hash, ok := strings.Cut(line, ":")
+		if !ok || login == "" {
+			return nil, fmt.Errorf("failed parsing htpasswd line %d: expected login:hash", n)
+		}
+		if !supportedHash(hash) {
+			return nil, fmt.Errorf("failed parsing htpasswd line %d: unsupported hash", n)
+		}
+
+		h.hashes[login] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading htpasswd file: %s", err)
+	}
+
+	return h, nil
+}
+
+const plainPrefix = "{PLAIN}"
+
+// supportedHash reports whether hash is of a supported format.  Anything
+// else, such as a crypt(3) DES hash, is refused rather than taken as
+// plain text.
+func supportedHash(hash string) bool {
+	for _, prefix := range []string{"{SHA}", "$apr1$", "$1$", plainPrefix} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Htpasswd) Authenticate(login, passcode string) bool {
+	hash, ok := h.hashes[login]
+	if !ok {
+		return false
+	}
+
+	var got string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(passcode))
+		got = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		got = md5Crypt(passcode, hash, "$apr1$")
+	case strings.HasPrefix(hash, "$1$"):
+		got = md5Crypt(passcode, hash, "$1$")
+	case strings.HasPrefix(hash, plainPrefix):
+		got = plainPrefix + passcode
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(got)) == 1
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// md5Crypt hashes password with the salt of hash, by the MD5 crypt
+// algorithm, magic being $1$ or Apache's $apr1$.
+func md5Crypt(password, hash, magic string) string {
+	salt, _, _ := strings.Cut(strings.TrimPrefix(hash, magic), "$")
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	mixin := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		d.Write(mixin[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	var out bytes.Buffer
+	out.WriteString(magic + salt + "$")
+	put := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		put(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	put(uint32(final[11]), 2)
+
+	return out.String()
+}
+
+// Permission is a set of rights on destinations.
+type Permission int
+
+const (
+	// PermRead is subscribing to a destination.
+	PermRead Permission = 1 << iota
+	// PermWrite is sending to a destination.
+	PermWrite
+	// PermAdmin is administering a destination, and implies read and write.
+	PermAdmin
+)
+
+var permissionNames = map[string]Permission{
+	"read":  PermRead,
+	"write": PermWrite,
+	"admin": PermAdmin,
+}
+
+// ACL grants users permissions on destinations.  Anything not granted is
+// denied.  Its zero value is usable, and grants nothing.
+type ACL struct {
+	rules []aclRule
+}
+
+type aclRule struct {
+	user    string
+	pattern *regexp.Regexp
+	perms   Permission
+}
+
+// Grant gives user perms on the destinations matching pattern.  User *
+// is every user, including anonymous ones.  In patterns, * matches
+// within a path segment, and ** across segments, so /queue/orders.* and
+// /topic/** are valid.
+func (a *ACL) Grant(user, pattern string, perms Permission) error {
+	if pattern == "" {
+		return fmt.Errorf("failed granting %s: empty destination pattern", user)
+	}
+
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\*`, "[^/]*")
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return fmt.Errorf("failed granting %s on %s: %s", user, pattern, err)
+	}
+
+	a.rules = append(a.rules, aclRule{user: user, pattern: re, perms: perms})
+	return nil
+}
+
+// Allowed reports whether user has perm on the destination.
+func (a *ACL) Allowed(user, destination string, perm Permission) bool {
+	for _, r := range a.rules {
+		if r.user != "*" && r.user != user {
+			continue
+		}
+		if !r.pattern.MatchString(destination) {
+			continue
+		}
+		if r.perms&perm != 0 || r.perms&PermAdmin != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadACL reads an ACL file.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening acl file: %s", err)
+	}
+	defer f.Close()
+
+	return ParseACL(f)
+}
+
+// ParseACL reads ACL lines, of a user, a destination pattern, and comma
+// separated permissions, such as:
+//
+//	alice /queue/orders.* read,write
+//	*     /topic/news     read
+//
+// Blank lines, and lines starting #, are ignored.
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("failed parsing acl line %d: expected user, pattern and permissions", n)
+		}
+
+		var perms Permission
+		for _, name := range strings.Split(fields[2], ",") {
+			p, ok := permissionNames[name]
+			if !ok {
+				return nil, fmt.Errorf("failed parsing acl line %d: unknown permission %s", n, name)
+			}
+			perms |= p
+		}
+
+		if err := acl.Grant(fields[0], fields[1], perms); err != nil {
+			return nil, fmt.Errorf("failed parsing acl line %d: %s", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading acl file: %s", err)
+	}
+
+	return acl, nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"testing"
+
+	"bufio"
+	"bytes"
+	"strings"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+func Test_Htpasswd(t *testing.T) {
+	h, err := ParseHtpasswd(strings.NewReader(`
+# Generated by htpasswd.
+alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/
+bob:$1$xyz$Qia9Wq6FxQkYcwNWMk/RM0
+carol:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+dave:{PLAIN}secret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, login := range []string{"alice", "bob", "carol", "dave"} {
+		if !h.Authenticate(login, "secret") {
+			t.Error("Expected:", login, "authenticated\nGot: refused")
+		}
+		if h.Authenticate(login, "Secret") {
+			t.Error("Expected:", login, "refused a wrong passcode\nGot: authenticated")
+		}
+	}
+	if h.Authenticate("erin", "secret") {
+		t.Error("Expected: unknown login refused\nGot: authenticated")
+	}
+
+	if _, err := ParseHtpasswd(strings.NewReader("alice:$2y$05$abcdefghijklmnopqrstuv")); err == nil {
+		t.Error("Expected: error for bcrypt hash\nGot: nil")
+	}
+	if _, err := ParseHtpasswd(strings.NewReader("alice:rl0uAgSyIdWJ6")); err == nil {
+		t.Error("Expected: error for DES crypt hash\nGot: nil")
+	}
+	if _, err := ParseHtpasswd(strings.NewReader("alice")); err == nil {
+		t.Error("Expected: error for line without hash\nGot: nil")
+	}
+}
+
+func Test_ACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+alice /queue/orders.*  read,write
+bob   /topic/**        read
+*     /queue/public    write
+root  /**              admin
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, dest string
+		perm       Permission
+		allowed    bool
+	}{
+		{"alice", "/queue/orders.eu", PermRead, true},
+		{"alice", "/queue/orders.eu", PermWrite, true},
+		{"alice", "/queue/orders.eu", PermAdmin, false},
+		{"alice", "/queue/orders/eu", PermRead, false},
+		{"alice", "/queue/invoices", PermRead, false},
+		{"bob", "/topic/news/sport", PermRead, true},
+		{"bob", "/topic/news", PermWrite, false},
+		{"", "/queue/public", PermWrite, true},
+		{"bob", "/queue/public", PermRead, false},
+		{"root", "/queue/anything", PermWrite, true},
+	}
+	for _, tt := range tests {
+		if got := acl.Allowed(tt.user, tt.dest, tt.perm); got != tt.allowed {
+			t.Error("Expected:", tt.user, tt.dest, tt.perm, tt.allowed, "\nGot:", got)
+		}
+	}
+
+	if _, err := ParseACL(strings.NewReader("alice /queue/a delete")); err == nil {
+		t.Error("Expected: error for unknown permission\nGot: nil")
+	}
+	if (&ACL{}).Allowed("alice", "/queue/a", PermRead) {
+		t.Error("Expected: empty ACL denies\nGot: allowed")
+	}
+}
+
+func Test_Authentication(t *testing.T) {
+	srv := New(&Options{Authenticator: StaticAuthenticator{"alice": "secret"}})
+	defer srv.Close()
+
+	_, resp, err := stomper.Connect(srv.Pipe(), &stomper.Options{Login: "alice", Passcode: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(resp, []byte(stomper.CmdError)) || !bytes.Contains(resp, []byte("authentication failed")) {
+		t.Error("Expected: ERROR authentication failed\nGot:", string(resp))
+	}
+
+	_, resp, err = stomper.Connect(srv.Pipe(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(resp, []byte(stomper.CmdError)) {
+		t.Error("Expected: ERROR without credentials\nGot:", string(resp))
+	}
+
+	client := connect(t, srv, &stomper.Options{Login: "alice", Passcode: "secret"})
+	frames := subscribe(t, client, "/queue/a", stomper.AckModeAuto)
+	connect(t, srv, &stomper.Options{Login: "alice", Passcode: "secret"}).Send("/queue/a", []byte("hi"), "", "")
+	if sf := next(t, frames); string(sf.Payload()) != "hi" {
+		t.Error("Expected: hi\nGot:", sf.String())
+	}
+}
+
+func Test_Authorization(t *testing.T) {
+	acl := &ACL{}
+	acl.Grant("alice", "/queue/orders", PermWrite)
+	acl.Grant("*", "/topic/**", PermRead)
+
+	srv := New(&Options{
+		Authenticator: StaticAuthenticator{"alice": "secret"},
+		ACL:           acl,
+	})
+	defer srv.Close()
+
+	denied := func(frame, detail string) {
+		t.Helper()
+
+		conn := srv.Pipe()
+		t.Cleanup(func() { conn.Close() })
+		r := bufio.NewReader(conn)
+
+		go conn.Write([]byte("CONNECT\naccept-version:1.2\nlogin:alice\npasscode:secret\n\n\x00" + frame))
+		if sf := readServerFrame(t, r); sf.Command != stomper.CmdConnected {
+			t.Fatal("Expected: CONNECTED\nGot:", sf.String())
+		}
+		sf := readServerFrame(t, r)
+		if sf.Command != stomper.CmdError || string(sf.Headers[stomper.HeaderMessage]) != "access denied" ||
+			string(sf.Headers[stomper.HeaderReceiptID]) != "r-1" || !strings.Contains(string(sf.Body), detail) {
+			t.Error("Expected: ERROR access denied,", detail, "\nGot:", sf.String())
+		}
+	}
+
+	denied("SEND\ndestination:/queue/invoices\nreceipt:r-1\n\nhi\x00", "alice may not send to /queue/invoices")
+	denied("SUBSCRIBE\nid:0\ndestination:/queue/orders\nreceipt:r-1\n\n\x00", "alice may not subscribe to /queue/orders")
+	denied("BEGIN\ntransaction:t\n\n\x00SEND\ndestination:/topic/news\ntransaction:t\nreceipt:r-1\n\nhi\x00",
+		"alice may not send to /topic/news")
+
+	options := &stomper.Options{Login: "alice", Passcode: "secret"}
+	frames := subscribe(t, connect(t, srv, options), "/topic/news", stomper.AckModeAuto)
+	if _, err := connect(t, srv, options).Send("/queue/orders", []byte("order"), "r", ""); err != nil {
+		t.Error("Expected: send allowed\nGot:", err)
+	}
+	nothing(t, frames)
+}
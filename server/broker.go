@@ -0,0 +1,550 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	stomper "github.com/russmack/stompingophers"
+	"github.com/russmack/stompingophers/selector"
+)
+
+// message is a message held by the broker.
+type message struct {
+	seq         uint64
+	id          string
+	destination string
+	// headers are those of the SEND frame, less the frame's own.
+	headers map[string][]byte
+	body    []byte
+	// redelivered messages were returned to their queue, unacked, or
+	// recovered from the WAL.  Topic messages, shared by their
+	// subscribers, never are.
+	redelivered bool
+	// persisted messages are in the WAL, until acked.
+	persisted bool
+	// deliverAt is when a scheduled message is due, zero if it is not.
+	deliverAt time.Time
+	// expires is when the message expires, zero if it does not.
+	expires time.Time
+	// priority is from 0 to 9, highest first.
+	priority int
+}
+
+type destination struct {
+	name  string
+	topic bool
+
+	// pending messages of a queue, highest priority first, then oldest
+	// first.
+	pending []*message
+	// unmatched messages, in the same order, are those no subscription's
+	// selector matched.  They are held out of pending, so as not to be
+	// matched again on every dispatch, until a subscription is added.
+	unmatched []*message
+	subs      []*subscription
+	next      int
+
+	// scheduled is the number of messages held until they are due.
+	scheduled int
+	expired   uint64
+
+	enqueued meter
+	dequeued meter
+}
+
+type subscription struct {
+	id      string
+	conn    *conn
+	dest    *destination
+	ackMode string
+	// prefetch limits unacked messages, zero is unlimited.
+	prefetch int
+	// selector, if set, filters the messages delivered.
+	selector *selector.Selector
+
+	// unacked deliveries, in the order they were delivered.
+	unacked []*delivery
+	// backlog holds topic messages, while prefetch is reached.
+	backlog []*message
+}
+
+type delivery struct {
+	ackID string
+	msg   *message
+	sub   *subscription
+}
+
+var errBadPriority = errors.New("invalid priority header")
+
+// sendHeaders are set by the broker, and not copied from SEND frames.
+var sendHeaders = map[string]bool{
+	stomper.HeaderDestination:   true,
+	stomper.HeaderTransaction:   true,
+	stomper.HeaderReceipt:       true,
+	stomper.HeaderContentLength: true,
+	stomper.HeaderMessageID:     true,
+	stomper.HeaderSubscription:  true,
+	stomper.HeaderAck:           true,
+
+	stomper.HeaderScheduledDelay: true,
+	stomper.HeaderDeliverAt:      true,
+}
+
+func messageID(seq uint64) string {
+	return "msg-" + strconv.FormatUint(seq, 10)
+}
+
+func newMessage(seq uint64, sf stomper.ServerFrame, deliverAt time.Time) *message {
+	m := &message{
+		seq:         seq,
+		id:          messageID(seq),
+		destination: string(sf.Headers[stomper.HeaderDestination]),
+		headers:     make(map[string][]byte, len(sf.Headers)),
+		body:        sf.Body,
+		deliverAt:   deliverAt,
+	}
+
+	for k, v := range sf.Headers {
+		if !sendHeaders[k] {
+			m.headers[k] = v
+		}
+	}
+	m.derive()
+
+	return m
+}
+
+// derive sets the fields given by a message's headers.
+func (m *message) derive() {
+	m.expires = expiry(m.headers)
+
+	m.priority = stomper.DefaultPriority
+	if p, err := parsePriority(m.headers[stomper.HeaderPriority]); err == nil && p >= 0 {
+		m.priority = p
+	}
+}
+
+// parsePriority parses a priority header, returning -1 if it is absent.
+func parsePriority(v []byte) (int, error) {
+	if v == nil {
+		return -1, nil
+	}
+	p, err := strconv.Atoi(string(v))
+	if err != nil || p < 0 || p > 9 {
+		return -1, errBadPriority
+	}
+	return p, nil
+}
+
+// before reports whether m is delivered before o, from the same queue.
+func (m *message) before(o *message) bool {
+	if m.priority != o.priority {
+		return m.priority > o.priority
+	}
+	return m.seq < o.seq
+}
+
+// ready reports whether the subscription may be sent another message: it
+// has fewer unacked messages than its prefetch, and its connection is
+// keeping up with those sent.
+func (sub *subscription) ready() bool {
+	if sub.ackMode != "auto" && sub.prefetch > 0 && len(sub.unacked) >= sub.prefetch {
+		return false
+	}
+	return !sub.conn.busy()
+}
+
+// matches reports whether a message matches the subscription's selector,
+// by its headers, destination and message-id.
+func (sub *subscription) matches(m *message) bool {
+	if sub.selector == nil {
+		return true
+	}
+
+	return sub.selector.MatchesFunc(func(name string) ([]byte, bool) {
+		switch name {
+		case stomper.HeaderDestination:
+			return []byte(m.destination), true
+		case stomper.HeaderMessageID:
+			return []byte(m.id), true
+		}
+		v, ok := m.headers[name]
+		return v, ok
+	})
+}
+
+// destination returns the named destination, creating it if need be.
+// The server's lock must be held.
+func (s *Server) destination(name string) *destination {
+	d, ok := s.destinations[name]
+	if !ok {
+		d = &destination{name: name, topic: strings.HasPrefix(name, topicPrefix)}
+		s.destinations[name] = d
+	}
+	return d
+}
+
+// publish routes a message to its destination, or schedules it if it is
+// not yet due, logging queue messages to the WAL first, if the server has
+// one.  The server's lock must be held.
+func (s *Server) publish(m *message) error {
+	now := time.Now()
+
+	d := s.destination(m.destination)
+	d.enqueued.mark(now)
+
+	if !d.topic && s.options.WAL != nil {
+		if err := s.options.WAL.appendMessage(m); err != nil {
+			return fmt.Errorf("failed persisting message: %s", err)
+		}
+		m.persisted = true
+	}
+
+	if m.deliverAt.After(now) {
+		s.schedule(m)
+		return nil
+	}
+
+	s.route(d, m)
+	return nil
+}
+
+// route delivers a message to a topic's subscribers, or queues it.
+func (s *Server) route(d *destination, m *message) {
+	if d.topic {
+		for _, sub := range d.subs {
+			if !sub.matches(m) {
+				continue
+			}
+			if len(sub.backlog) >= s.options.MaxOutbound {
+				sub.conn.tooSlow()
+				continue
+			}
+			sub.backlog = append(sub.backlog, m)
+			s.drain(sub)
+		}
+		return
+	}
+
+	d.insert(m)
+	s.dispatch(d)
+}
+
+// insert adds a message to a queue's pending messages, in delivery order.
+func (d *destination) insert(m *message) {
+	d.pending = insertOrdered(d.pending, m)
+}
+
+// insertOrdered adds m to msgs, in delivery order.
+func insertOrdered(msgs []*message, m *message) []*message {
+	n := len(msgs)
+	if n == 0 || msgs[n-1].before(m) {
+		return append(msgs, m)
+	}
+
+	i := sort.Search(n, func(i int) bool { return m.before(msgs[i]) })
+	return slices.Insert(msgs, i, m)
+}
+
+// rematch moves the unmatched messages which sub matches back to pending,
+// once it is added.
+func (d *destination) rematch(sub *subscription) {
+	kept := d.unmatched[:0]
+	for _, m := range d.unmatched {
+		if sub.matches(m) {
+			d.insert(m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	for i := len(kept); i < len(d.unmatched); i++ {
+		d.unmatched[i] = nil
+	}
+	d.unmatched = kept
+}
+
+// waiting returns the pending and unmatched messages, in delivery order.
+func (d *destination) waiting() []*message {
+	if len(d.unmatched) == 0 {
+		return d.pending
+	}
+
+	msgs := make([]*message, 0, len(d.pending)+len(d.unmatched))
+	p, u := d.pending, d.unmatched
+	for len(p) > 0 && len(u) > 0 {
+		if p[0].before(u[0]) {
+			msgs, p = append(msgs, p[0]), p[1:]
+		} else {
+			msgs, u = append(msgs, u[0]), u[1:]
+		}
+	}
+	msgs = append(msgs, p...)
+	return append(msgs, u...)
+}
+
+// consumed counts an acked message, and forgets it.
+func (s *Server) consumed(m *message) {
+	s.destination(m.destination).dequeued.mark(time.Now())
+	s.forget(m)
+}
+
+// forget tombstones a message in the WAL.  A failure is logged, the
+// message is then redelivered after a restart.
+func (s *Server) forget(m *message) {
+	if !m.persisted {
+		return
+	}
+	m.persisted = false
+
+	if err := s.options.WAL.appendTombstone(m.seq); err != nil {
+		s.log(slog.LevelError, "stomp ack not persisted",
+			slog.String("message-id", m.id), slog.Any("error", err))
+	}
+}
+
+// dispatch delivers a queue's pending messages, in order, each to the next
+// ready subscriber whose selector it matches.  Messages no ready
+// subscriber matches are skipped, those no subscriber matches are moved
+// to unmatched, and expired messages are expired.
+func (s *Server) dispatch(d *destination) {
+	now := time.Now()
+
+	for i := 0; i < len(d.pending); {
+		m := d.pending[i]
+
+		if m.expired(now) {
+			d.remove(i)
+			s.expire(d, m)
+			continue
+		}
+
+		sub := d.nextReady(m)
+		if sub == nil {
+			if !d.anyReady() {
+				return
+			}
+			if !d.anyMatches(m) {
+				d.remove(i)
+				d.unmatched = insertOrdered(d.unmatched, m)
+				continue
+			}
+			i++
+			continue
+		}
+
+		d.remove(i)
+		s.deliver(sub, m)
+	}
+}
+
+// nextReady returns the next ready subscription, in turn, which m
+// matches.
+func (d *destination) nextReady(m *message) *subscription {
+	for i := 0; i < len(d.subs); i++ {
+		sub := d.subs[(d.next+i)%len(d.subs)]
+		if sub.ready() && sub.matches(m) {
+			d.next = (d.next + i + 1) % len(d.subs)
+			return sub
+		}
+	}
+	return nil
+}
+
+func (d *destination) anyReady() bool {
+	for _, sub := range d.subs {
+		if sub.ready() {
+			return true
+		}
+	}
+	return false
+}
+
+// anyMatches reports whether any subscription, ready or not, matches m.
+func (d *destination) anyMatches(m *message) bool {
+	for _, sub := range d.subs {
+		if sub.matches(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes the i'th pending message.
+func (d *destination) remove(i int) {
+	if i == 0 {
+		d.pending[0] = nil
+		d.pending = d.pending[1:]
+		return
+	}
+	d.pending = slices.Delete(d.pending, i, i+1)
+}
+
+// drain delivers a topic subscription's backlog, while it is ready.
+// Expired messages are dropped.
+func (s *Server) drain(sub *subscription) {
+	now := time.Now()
+
+	for len(sub.backlog) > 0 && sub.ready() {
+		m := sub.backlog[0]
+		sub.backlog[0] = nil
+		sub.backlog = sub.backlog[1:]
+
+		if m.expired(now) {
+			s.expire(sub.dest, m)
+			continue
+		}
+		s.deliver(sub, m)
+	}
+}
+
+func (s *Server) deliver(sub *subscription, m *message) {
+	sf := stomper.NewMessageFrame(m.destination, m.id, sub.id, m.body)
+	for k, v := range m.headers {
+		if sf.Headers[k] == nil {
+			sf.Headers[k] = v
+		}
+	}
+	if m.redelivered {
+		sf.Headers[stomper.HeaderRedelivered] = []byte("true")
+	}
+
+	var ackID string
+	if sub.ackMode != "auto" {
+		ackID = s.newID("ack-")
+		sf.Headers[stomper.HeaderAck] = []byte(ackID)
+	}
+
+	if err := sub.conn.enqueue(sf); err != nil {
+		// A queue message waits for another subscriber, if its
+		// connection is closing, but is dropped if it cannot be sent.
+		if err == errTooSlow && !sub.dest.topic {
+			sub.dest.insert(m)
+		} else {
+			s.forget(m)
+		}
+		return
+	}
+
+	if sub.ackMode != "auto" {
+		d := &delivery{ackID: ackID, msg: m, sub: sub}
+		sub.unacked = append(sub.unacked, d)
+		sub.conn.unacked[d.ackID] = d
+	} else {
+		s.consumed(m)
+	}
+}
+
+// resume delivers to a connection's subscriptions, once it has caught up
+// with the frames queued to it.
+func (s *Server) resume(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range c.subs {
+		if sub.dest.topic {
+			s.drain(sub)
+		} else {
+			s.dispatch(sub.dest)
+		}
+	}
+}
+
+// settle acks, or nacks, the delivery with the given ack id, and in
+// client ack mode every earlier delivery of its subscription too.  Unknown
+// ack ids are ignored, as the message may have been acked already.
+// Nacked queue messages are redelivered, nacked topic messages dropped.
+func (s *Server) settle(c *conn, ackID string, ack bool) {
+	d, ok := c.unacked[ackID]
+	if !ok {
+		return
+	}
+	sub := d.sub
+
+	n := 1
+	for i, u := range sub.unacked {
+		if u == d {
+			n = i + 1
+			break
+		}
+	}
+
+	settled := []*delivery{d}
+	if sub.ackMode == "client" {
+		settled = append([]*delivery(nil), sub.unacked[:n]...)
+	}
+
+	for _, u := range settled {
+		delete(c.unacked, u.ackID)
+		sub.removeUnacked(u)
+	}
+
+	if ack {
+		for _, u := range settled {
+			s.consumed(u.msg)
+		}
+	} else {
+		s.requeue(sub.dest, settled)
+	}
+
+	if sub.dest.topic {
+		s.drain(sub)
+	} else {
+		s.dispatch(sub.dest)
+	}
+}
+
+func (sub *subscription) removeUnacked(d *delivery) {
+	for i, u := range sub.unacked {
+		if u == d {
+			sub.unacked = append(sub.unacked[:i], sub.unacked[i+1:]...)
+			return
+		}
+	}
+}
+
+// requeue returns unacked queue messages to their queue, ahead of the
+// messages sent after them, of the same priority.
+func (s *Server) requeue(d *destination, ds []*delivery) {
+	if d.topic {
+		return
+	}
+
+	for _, u := range ds {
+		u.msg.redelivered = true
+		d.insert(u.msg)
+	}
+}
+
+// unsubscribe removes a subscription, requeueing its unacked messages.
+func (s *Server) unsubscribe(sub *subscription) {
+	d := sub.dest
+
+	for i, x := range d.subs {
+		if x == sub {
+			d.subs = append(d.subs[:i], d.subs[i+1:]...)
+			break
+		}
+	}
+	if d.next >= len(d.subs) {
+		d.next = 0
+	}
+
+	for _, u := range sub.unacked {
+		delete(sub.conn.unacked, u.ackID)
+	}
+	s.requeue(d, sub.unacked)
+	sub.unacked = nil
+	sub.backlog = nil
+
+	delete(sub.conn.subs, sub.id)
+
+	if !d.topic {
+		s.dispatch(d)
+	}
+}
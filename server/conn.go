@@ -0,0 +1,617 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	stomper "github.com/russmack/stompingophers"
+	"github.com/russmack/stompingophers/selector"
+)
+
+const (
+	// connectTimeout limits the wait for a connection's CONNECT frame.
+	connectTimeout = 30 * time.Second
+	// flushTimeout limits the wait to send frames before closing.
+	flushTimeout = 5 * time.Second
+)
+
+var (
+	// errClose ends a connection, after its frames are flushed.
+	errClose   = errors.New("connection closing")
+	errTooSlow = errors.New("connection too slow")
+)
+
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	session string
+	// user is the authenticated login, and connectedAt the time of
+	// connecting, guarded by the server's lock.
+	user        string
+	connectedAt time.Time
+
+	// connected, and recvEvery, are only used by the reading goroutine.
+	connected bool
+	recvEvery time.Duration
+
+	// Broker state, guarded by the server's lock.
+	subs    map[string]*subscription
+	unacked map[string]*delivery
+	txs     map[string][]stomper.ServerFrame
+
+	// Outgoing frames, and the heart-beat interval, guarded by outMu, and
+	// written by writeLoop.  queued counts the frames not yet written,
+	// and throttled is set when deliveries wait for them to be.
+	outMu     sync.Mutex
+	out       [][]byte
+	queued    int
+	throttled bool
+	draining  bool
+	sendEvery time.Duration
+	signal    chan struct{}
+	done      chan struct{}
+}
+
+// newConn registers a connection, or returns nil if the server is closed.
+func (s *Server) newConn(nc net.Conn) *conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	c := &conn{
+		server:  s,
+		netConn: nc,
+		session: s.newID("session-"),
+		subs:    map[string]*subscription{},
+		unacked: map[string]*delivery{},
+		txs:     map[string][]stomper.ServerFrame{},
+		signal:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+
+	return c
+}
+
+func (c *conn) serve() {
+	s := c.server
+
+	go c.writeLoop()
+
+	err := c.readLoop()
+	if err == errClose {
+		s.log(slog.LevelInfo, "stomp client disconnected", slog.String("session", c.session))
+	} else {
+		s.log(slog.LevelInfo, "stomp client connection closed",
+			slog.String("session", c.session), slog.Any("error", err))
+	}
+
+	s.mu.Lock()
+	for _, sub := range c.subs {
+		s.unsubscribe(sub)
+	}
+	delete(s.conns, c)
+	s.mu.Unlock()
+
+	// Frames are flushed before closing, after an ERROR or DISCONNECT,
+	// otherwise the connection has failed.
+	if err != errClose {
+		c.netConn.Close()
+	}
+	c.flush()
+	c.netConn.Close()
+}
+
+func (c *conn) readLoop() error {
+	r := bufio.NewReader(c.netConn)
+	c.netConn.SetReadDeadline(time.Now().Add(connectTimeout))
+
+	for {
+		sf, err := readFrame(r, c.server.options.MaxBodySize)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return err
+			}
+			if sf.Command != "" {
+				c.fail(sf, "malformed frame", err.Error())
+				return errClose
+			}
+			return err
+		}
+
+		if c.recvEvery > 0 {
+			c.netConn.SetReadDeadline(time.Now().Add(2 * c.recvEvery))
+		} else if c.connected {
+			c.netConn.SetReadDeadline(time.Time{})
+		}
+
+		// Heart-beat.
+		if sf.Command == "" {
+			continue
+		}
+
+		if err := c.handle(sf); err != nil {
+			return err
+		}
+	}
+}
+
+// handle processes a client frame, sending its receipt if one was asked
+// for.
+func (c *conn) handle(sf stomper.ServerFrame) error {
+	s := c.server
+
+	if sf.Command == stomper.CmdConnect || sf.Command == cmdStomp {
+		return c.connect(sf)
+	}
+	if !c.connected {
+		c.fail(sf, "not connected", "expected a CONNECT frame, got "+sf.Command)
+		return errClose
+	}
+
+	s.mu.Lock()
+	msg, detail := c.process(sf)
+	s.mu.Unlock()
+
+	// Synced without the server's lock, so other connections continue.
+	if msg == "" && s.options.WAL != nil {
+		if err := s.options.WAL.commit(); err != nil {
+			msg, detail = "persist failed", err.Error()
+		}
+	}
+	if msg != "" {
+		c.fail(sf, msg, detail)
+		return errClose
+	}
+	c.receipt(sf)
+
+	if sf.Command == stomper.CmdDisconnect {
+		return errClose
+	}
+
+	return nil
+}
+
+// process applies a frame to the broker, returning an error message and
+// detail on failure.  The server's lock must be held.
+func (c *conn) process(sf stomper.ServerFrame) (string, string) {
+	s := c.server
+
+	if msg, detail := c.authorize(sf); msg != "" {
+		return msg, detail
+	}
+
+	txn, inTx := sf.Headers[stomper.HeaderTransaction]
+
+	if msg, detail := checkHeaders(sf); msg != "" {
+		return msg, detail
+	}
+
+	switch sf.Command {
+	case stomper.CmdSend, stomper.CmdAck, stomper.CmdNack:
+		// Frames are checked as they are buffered, so that a COMMIT
+		// applies all of them, or none if one was refused.
+		if inTx {
+			if _, ok := c.txs[string(txn)]; !ok {
+				return "unknown transaction", "transaction " + string(txn) + " has not begun"
+			}
+			c.txs[string(txn)] = append(c.txs[string(txn)], sf)
+			return "", ""
+		}
+	}
+
+	switch sf.Command {
+	case stomper.CmdSend:
+		at, _ := deliverAt(sf, time.Now())
+		s.lastID++
+		if err := s.publish(newMessage(s.lastID, sf, at)); err != nil {
+			return "send failed", err.Error()
+		}
+
+	case stomper.CmdSubscribe:
+		return c.subscribe(sf)
+
+	case stomper.CmdUnsubscribe:
+		id := string(sf.Headers[stomper.HeaderID])
+		sub, ok := c.subs[id]
+		if !ok {
+			return "unknown subscription", "no subscription with id " + id
+		}
+		s.unsubscribe(sub)
+
+	case stomper.CmdAck, stomper.CmdNack:
+		s.settle(c, string(sf.Headers[stomper.HeaderID]), sf.Command == stomper.CmdAck)
+
+	case stomper.CmdBegin:
+		if !inTx {
+			return "missing header", "BEGIN requires a transaction header"
+		}
+		if _, ok := c.txs[string(txn)]; ok {
+			return "duplicate transaction", "transaction " + string(txn) + " has already begun"
+		}
+		c.txs[string(txn)] = []stomper.ServerFrame{}
+
+	case stomper.CmdCommit, stomper.CmdAbort:
+		frames, ok := c.txs[string(txn)]
+		if !inTx || !ok {
+			return "unknown transaction", "transaction " + string(txn) + " has not begun"
+		}
+		delete(c.txs, string(txn))
+
+		if sf.Command == stomper.CmdAbort {
+			return "", ""
+		}
+		for _, f := range frames {
+			delete(f.Headers, stomper.HeaderTransaction)
+			if msg, detail := c.process(f); msg != "" {
+				return msg, detail
+			}
+		}
+
+	case stomper.CmdDisconnect:
+
+	default:
+		return "unknown command", "unknown command " + sf.Command
+	}
+
+	return "", ""
+}
+
+// checkHeaders checks the headers of SEND, ACK and NACK frames, returning
+// an error message and detail if they are invalid.
+func checkHeaders(sf stomper.ServerFrame) (string, string) {
+	switch sf.Command {
+	case stomper.CmdSend:
+		if len(sf.Headers[stomper.HeaderDestination]) == 0 {
+			return "missing header", "SEND requires a destination header"
+		}
+		if _, err := deliverAt(sf, time.Now()); err != nil {
+			return "invalid header", "SEND scheduling headers must be non-negative milliseconds"
+		}
+		if _, err := parsePriority(sf.Headers[stomper.HeaderPriority]); err != nil {
+			return "invalid header", "SEND priority must be from 0 to 9"
+		}
+
+	case stomper.CmdAck, stomper.CmdNack:
+		if _, ok := sf.Headers[stomper.HeaderID]; !ok {
+			return "missing header", sf.Command + " requires an id header"
+		}
+	}
+
+	return "", ""
+}
+
+// authorize checks the connection's user may send, or subscribe, to the
+// frame's destination.
+func (c *conn) authorize(sf stomper.ServerFrame) (string, string) {
+	acl := c.server.options.ACL
+	if acl == nil {
+		return "", ""
+	}
+
+	var perm Permission
+	var verb string
+	switch sf.Command {
+	case stomper.CmdSend:
+		perm, verb = PermWrite, "send to "
+	case stomper.CmdSubscribe:
+		perm, verb = PermRead, "subscribe to "
+	default:
+		return "", ""
+	}
+
+	dest := string(sf.Headers[stomper.HeaderDestination])
+	if dest == "" || acl.Allowed(c.user, dest, perm) {
+		return "", ""
+	}
+
+	user := c.user
+	if user == "" {
+		user = "anonymous"
+	}
+	return "access denied", user + " may not " + verb + dest
+}
+
+func (c *conn) subscribe(sf stomper.ServerFrame) (string, string) {
+	s := c.server
+
+	id := string(sf.Headers[stomper.HeaderID])
+	name := string(sf.Headers[stomper.HeaderDestination])
+	if id == "" || name == "" {
+		return "missing header", "SUBSCRIBE requires id and destination headers"
+	}
+	if _, ok := c.subs[id]; ok {
+		return "duplicate subscription", "subscription " + id + " already exists"
+	}
+
+	ackMode := string(sf.Headers[stomper.HeaderAck])
+	switch ackMode {
+	case "":
+		ackMode = "auto"
+	case "auto", "client", "client-individual":
+	default:
+		return "invalid header", "unknown ack mode " + ackMode
+	}
+
+	prefetch := 0
+	for _, h := range []string{stomper.HeaderPrefetchCount, stomper.HeaderActiveMQPrefetch} {
+		if v, ok := sf.Headers[h]; ok {
+			prefetch, _ = strconv.Atoi(string(v))
+			break
+		}
+	}
+
+	var sel *selector.Selector
+	if v, ok := sf.Headers[stomper.HeaderSelector]; ok {
+		var err error
+		if sel, err = selector.Parse(string(v)); err != nil {
+			return "invalid selector", err.Error()
+		}
+	}
+
+	d := s.destination(name)
+	sub := &subscription{id: id, conn: c, dest: d, ackMode: ackMode, prefetch: prefetch, selector: sel}
+	d.subs = append(d.subs, sub)
+	c.subs[id] = sub
+
+	// The receipt is sent before pending messages.
+	c.receipt(sf)
+	delete(sf.Headers, stomper.HeaderReceipt)
+
+	if !d.topic {
+		d.rematch(sub)
+		s.dispatch(d)
+	}
+
+	return "", ""
+}
+
+func (c *conn) connect(sf stomper.ServerFrame) error {
+	if c.connected {
+		c.fail(sf, "already connected", "")
+		return errClose
+	}
+
+	version := ""
+	accept := "1.0"
+	if v, ok := sf.Headers[stomper.HeaderAcceptVersion]; ok {
+		accept = string(v)
+	}
+	for _, v := range []string{"1.2", "1.1", "1.0"} {
+		if strings.Contains(","+accept+",", ","+v+",") {
+			version = v
+			break
+		}
+	}
+	if version == "" {
+		c.fail(sf, "unsupported protocol version", "supported versions are 1.0,1.1,1.2")
+		return errClose
+	}
+
+	if auth := c.server.options.Authenticator; auth != nil {
+		login := string(sf.Headers[stomper.HeaderLogin])
+		if !auth.Authenticate(login, string(sf.Headers[stomper.HeaderPasscode])) {
+			c.fail(sf, "authentication failed", "")
+			return errClose
+		}
+		c.server.mu.Lock()
+		c.user = login
+		c.server.mu.Unlock()
+	}
+
+	cx, cy := parseHeartBeat(sf.Headers[stomper.HeaderHeartBeat])
+	hb := c.server.options.HeartBeat
+	if hb > 0 && cy > 0 {
+		c.outMu.Lock()
+		c.sendEvery = max(hb, cy)
+		c.outMu.Unlock()
+	}
+	if hb > 0 && cx > 0 {
+		c.recvEvery = max(hb, cx)
+	}
+
+	ms := strconv.FormatInt(hb.Milliseconds(), 10)
+
+	c.connected = true
+	c.server.mu.Lock()
+	c.connectedAt = time.Now()
+	c.server.mu.Unlock()
+	c.server.log(slog.LevelInfo, "stomp client connected",
+		slog.String("session", c.session),
+		slog.String("remote", c.netConn.RemoteAddr().String()),
+		slog.String("user", c.user),
+		slog.String("version", version))
+	c.enqueue(stomper.NewConnectedFrame(version, c.session, c.server.options.Name, ms+","+ms))
+
+	if c.recvEvery > 0 {
+		c.netConn.SetReadDeadline(time.Now().Add(2 * c.recvEvery))
+	} else {
+		c.netConn.SetReadDeadline(time.Time{})
+	}
+
+	return nil
+}
+
+// parseHeartBeat parses a heart-beat header, of millisecond intervals.
+func parseHeartBeat(v []byte) (time.Duration, time.Duration) {
+	x, y, ok := strings.Cut(string(v), ",")
+	if !ok {
+		return 0, 0
+	}
+
+	cx, err := strconv.Atoi(strings.TrimSpace(x))
+	if err != nil || cx < 0 {
+		cx = 0
+	}
+	cy, err := strconv.Atoi(strings.TrimSpace(y))
+	if err != nil || cy < 0 {
+		cy = 0
+	}
+
+	return time.Duration(cx) * time.Millisecond, time.Duration(cy) * time.Millisecond
+}
+
+func (c *conn) receipt(sf stomper.ServerFrame) {
+	id, ok := sf.Headers[stomper.HeaderReceipt]
+	if !ok {
+		return
+	}
+
+	c.enqueue(stomper.NewReceiptFrame(string(id)))
+}
+
+// fail sends an ERROR frame, in reply to sf.
+func (c *conn) fail(sf stomper.ServerFrame, msg, detail string) {
+	c.server.log(slog.LevelWarn, "stomp error sent",
+		slog.String("session", c.session),
+		slog.String("command", sf.Command),
+		slog.String("message", msg),
+		slog.String("detail", detail))
+
+	var body []byte
+	if detail != "" {
+		body = []byte(detail + "\n")
+	}
+
+	c.enqueue(stomper.NewErrorFrame(msg, string(sf.Headers[stomper.HeaderReceipt]), body))
+}
+
+// enqueue queues a frame for writeLoop.  It does not block, so it may be
+// called with the server's lock held.  A frame which cannot be encoded is
+// logged, and a connection too far behind is closed.
+func (c *conn) enqueue(sf stomper.ServerFrame) error {
+	b, err := sf.Encode()
+	if err != nil {
+		c.server.log(slog.LevelError, "stomp frame not sent",
+			slog.String("session", c.session), slog.Any("error", err))
+		return err
+	}
+
+	c.outMu.Lock()
+	if c.queued >= 2*c.server.options.MaxOutbound {
+		c.outMu.Unlock()
+		c.tooSlow()
+		return errTooSlow
+	}
+	c.out = append(c.out, b)
+	c.queued++
+	c.outMu.Unlock()
+
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// busy reports whether the connection's queue is full, so messages are
+// not delivered to it, until writeLoop resumes them.
+func (c *conn) busy() bool {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	if c.queued < c.server.options.MaxOutbound {
+		return false
+	}
+	c.throttled = true
+	return true
+}
+
+// tooSlow closes a connection not reading its frames.
+func (c *conn) tooSlow() {
+	c.server.log(slog.LevelWarn, "stomp client too slow, closing",
+		slog.String("session", c.session))
+	c.netConn.Close()
+}
+
+// flush waits for queued frames to be written, then stops writeLoop.
+func (c *conn) flush() {
+	c.netConn.SetWriteDeadline(time.Now().Add(flushTimeout))
+
+	c.outMu.Lock()
+	c.draining = true
+	c.outMu.Unlock()
+
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+
+	<-c.done
+}
+
+// writeLoop writes queued frames, each in its own write, and heart-beats
+// when nothing has been written for the negotiated interval.
+func (c *conn) writeLoop() {
+	defer close(c.done)
+
+	var beat <-chan time.Time
+	var every time.Duration
+	lastWrite := time.Now()
+
+	for {
+		select {
+		case <-c.signal:
+		case <-beat:
+			if time.Since(lastWrite) >= every/2 {
+				if _, err := c.netConn.Write([]byte{'\n'}); err != nil {
+					return
+				}
+				lastWrite = time.Now()
+			}
+			continue
+		}
+
+		for {
+			c.outMu.Lock()
+			out := c.out
+			c.out = nil
+			draining := c.draining
+			if beat == nil && c.sendEvery > 0 {
+				every = c.sendEvery
+				ticker := time.NewTicker(every / 2)
+				defer ticker.Stop()
+				beat = ticker.C
+			}
+			c.outMu.Unlock()
+
+			if len(out) == 0 {
+				if draining {
+					return
+				}
+				break
+			}
+
+			for _, b := range out {
+				if _, err := c.netConn.Write(b); err != nil {
+					c.netConn.Close()
+					return
+				}
+			}
+			lastWrite = time.Now()
+
+			c.outMu.Lock()
+			c.queued -= len(out)
+			resume := c.throttled && c.queued < c.server.options.MaxOutbound
+			if resume {
+				c.throttled = false
+			}
+			c.outMu.Unlock()
+			if resume {
+				c.server.resume(c)
+			}
+		}
+	}
+}
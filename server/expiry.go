@@ -0,0 +1,104 @@
+package server
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+// DefaultExpirySweep is how often expired messages are swept from
+// destinations, when not set in Options.
+const DefaultExpirySweep = time.Second
+
+// expiry returns when a message's expires header says it expires, or the
+// zero time if it does not.
+func expiry(headers map[string][]byte) time.Time {
+	ms, err := strconv.ParseInt(string(headers[stomper.HeaderExpires]), 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+func (m *message) expired(now time.Time) bool {
+	return !m.expires.IsZero() && !now.Before(m.expires)
+}
+
+// expire discards an expired message, moving a queue message to the
+// expiry destination, if the server has one.  The server's lock must be
+// held.
+func (s *Server) expire(d *destination, m *message) {
+	d.expired++
+
+	to := s.options.ExpiryDestination
+	if !d.topic && to != "" && to != d.name {
+		headers := make(map[string][]byte, len(m.headers)+3)
+		for k, v := range m.headers {
+			headers[k] = v
+		}
+		delete(headers, stomper.HeaderExpires)
+		headers[stomper.HeaderDeadLetterDestination] = []byte(d.name)
+		headers[stomper.HeaderDeadLetterMessageID] = []byte(m.id)
+		headers[stomper.HeaderDeadLetterReason] = []byte("expired")
+
+		s.lastID++
+		moved := &message{
+			seq:         s.lastID,
+			id:          messageID(s.lastID),
+			destination: to,
+			headers:     headers,
+			body:        m.body,
+		}
+		moved.derive()
+		if err := s.publish(moved); err != nil {
+			// Kept in the WAL, the message is expired again after a
+			// restart.
+			s.log(slog.LevelError, "stomp expired message not moved",
+				slog.String("message-id", m.id), slog.Any("error", err))
+			return
+		}
+	}
+
+	s.forget(m)
+}
+
+// sweep expires the messages waiting in destinations, then sets the timer
+// for the next sweep.
+func (s *Server) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	now := time.Now()
+	for _, d := range s.destinations {
+		d.pending = s.unexpired(d, d.pending, now)
+		d.unmatched = s.unexpired(d, d.unmatched, now)
+		for _, sub := range d.subs {
+			sub.backlog = s.unexpired(d, sub.backlog, now)
+		}
+	}
+
+	s.sweeper.Reset(s.options.ExpirySweep)
+}
+
+// unexpired expires the expired messages of msgs, returning the rest.
+// The server's lock must be held.
+func (s *Server) unexpired(d *destination, msgs []*message, now time.Time) []*message {
+	kept := msgs[:0]
+	for _, m := range msgs {
+		if m.expired(now) {
+			s.expire(d, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	for i := len(kept); i < len(msgs); i++ {
+		msgs[i] = nil
+	}
+	return kept
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"testing"
+
+	"time"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+func Test_ExpiredNotDelivered(t *testing.T) {
+	srv := New(&Options{ExpiryDestination: "/queue/expired"})
+	defer srv.Close()
+
+	producer := connect(t, srv, nil)
+	producer.Send("/queue/a", []byte("stale"), "r", "", stomper.Expires(time.Now().Add(50*time.Millisecond)))
+	producer.Send("/queue/a", []byte("fresh"), "r", "", stomper.Expires(time.Now().Add(time.Hour)))
+	producer.Send("/queue/a", []byte("forever"), "r", "", stomper.Header{Key: stomper.HeaderExpires, Value: "0"})
+	time.Sleep(100 * time.Millisecond)
+
+	frames := subscribe(t, connect(t, srv, nil), "/queue/a", stomper.AckModeAuto)
+	for _, want := range []string{"fresh", "forever"} {
+		sf := next(t, frames)
+		if string(sf.Payload()) != want {
+			t.Error("Expected:", want, "\nGot:", sf.String())
+		}
+		if want == "fresh" && len(sf.Headers[stomper.HeaderExpires]) == 0 {
+			t.Error("Expected: expires header\nGot:", sf.String())
+		}
+	}
+	nothing(t, frames)
+
+	expired := subscribe(t, connect(t, srv, nil), "/queue/expired", stomper.AckModeAuto)
+	sf := next(t, expired)
+	if string(sf.Payload()) != "stale" ||
+		string(sf.Headers[stomper.HeaderDeadLetterDestination]) != "/queue/a" ||
+		string(sf.Headers[stomper.HeaderDeadLetterReason]) != "expired" ||
+		sf.Headers[stomper.HeaderExpires] != nil {
+		t.Error("Expected: stale moved to /queue/expired\nGot:", sf.String())
+	}
+
+	if dests := srv.Destinations(); dests[0].Name != "/queue/a" || dests[0].Expired != 1 {
+		t.Error("Expected: 1 expired from /queue/a\nGot:", dests)
+	}
+}
+
+func Test_ExpirySweep(t *testing.T) {
+	srv := New(&Options{ExpirySweep: 20 * time.Millisecond})
+	defer srv.Close()
+
+	producer := connect(t, srv, nil)
+	producer.Send("/queue/a", []byte("stale"), "r", "", stomper.Expires(time.Now().Add(30*time.Millisecond)))
+	producer.Send("/queue/a", []byte("fresh"), "r", "")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if d := srv.Destinations()[0]; d.Depth == 1 && d.Expired == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := srv.Destinations()[0]; d.Depth != 1 || d.Expired != 1 {
+		t.Error("Expected: 1 swept, 1 left\nGot:", d)
+	}
+}
+
+func Test_ExpiredTopicAndScheduled(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	frames := subscribe(t, connect(t, srv, nil), "/topic/t", stomper.AckModeAuto)
+	producer := connect(t, srv, nil)
+
+	// Due after it expires.
+	producer.Send("/topic/t", []byte("late"), "", "",
+		stomper.Delay(100*time.Millisecond), stomper.Expires(time.Now().Add(50*time.Millisecond)))
+	producer.Send("/topic/t", []byte("on time"), "", "",
+		stomper.Delay(100*time.Millisecond), stomper.Expires(time.Now().Add(time.Hour)))
+
+	if sf := next(t, frames); string(sf.Payload()) != "on time" {
+		t.Error("Expected: on time\nGot:", sf.String())
+	}
+	nothing(t, frames)
+}
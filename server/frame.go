@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+const (
+	cmdStomp = "STOMP"
+
+	maxHeaders    = 1000
+	maxLineLength = 64 * 1024
+)
+
+var (
+	errLineTooLong  = errors.New("frame line too long")
+	errTooManyLines = errors.New("too many frame headers")
+	errBadHeader    = errors.New("malformed frame header")
+	errBodyTooLarge = errors.New("frame body too large")
+	errNoNull       = errors.New("frame body not terminated by null")
+)
+
+// readFrame reads a client frame.  End of lines, and nulls, between
+// frames are heart-beats, returned as a frame without a command.  Header
+// names and values are unescaped, except in CONNECT frames.  The body is
+// read by content-length when present, and never exceeds maxBody bytes.
+func readFrame(r *bufio.Reader, maxBody int) (stomper.ServerFrame, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return stomper.ServerFrame{}, err
+	}
+	if b == '\n' || b == '\r' || b == 0 {
+		return stomper.ServerFrame{}, nil
+	}
+	r.UnreadByte()
+
+	line, err := readLine(r)
+	if err != nil {
+		return stomper.ServerFrame{}, err
+	}
+
+	sf := stomper.ServerFrame{Command: string(line), Headers: map[string][]byte{}}
+	escaped := sf.Command != stomper.CmdConnect && sf.Command != cmdStomp
+
+	for i := 0; ; i++ {
+		if i > maxHeaders {
+			return sf, errTooManyLines
+		}
+
+		line, err := readLine(r)
+		if err != nil {
+			return sf, err
+		}
+		if len(line) == 0 {
+			break
+		}
+
+		k, v, ok := bytes.Cut(line, []byte{':'})
+		if !ok {
+			return sf, errBadHeader
+		}
+		if escaped {
+			k, v = stomper.UnescapeHeader(k), stomper.UnescapeHeader(v)
+		}
+
+		// Repeated headers, only the first is used.
+		if _, ok := sf.Headers[string(k)]; !ok {
+			sf.Headers[string(k)] = v
+		}
+	}
+
+	if v, ok := sf.Headers[stomper.HeaderContentLength]; ok {
+		n, err := strconv.Atoi(string(v))
+		if err != nil || n < 0 {
+			return sf, errBadHeader
+		}
+		if n > maxBody {
+			return sf, errBodyTooLarge
+		}
+
+		sf.Body = make([]byte, n+1)
+		if _, err := io.ReadFull(r, sf.Body); err != nil {
+			return sf, err
+		}
+		if sf.Body[n] != 0 {
+			return sf, errNoNull
+		}
+		sf.Body = sf.Body[:n]
+
+		return sf, nil
+	}
+
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return sf, err
+		}
+		if c == 0 {
+			return sf, nil
+		}
+		if len(sf.Body) >= maxBody {
+			return sf, errBodyTooLarge
+		}
+		sf.Body = append(sf.Body, c)
+	}
+}
+
+// readLine reads a line, without its end of line.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		part, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, part...)
+		if len(line) > maxLineLength {
+			return nil, errLineTooLong
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
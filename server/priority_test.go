@@ -0,0 +1,111 @@
+package server
+
+import (
+	"testing"
+
+	"strings"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+// sendPriorities sends a message to /queue/a for each body, of the
+// priority given by its first character, or without one for "-".
+func sendPriorities(t *testing.T, producer *stomper.Client, bodies ...string) {
+	t.Helper()
+
+	for _, b := range bodies {
+		var h []stomper.Header
+		if b[0] != '-' {
+			h = append(h, stomper.Header{Key: stomper.HeaderPriority, Value: b[:1]})
+		}
+		if _, err := producer.Send("/queue/a", []byte(b), "r", "", h...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func receiveBodies(t *testing.T, frames chan stomper.ServerFrame, n int) string {
+	t.Helper()
+
+	var bodies []string
+	for i := 0; i < n; i++ {
+		sf := next(t, frames)
+		bodies = append(bodies, string(sf.Payload()))
+	}
+	return strings.Join(bodies, " ")
+}
+
+func Test_Priority(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	sendPriorities(t, connect(t, srv, nil), "1a", "9a", "-a", "4a", "9b", "0a", "1b", "-b")
+
+	frames := subscribe(t, connect(t, srv, nil), "/queue/a", stomper.AckModeAuto)
+	want := "9a 9b -a 4a -b 1a 1b 0a"
+	if got := receiveBodies(t, frames, 8); got != want {
+		t.Error("Expected:", want, "\nGot:", got)
+	}
+}
+
+func Test_PriorityRequeue(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	conn, r := rawConnect(t, srv, "0,0")
+	conn.Write([]byte("SUBSCRIBE\nid:0\ndestination:/queue/a\nack:client-individual\nprefetch-count:1\n\n\x00"))
+
+	producer := connect(t, srv, nil)
+	sendPriorities(t, producer, "5a", "5b", "9a", "1a")
+
+	// 5a was delivered before the others arrived.
+	sf := readServerFrame(t, r)
+	if string(sf.Body) != "5a" {
+		t.Fatal("Expected: 5a\nGot:", sf.String())
+	}
+	conn.Write([]byte("NACK\nid:" + string(sf.Headers[stomper.HeaderAck]) + "\n\n\x00"))
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		sf := readServerFrame(t, r)
+		got = append(got, string(sf.Body))
+		conn.Write([]byte("ACK\nid:" + string(sf.Headers[stomper.HeaderAck]) + "\n\n\x00"))
+	}
+	if want := "9a 5a 5b 1a"; strings.Join(got, " ") != want {
+		t.Error("Expected:", want, "\nGot:", strings.Join(got, " "))
+	}
+}
+
+func Test_PriorityAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	wal := openTestWAL(t, dir, SyncAlways)
+	srv := New(&Options{WAL: wal})
+	sendPriorities(t, connect(t, srv, nil), "2a", "8a", "-a", "8b", "2b")
+	srv.Close()
+	wal.Close()
+
+	wal = openTestWAL(t, dir, SyncAlways)
+	defer wal.Close()
+	srv = New(&Options{WAL: wal})
+	defer srv.Close()
+
+	frames := subscribe(t, connect(t, srv, nil), "/queue/a", stomper.AckModeAuto)
+	want := "8a 8b -a 2a 2b"
+	if got := receiveBodies(t, frames, 5); got != want {
+		t.Error("Expected:", want, "\nGot:", got)
+	}
+}
+
+func Test_PriorityInvalid(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	conn, r := rawConnect(t, srv, "0,0")
+	go conn.Write([]byte("SEND\ndestination:/queue/a\npriority:10\n\nhi\x00"))
+
+	sf := readServerFrame(t, r)
+	if sf.Command != stomper.CmdError || !strings.Contains(string(sf.Body), "priority") {
+		t.Error("Expected: ERROR invalid priority\nGot:", sf.String())
+	}
+}
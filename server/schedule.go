@@ -0,0 +1,130 @@
+package server
+
+import (
+	"container/heap"
+	"errors"
+	"strconv"
+	"time"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+var errBadSchedule = errors.New("invalid scheduling header")
+
+// scheduleHeap holds delayed messages, earliest due first.
+type scheduleHeap []*message
+
+func (q scheduleHeap) Len() int { return len(q) }
+
+func (q scheduleHeap) Less(i, j int) bool {
+	if q[i].deliverAt.Equal(q[j].deliverAt) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].deliverAt.Before(q[j].deliverAt)
+}
+
+func (q scheduleHeap) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *scheduleHeap) Push(x any) { *q = append(*q, x.(*message)) }
+
+func (q *scheduleHeap) Pop() any {
+	old := *q
+	m := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return m
+}
+
+// deliverAt returns when a SEND frame asks to be delivered, by its
+// AMQ_SCHEDULED_DELAY or deliver-at header, or the zero time for now.
+func deliverAt(sf stomper.ServerFrame, now time.Time) (time.Time, error) {
+	if v, ok := sf.Headers[stomper.HeaderScheduledDelay]; ok {
+		ms, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil || ms < 0 {
+			return time.Time{}, errBadSchedule
+		}
+		if ms == 0 {
+			return time.Time{}, nil
+		}
+		return now.Add(time.Duration(ms) * time.Millisecond), nil
+	}
+
+	if v, ok := sf.Headers[stomper.HeaderDeliverAt]; ok {
+		ms, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil || ms < 0 {
+			return time.Time{}, errBadSchedule
+		}
+		return time.UnixMilli(ms), nil
+	}
+
+	return time.Time{}, nil
+}
+
+// schedule holds a message until it is due.  The server's lock must be
+// held.
+func (s *Server) schedule(m *message) {
+	heap.Push(&s.scheduled, m)
+	s.destination(m.destination).scheduled++
+
+	if s.scheduled[0] == m {
+		s.resetTimer()
+	}
+}
+
+// resetTimer sets the timer for the earliest scheduled message.  The
+// server's lock must be held.
+func (s *Server) resetTimer() {
+	if len(s.scheduled) == 0 || s.closed {
+		return
+	}
+
+	wait := time.Until(s.scheduled[0].deliverAt)
+	if s.timer == nil {
+		s.timer = time.AfterFunc(wait, s.deliverDue)
+	} else {
+		s.timer.Reset(wait)
+	}
+}
+
+// deliverDue routes the scheduled messages which are due.
+func (s *Server) deliverDue() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	now := time.Now()
+	for len(s.scheduled) > 0 && !s.scheduled[0].deliverAt.After(now) {
+		m := heap.Pop(&s.scheduled).(*message)
+		d := s.destination(m.destination)
+		d.scheduled--
+		s.route(d, m)
+	}
+
+	s.resetTimer()
+}
+
+// unschedule removes, and returns, the scheduled messages of a
+// destination.  The server's lock must be held.
+func (s *Server) unschedule(d *destination) []*message {
+	var removed []*message
+
+	kept := s.scheduled[:0]
+	for _, m := range s.scheduled {
+		if m.destination == d.name {
+			removed = append(removed, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	for i := len(kept); i < len(s.scheduled); i++ {
+		s.scheduled[i] = nil
+	}
+	s.scheduled = kept
+	heap.Init(&s.scheduled)
+	d.scheduled = 0
+
+	return removed
+}
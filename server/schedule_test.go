@@ -0,0 +1,106 @@
+package server
+
+import (
+	"testing"
+
+	"strings"
+	"time"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+func Test_ScheduledDelivery(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	frames := subscribe(t, connect(t, srv, nil), "/queue/a", stomper.AckModeAuto)
+	producer := connect(t, srv, nil)
+
+	start := time.Now()
+	producer.Send("/queue/a", []byte("later"), "", "", stomper.Delay(300*time.Millisecond))
+	producer.Send("/queue/a", []byte("soon"), "", "", stomper.DeliverAt(start.Add(150*time.Millisecond)))
+	producer.Send("/queue/a", []byte("now"), "", "", stomper.Delay(0))
+
+	for _, want := range []string{"now", "soon", "later"} {
+		sf := next(t, frames)
+		if string(sf.Payload()) != want {
+			t.Error("Expected:", want, "\nGot:", string(sf.Payload()))
+		}
+		if _, ok := sf.Headers[stomper.HeaderScheduledDelay]; ok {
+			t.Error("Expected: scheduling headers removed\nGot:", sf.String())
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Error("Expected: delivered after 300ms\nGot:", elapsed)
+	}
+}
+
+func Test_ScheduledTopicAndPurge(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	frames := subscribe(t, connect(t, srv, nil), "/topic/t", stomper.AckModeAuto)
+	producer := connect(t, srv, nil)
+	producer.Send("/topic/t", []byte("news"), "", "", stomper.Delay(50*time.Millisecond))
+	producer.Send("/queue/a", []byte("a"), "r", "", stomper.Delay(100*time.Millisecond))
+
+	if dests := srv.Destinations(); len(dests) != 2 || dests[0].Scheduled != 1 || dests[0].Depth != 0 {
+		t.Error("Expected: 1 scheduled message in /queue/a\nGot:", dests)
+	}
+	if n, err := srv.Purge("/queue/a"); n != 1 || err != nil {
+		t.Error("Expected: 1 purged\nGot:", n, err)
+	}
+
+	if sf := next(t, frames); string(sf.Payload()) != "news" {
+		t.Error("Expected: news\nGot:", sf.String())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if dests := srv.Destinations(); dests[0].Depth != 0 || dests[0].Scheduled != 0 {
+		t.Error("Expected: purged scheduled message not delivered\nGot:", dests)
+	}
+}
+
+func Test_ScheduledInvalidHeader(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	conn, r := rawConnect(t, srv, "0,0")
+	go conn.Write([]byte("SEND\ndestination:/queue/a\nAMQ_SCHEDULED_DELAY:soon\n\nhi\x00"))
+
+	sf := readServerFrame(t, r)
+	if sf.Command != stomper.CmdError || !strings.Contains(string(sf.Body), "scheduling") {
+		t.Error("Expected: ERROR invalid header\nGot:", sf.String())
+	}
+}
+
+func Test_ScheduledSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	wal := openTestWAL(t, dir, SyncAlways)
+	srv := New(&Options{WAL: wal})
+	producer := connect(t, srv, nil)
+	producer.Send("/queue/a", []byte("due"), "r", "", stomper.Delay(400*time.Millisecond))
+	producer.Send("/queue/a", []byte("now"), "r", "")
+	srv.Close()
+	wal.Close()
+
+	wal = openTestWAL(t, dir, SyncAlways)
+	defer wal.Close()
+	srv = New(&Options{WAL: wal})
+	defer srv.Close()
+
+	frames := subscribe(t, connect(t, srv, nil), "/queue/a", stomper.AckModeAuto)
+	if sf := next(t, frames); string(sf.Payload()) != "now" {
+		t.Error("Expected: now\nGot:", sf.String())
+	}
+	nothing(t, frames)
+
+	sf := next(t, frames)
+	if string(sf.Payload()) != "due" {
+		t.Error("Expected: due\nGot:", sf.String())
+	}
+	if _, ok := sf.Headers[stomper.HeaderRedelivered]; ok {
+		t.Error("Expected: not redelivered\nGot:", sf.String())
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"testing"
+
+	"bytes"
+	"strings"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+func subscribeSelector(t *testing.T, srv *Server, dest, sel string) chan stomper.ServerFrame {
+	t.Helper()
+
+	client := connect(t, srv, nil)
+	_, resp, err := client.Subscribe(dest, "rcpt-sub", stomper.AckModeAuto, stomper.Selector(sel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(resp, []byte(stomper.CmdReceipt)) {
+		t.Fatal("Expected: RECEIPT\nGot:", string(resp))
+	}
+
+	frames, _ := client.ReceiveFrames()
+	return frames
+}
+
+func Test_SelectorQueue(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	producer := connect(t, srv, nil)
+	for _, region := range []string{"eu", "us", "eu", "apac", "us"} {
+		producer.Send("/queue/a", []byte(region), "r", "", stomper.Header{Key: "region", Value: region})
+	}
+
+	// Messages no subscriber matches do not hold up the rest.
+	us := subscribeSelector(t, srv, "/queue/a", "region = 'us'")
+	if got := receiveBodies(t, us, 2); got != "us us" {
+		t.Error("Expected: us us\nGot:", got)
+	}
+	nothing(t, us)
+
+	eu := subscribeSelector(t, srv, "/queue/a", "region IN ('eu', 'uk') OR message-id IS NULL")
+	if got := receiveBodies(t, eu, 2); got != "eu eu" {
+		t.Error("Expected: eu eu\nGot:", got)
+	}
+
+	if msgs, _ := srv.Browse("/queue/a", 0); len(msgs) != 1 || string(msgs[0].Body) != "apac" {
+		t.Error("Expected: apac left\nGot:", msgs)
+	}
+	listed := false
+	for _, c := range srv.Connections() {
+		for _, sub := range c.Subscriptions {
+			listed = listed || strings.HasPrefix(sub.Selector, "region IN")
+		}
+	}
+	if !listed {
+		t.Error("Expected: selector listed\nGot:", srv.Connections())
+	}
+}
+
+func Test_SelectorTopic(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	high := subscribeSelector(t, srv, "/topic/t", "priority >= 7 AND destination = '/topic/t'")
+	all := subscribe(t, connect(t, srv, nil), "/topic/t", stomper.AckModeAuto)
+
+	producer := connect(t, srv, nil)
+	producer.Send("/topic/t", []byte("low"), "", "", stomper.Priority(1))
+	producer.Send("/topic/t", []byte("high"), "", "", stomper.Priority(9))
+	producer.Send("/topic/t", []byte("none"), "", "")
+
+	if got := receiveBodies(t, high, 1); got != "high" {
+		t.Error("Expected: high\nGot:", got)
+	}
+	nothing(t, high)
+	if got := receiveBodies(t, all, 3); got != "low high none" {
+		t.Error("Expected: low high none\nGot:", got)
+	}
+}
+
+func Test_SelectorInvalid(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	conn, r := rawConnect(t, srv, "0,0")
+	go conn.Write([]byte("SUBSCRIBE\nid:0\ndestination:/queue/a\nselector:region = \n\n\x00"))
+
+	sf := readServerFrame(t, r)
+	if sf.Command != stomper.CmdError || string(sf.Headers[stomper.HeaderMessage]) != "invalid selector" {
+		t.Error("Expected: ERROR invalid selector\nGot:", sf.String())
+	}
+}
+
+func Test_SelectorUnmatchedHeldAside(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	us := subscribeSelector(t, srv, "/queue/a", "region = 'us'")
+
+	producer := connect(t, srv, nil)
+	for _, region := range []string{"eu", "apac", "eu", "us"} {
+		producer.Send("/queue/a", []byte(region), "r", "", stomper.Header{Key: "region", Value: region})
+	}
+	if got := receiveBodies(t, us, 1); got != "us" {
+		t.Error("Expected: us\nGot:", got)
+	}
+
+	// Unmatched messages are not matched again on each dispatch.
+	srv.mu.Lock()
+	d := srv.destinations["/queue/a"]
+	pending, unmatched := len(d.pending), len(d.unmatched)
+	srv.mu.Unlock()
+	if pending != 0 || unmatched != 3 {
+		t.Error("Expected: 0 pending, 3 unmatched\nGot:", pending, unmatched)
+	}
+	if dests := srv.Destinations(); dests[0].Depth != 3 {
+		t.Error("Expected: depth 3\nGot:", dests[0].Depth)
+	}
+	if msgs, _ := srv.Browse("/queue/a", 0); len(msgs) != 3 || string(msgs[1].Body) != "apac" {
+		t.Error("Expected: eu apac eu\nGot:", msgs)
+	}
+
+	eu := subscribeSelector(t, srv, "/queue/a", "region = 'eu'")
+	if got := receiveBodies(t, eu, 2); got != "eu eu" {
+		t.Error("Expected: eu eu\nGot:", got)
+	}
+
+	srv.mu.Lock()
+	unmatched = len(d.unmatched)
+	srv.mu.Unlock()
+	if unmatched != 1 {
+		t.Error("Expected: 1 unmatched\nGot:", unmatched)
+	}
+}
@@ -0,0 +1,245 @@
+// Package server is an in-process STOMP 1.2 broker, for unit tests and
+// small deployments.
+//
+// Destinations starting /topic/ fan each message out to every
+// subscriber.  All others are queues, whose messages go to one of their
+// subscribers in turn, and wait for a subscriber when there are none.
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultName        = "stompingophers"
+	DefaultMaxBodySize = 4 << 20
+	DefaultMaxOutbound = 1024
+
+	topicPrefix = "/topic/"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+type Options struct {
+	// Name is sent to clients in the server header.
+	Name string
+
+	// HeartBeat is the interval the server offers to send heart-beats
+	// at, and asks clients to send them at.  Zero is none.  A client
+	// silent for twice the negotiated interval is disconnected.
+	HeartBeat time.Duration
+
+	// MaxBodySize limits frame bodies, DefaultMaxBodySize if zero.
+	MaxBodySize int
+
+	// MaxOutbound is the number of frames queued to a connection, and not
+	// yet written, at which messages stop being delivered to it, until it
+	// catches up.  DefaultMaxOutbound if zero.  A connection whose queue
+	// still grows to twice that, or whose topic subscription falls that
+	// far behind, is closed.
+	MaxOutbound int
+
+	// Logger, if set, logs connections, and the errors sent to clients.
+	Logger *slog.Logger
+
+	// WAL, if set, persists queue messages until they are acked, and
+	// its recovered messages are queued again.  The WAL is not closed
+	// with the server.
+	WAL *WAL
+
+	// Authenticator, if set, checks the login and passcode of each
+	// connection, refusing those it does not authenticate.
+	Authenticator Authenticator
+
+	// ExpiryDestination, if set, is where queue messages which expire
+	// before they are delivered are moved, with the dead-letter headers
+	// of stompingophers.Retry.  Otherwise they are discarded.
+	ExpiryDestination string
+
+	// ExpirySweep is how often expired messages are swept from
+	// destinations, DefaultExpirySweep if zero.  Messages are checked
+	// before delivery regardless.
+	ExpirySweep time.Duration
+
+	// ACL, if set, authorizes sending to and subscribing to destinations.
+	// Connections are of their login's user when authenticated, and
+	// anonymous, the empty user, otherwise.
+	ACL *ACL
+
+	// InsecureAdmin serves the admin API to anyone, unauthenticated.
+	// Otherwise it denies every request unless there is both an
+	// Authenticator and an ACL, see AdminHandler.
+	InsecureAdmin bool
+}
+
+// Server is a STOMP broker.  Its zero value is not usable, see New.
+type Server struct {
+	options Options
+
+	mu           sync.Mutex
+	destinations map[string]*destination
+	conns        map[*conn]struct{}
+	listeners    map[net.Listener]struct{}
+	lastID       uint64
+	closed       bool
+
+	// scheduled messages, due when timer fires.
+	scheduled scheduleHeap
+	timer     *time.Timer
+	sweeper   *time.Timer
+
+	wg sync.WaitGroup
+}
+
+func New(options *Options) *Server {
+	s := &Server{
+		destinations: map[string]*destination{},
+		conns:        map[*conn]struct{}{},
+		listeners:    map[net.Listener]struct{}{},
+	}
+
+	if options != nil {
+		s.options = *options
+	}
+	if s.options.Name == "" {
+		s.options.Name = DefaultName
+	}
+	if s.options.MaxBodySize == 0 {
+		s.options.MaxBodySize = DefaultMaxBodySize
+	}
+	if s.options.MaxOutbound == 0 {
+		s.options.MaxOutbound = DefaultMaxOutbound
+	}
+	if s.options.ExpirySweep == 0 {
+		s.options.ExpirySweep = DefaultExpirySweep
+	}
+
+	if s.options.WAL != nil {
+		s.lastID = s.options.WAL.lastSequence()
+
+		now := time.Now()
+		for _, m := range s.options.WAL.recoveredMessages() {
+			m.persisted = true
+			m.derive()
+
+			if m.deliverAt.After(now) {
+				s.schedule(m)
+				continue
+			}
+
+			// It may have been delivered before the restart.
+			m.redelivered = true
+
+			s.destination(m.destination).insert(m)
+		}
+	}
+
+	s.sweeper = time.AfterFunc(s.options.ExpirySweep, s.sweep)
+
+	return s
+}
+
+// Serve accepts connections on ln, serving each in its own goroutine,
+// until ln fails or the server is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+	}()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go s.ServeConn(nc)
+	}
+}
+
+// ListenAndServe listens on the TCP address addr, and serves it.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.log(slog.LevelInfo, "stomp server listening", slog.String("addr", ln.Addr().String()))
+
+	return s.Serve(ln)
+}
+
+// ServeConn serves a single connection, returning when it is closed.
+func (s *Server) ServeConn(nc net.Conn) {
+	c := s.newConn(nc)
+	if c == nil {
+		nc.Close()
+		return
+	}
+	defer s.wg.Done()
+
+	c.serve()
+}
+
+// Pipe returns the client end of an in-memory connection to the server.
+func (s *Server) Pipe() net.Conn {
+	cliconn, srvconn := net.Pipe()
+	go s.ServeConn(srvconn)
+	return cliconn
+}
+
+// Close stops the server's listeners, and closes all its connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.sweeper.Stop()
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.netConn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return nil
+}
+
+func (s *Server) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	if s.options.Logger == nil {
+		return
+	}
+	s.options.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// newID returns a server unique identifier, with the given prefix.  The
+// server's lock must be held.
+func (s *Server) newID(prefix string) string {
+	s.lastID++
+	return prefix + strconv.FormatUint(s.lastID, 10)
+}
@@ -0,0 +1,567 @@
+package server
+
+import (
+	"testing"
+
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+func connect(t testing.TB, srv *Server, options *stomper.Options) *stomper.Client {
+	conn := srv.Pipe()
+	t.Cleanup(func() { conn.Close() })
+
+	client, _, err := stomper.Connect(conn, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &client
+}
+
+func subscribe(t testing.TB, client *stomper.Client, dest string, ackMode int) chan stomper.ServerFrame {
+	_, resp, err := client.Subscribe(dest, "rcpt-sub", ackMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(resp, []byte(stomper.CmdReceipt)) {
+		t.Fatal("Expected: RECEIPT\nGot:", string(resp))
+	}
+
+	frames, _ := client.ReceiveFrames()
+	return frames
+}
+
+func next(t *testing.T, frames chan stomper.ServerFrame) stomper.ServerFrame {
+	t.Helper()
+
+	select {
+	case sf := <-frames:
+		return sf
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a frame\nGot: nothing")
+	}
+	return stomper.ServerFrame{}
+}
+
+func nothing(t *testing.T, frames chan stomper.ServerFrame) {
+	t.Helper()
+
+	select {
+	case sf := <-frames:
+		t.Error("Expected: nothing\nGot:", sf.String())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_SendReceive(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	consumer := connect(t, srv, nil)
+	frames := subscribe(t, consumer, "/queue/a", stomper.AckModeAuto)
+
+	producer := connect(t, srv, nil)
+	_, err := producer.Send("/queue/a", []byte("hello\x00world"), "", "",
+		stomper.Header{Key: "colour", Value: "red:ish"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf := next(t, frames)
+	if sf.Command != stomper.CmdMessage || string(sf.Payload()) != "hello\x00world" {
+		t.Error("Expected: MESSAGE hello\\x00world\nGot:", sf.String())
+	}
+	if string(sf.Headers[stomper.HeaderDestination]) != "/queue/a" ||
+		string(sf.Headers[stomper.HeaderSubscription]) != "0" {
+		t.Error("Expected: destination and subscription headers\nGot:", sf.Headers)
+	}
+	if string(sf.Headers["colour"]) != "red:ish" {
+		t.Error("Expected: red:ish\nGot:", string(sf.Headers["colour"]))
+	}
+}
+
+func Test_QueueCompetingConsumers(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	frames1 := subscribe(t, connect(t, srv, nil), "/queue/work", stomper.AckModeAuto)
+	frames2 := subscribe(t, connect(t, srv, nil), "/queue/work", stomper.AckModeAuto)
+
+	producer := connect(t, srv, nil)
+	for i := 0; i < 4; i++ {
+		producer.Send("/queue/work", []byte("job"), "", "")
+	}
+
+	for _, frames := range []chan stomper.ServerFrame{frames1, frames2} {
+		next(t, frames)
+		next(t, frames)
+		nothing(t, frames)
+	}
+}
+
+func Test_TopicFanOut(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	producer := connect(t, srv, nil)
+	// Topic messages without subscribers are dropped.
+	producer.Send("/topic/news", []byte("early"), "", "")
+
+	frames1 := subscribe(t, connect(t, srv, nil), "/topic/news", stomper.AckModeAuto)
+	frames2 := subscribe(t, connect(t, srv, nil), "/topic/news", stomper.AckModeAuto)
+
+	producer.Send("/topic/news", []byte("extra"), "", "")
+
+	for _, frames := range []chan stomper.ServerFrame{frames1, frames2} {
+		if sf := next(t, frames); string(sf.Payload()) != "extra" {
+			t.Error("Expected: extra\nGot:", string(sf.Payload()))
+		}
+		nothing(t, frames)
+	}
+}
+
+func Test_TopicFanOutNotRedelivered(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	frames1 := subscribe(t, connect(t, srv, nil), "/topic/news", stomper.AckModeAuto)
+	frames2 := subscribe(t, connect(t, srv, nil), "/topic/news", stomper.AckModeClientIndividual)
+
+	connect(t, srv, nil).Send("/topic/news", []byte("extra"), "", "")
+
+	for _, frames := range []chan stomper.ServerFrame{frames1, frames2} {
+		if sf := next(t, frames); sf.Headers[stomper.HeaderRedelivered] != nil {
+			t.Error("Expected: not redelivered\nGot:", sf.Headers)
+		}
+	}
+}
+
+func Test_QueuePendingUntilSubscribed(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	producer := connect(t, srv, nil)
+	producer.Send("/queue/later", []byte("1"), "", "")
+	producer.Send("/queue/later", []byte("2"), "", "")
+
+	frames := subscribe(t, connect(t, srv, nil), "/queue/later", stomper.AckModeAuto)
+	for _, expected := range []string{"1", "2"} {
+		if sf := next(t, frames); string(sf.Payload()) != expected {
+			t.Error("Expected:", expected, "\nGot:", string(sf.Payload()))
+		}
+	}
+}
+
+func Test_UnackedRedeliveredOnDisconnect(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	conn1 := srv.Pipe()
+	c1, _, err := stomper.Connect(conn1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames1 := subscribe(t, &c1, "/queue/work", stomper.AckModeClientIndividual)
+
+	producer := connect(t, srv, nil)
+	producer.Send("/queue/work", []byte("job"), "", "")
+
+	sf := next(t, frames1)
+	if _, ok := sf.Headers[stomper.HeaderAck]; !ok {
+		t.Error("Expected: ack header\nGot:", sf.Headers)
+	}
+
+	frames2 := subscribe(t, connect(t, srv, nil), "/queue/work", stomper.AckModeAuto)
+	nothing(t, frames2)
+
+	conn1.Close()
+
+	sf = next(t, frames2)
+	if string(sf.Headers[stomper.HeaderRedelivered]) != "true" {
+		t.Error("Expected: redelivered\nGot:", sf.Headers)
+	}
+}
+
+func Test_NackRedelivers(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	consumer := connect(t, srv, nil)
+	frames := subscribe(t, consumer, "/queue/work", stomper.AckModeClientIndividual)
+
+	producer := connect(t, srv, nil)
+	producer.Send("/queue/work", []byte("job"), "", "")
+
+	sf := next(t, frames)
+	if err := consumer.Nack(string(sf.Headers[stomper.HeaderAck]), "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	sf = next(t, frames)
+	if string(sf.Headers[stomper.HeaderRedelivered]) != "true" {
+		t.Error("Expected: redelivered\nGot:", sf.Headers)
+	}
+	consumer.Ack(string(sf.Headers[stomper.HeaderAck]), "", "")
+	nothing(t, frames)
+}
+
+func Test_PrefetchAndCumulativeAck(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	consumer := connect(t, srv, nil)
+	_, _, err := consumer.SubscribeWindow("/queue/work", "", stomper.AckModeClient, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, _ := consumer.ReceiveFrames()
+
+	producer := connect(t, srv, nil)
+	for i := 0; i < 3; i++ {
+		producer.Send("/queue/work", []byte("job"), "", "")
+	}
+
+	next(t, frames)
+	second := next(t, frames)
+	nothing(t, frames)
+
+	// Acks both delivered messages.
+	consumer.Ack(string(second.Headers[stomper.HeaderAck]), "", "")
+
+	sf := next(t, frames)
+	if _, ok := sf.Headers[stomper.HeaderRedelivered]; ok {
+		t.Error("Expected: first delivery\nGot:", sf.Headers)
+	}
+}
+
+func Test_Transactions(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	frames := subscribe(t, connect(t, srv, nil), "/queue/tx", stomper.AckModeAuto)
+	producer := connect(t, srv, nil)
+
+	producer.BeginID("tx1", "")
+	producer.Send("/queue/tx", []byte("committed"), "", "tx1")
+	producer.BeginID("tx2", "")
+	producer.Send("/queue/tx", []byte("aborted"), "", "tx2")
+	nothing(t, frames)
+
+	producer.Abort("tx2", "")
+	producer.Commit("tx1", "")
+
+	if sf := next(t, frames); string(sf.Payload()) != "committed" {
+		t.Error("Expected: committed\nGot:", string(sf.Payload()))
+	}
+	nothing(t, frames)
+}
+
+func Test_TransactionInvalidFrame(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	conn, r := rawConnect(t, srv, "0,0")
+	conn.Write([]byte("SUBSCRIBE\nid:0\ndestination:/queue/a\nack:client\n\n\x00"))
+	connect(t, srv, nil).Send("/queue/a", []byte("first"), "r", "")
+	msg := readServerFrame(t, r)
+	ack := string(msg.Headers[stomper.HeaderAck])
+
+	go conn.Write([]byte("BEGIN\ntransaction:t\n\n\x00" +
+		"ACK\nid:" + ack + "\ntransaction:t\n\n\x00" +
+		"SEND\ndestination:/queue/b\ntransaction:t\n\nsent\x00" +
+		"SEND\ndestination:/queue/b\npriority:high\ntransaction:t\n\nbad\x00" +
+		"COMMIT\ntransaction:t\n\n\x00"))
+
+	sf := readServerFrame(t, r)
+	if sf.Command != stomper.CmdError || string(sf.Headers[stomper.HeaderMessage]) != "invalid header" {
+		t.Error("Expected: ERROR invalid header\nGot:", sf.String())
+	}
+
+	// The connection is closed, returning its unacked message.
+	deadline := time.Now().Add(2 * time.Second)
+	for len(srv.Connections()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, d := range srv.Destinations() {
+		if d.Name == "/queue/a" && d.Depth != 1 {
+			t.Error("Expected: /queue/a unacked\nGot:", d)
+		}
+		if d.Name == "/queue/b" && d.Depth != 0 {
+			t.Error("Expected: nothing sent to /queue/b\nGot:", d)
+		}
+	}
+}
+
+func Test_ReceiptAndDisconnect(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	client := connect(t, srv, nil)
+
+	resp, err := client.Send("/queue/a", []byte("x"), "rcpt-1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, err := stomper.ParseResponse(resp)
+	if err != nil || sf.Command != stomper.CmdReceipt || string(sf.Headers[stomper.HeaderReceiptID]) != "rcpt-1" {
+		t.Error("Expected: RECEIPT rcpt-1\nGot:", string(resp))
+	}
+
+	if err := client.Disconnect(); err != nil {
+		t.Error("Expected: nil\nGot:", err)
+	}
+}
+
+// rawConnect connects without the client, returning a reader of the
+// server's frames.
+func rawConnect(t *testing.T, srv *Server, heartBeat string) (net.Conn, *bufio.Reader) {
+	conn := srv.Pipe()
+	t.Cleanup(func() { conn.Close() })
+
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("CONNECT\naccept-version:1.2\nheart-beat:" + heartBeat + "\n\n\x00"))
+
+	sf := readServerFrame(t, r)
+	if sf.Command != stomper.CmdConnected || string(sf.Headers[stomper.HeaderVersion]) != "1.2" {
+		t.Fatal("Expected: CONNECTED 1.2\nGot:", sf.String())
+	}
+
+	return conn, r
+}
+
+func readServerFrame(t *testing.T, r *bufio.Reader) stomper.ServerFrame {
+	t.Helper()
+
+	for {
+		sf, err := readFrame(r, DefaultMaxBodySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sf.Command != "" {
+			return sf
+		}
+	}
+}
+
+func Test_Errors(t *testing.T) {
+	srv := New(nil)
+	defer srv.Close()
+
+	conn := srv.Pipe()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	go conn.Write([]byte("SEND\ndestination:/queue/a\n\nhi\x00"))
+	sf := readServerFrame(t, r)
+	if sf.Command != stomper.CmdError || string(sf.Headers[stomper.HeaderMessage]) != "not connected" {
+		t.Error("Expected: ERROR not connected\nGot:", sf.String())
+	}
+
+	conn, r = rawConnect(t, srv, "0,0")
+	go conn.Write([]byte("SEND\nreceipt:r-1\n\nhi\x00"))
+	sf = readServerFrame(t, r)
+	if sf.Command != stomper.CmdError || string(sf.Headers[stomper.HeaderReceiptID]) != "r-1" ||
+		!strings.Contains(string(sf.Body), "destination") {
+		t.Error("Expected: ERROR with receipt-id\nGot:", sf.String())
+	}
+	for {
+		sf, err := readFrame(r, DefaultMaxBodySize)
+		if err != nil {
+			break
+		}
+		if sf.Command != "" {
+			t.Error("Expected: connection closed after ERROR\nGot:", sf.String())
+		}
+	}
+}
+
+func Test_HeartBeats(t *testing.T) {
+	srv := New(&Options{HeartBeat: 20 * time.Millisecond})
+	defer srv.Close()
+
+	conn, r := rawConnect(t, srv, "20,20")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := r.ReadByte()
+	if err != nil || b != '\n' {
+		t.Fatal("Expected: heart-beat\nGot:", b, err)
+	}
+
+	// Silent clients are disconnected.
+	for {
+		_, err := r.ReadByte()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("Expected: silent client disconnected\nGot:", err)
+			}
+			break
+		}
+	}
+}
+
+func Test_Serve(t *testing.T) {
+	srv := New(nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, resp, err := stomper.Connect(conn, nil)
+	if err != nil || !bytes.HasPrefix(resp, []byte(stomper.CmdConnected)) {
+		t.Fatal("Expected: CONNECTED\nGot:", string(resp), err)
+	}
+
+	srv.Close()
+	if err := <-served; err != ErrServerClosed {
+		t.Error("Expected:", ErrServerClosed, "\nGot:", err)
+	}
+}
+
+func Test_readFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(
+		"\n\r\nSEND\r\nk\\c1:v\\n\\\\\nk\\c1:second\ncontent-length:3\n\na\x00b\x00\n" +
+			"CONNECT\nlogin:a\\cb\n\n\x00"))
+
+	sf := readServerFrame(t, r)
+	if sf.Command != stomper.CmdSend || string(sf.Headers["k:1"]) != "v\n\\" || string(sf.Body) != "a\x00b" {
+		t.Error("Expected: SEND with unescaped header\nGot:", sf.String())
+	}
+
+	sf = readServerFrame(t, r)
+	if string(sf.Headers["login"]) != `a\cb` {
+		t.Error("Expected: CONNECT headers not unescaped\nGot:", sf.Headers)
+	}
+
+	r = bufio.NewReader(strings.NewReader("SEND\ncontent-length:100\n\nx\x00"))
+	if _, err := readFrame(r, 10); err != errBodyTooLarge {
+		t.Error("Expected:", errBodyTooLarge, "\nGot:", err)
+	}
+}
+
+func Benchmark_Connect(b *testing.B) {
+	b.ReportAllocs()
+
+	srv := New(nil)
+	defer srv.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client := connect(b, srv, nil)
+		if err := client.Disconnect(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_Subscribe(b *testing.B) {
+	b.ReportAllocs()
+
+	srv := New(nil)
+	defer srv.Close()
+
+	client := connect(b, srv, nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := client.Subscribe("/queue/nooq", "mysubrcpt", stomper.AckModeAuto)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_SendReceive(b *testing.B) {
+	b.ReportAllocs()
+
+	srv := New(nil)
+	defer srv.Close()
+
+	frames := subscribe(b, connect(b, srv, nil), "/queue/nooq", stomper.AckModeAuto)
+	producer := connect(b, srv, nil)
+	body := []byte("Well, hello, number 16790!")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := producer.Send("/queue/nooq", body, "", ""); err != nil {
+			b.Fatal(err)
+		}
+		<-frames
+	}
+}
+
+func Test_SlowAutoConsumerBackpressure(t *testing.T) {
+	srv := New(&Options{MaxOutbound: 4})
+	defer srv.Close()
+
+	conn, r := rawConnect(t, srv, "0,0")
+	conn.Write([]byte("SUBSCRIBE\nid:0\ndestination:/queue/work\n\n\x00"))
+
+	producer := connect(t, srv, nil)
+	for i := 0; i < 100; i++ {
+		if _, err := producer.Send("/queue/work", []byte(strconv.Itoa(i)), "r", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The consumer is not reading, so most messages wait in the queue.
+	infos := srv.Destinations()
+	if len(infos) != 1 || infos[0].Depth < 100-2*4 {
+		t.Error("Expected: most of 100 messages queued\nGot:", infos)
+	}
+
+	for i := 0; i < 100; i++ {
+		sf := readServerFrame(t, r)
+		if string(sf.Body) != strconv.Itoa(i) {
+			t.Fatal("Expected:", i, "\nGot:", sf.String())
+		}
+	}
+}
+
+func Test_SlowTopicConsumerClosed(t *testing.T) {
+	srv := New(&Options{MaxOutbound: 4})
+	defer srv.Close()
+
+	conn, r := rawConnect(t, srv, "0,0")
+	conn.Write([]byte("SUBSCRIBE\nid:0\ndestination:/topic/news\nreceipt:s\n\n\x00"))
+	if sf := readServerFrame(t, r); sf.Command != stomper.CmdReceipt {
+		t.Fatal("Expected: RECEIPT\nGot:", sf.String())
+	}
+
+	producer := connect(t, srv, nil)
+	for i := 0; i < 20; i++ {
+		if _, err := producer.Send("/topic/news", []byte(strconv.Itoa(i)), "r", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Closed, losing the frames queued to it.
+	for {
+		if _, err := readFrame(r, DefaultMaxBodySize); err != nil {
+			break
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(srv.Connections()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(srv.Connections()); n != 1 {
+		t.Error("Expected: the producer's connection only\nGot:", n)
+	}
+}
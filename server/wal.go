@@ -0,0 +1,806 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy is when the WAL is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the records of each frame before it is receipted,
+	// so no acknowledged frame is lost on a crash.  Frames of concurrent
+	// connections share syncs.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval syncs every WALOptions.SyncEvery, losing at most that
+	// interval's records on a crash of the machine.
+	SyncInterval
+	// SyncNever leaves syncing to the operating system.
+	SyncNever
+)
+
+const (
+	DefaultSegmentSize = 64 << 20
+	DefaultSyncEvery   = time.Second
+
+	segmentExt   = ".wal"
+	tmpExt       = ".tmp"
+	compactedExt = ".compacted"
+
+	recordMessage   byte = 1
+	recordTombstone byte = 2
+
+	// recordHeaderSize is the length and checksum preceding each record.
+	recordHeaderSize = 8
+	maxRecordSize    = 1 << 30
+)
+
+var (
+	ErrWALClosed  = errors.New("wal closed")
+	errBadRecord  = errors.New("wal record corrupt")
+	castagnoliCRC = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type WALOptions struct {
+	// Dir holds the WAL's segment files, and is created if need be.
+	Dir string
+
+	// SegmentSize is the size a segment grows to before a new one is
+	// started, DefaultSegmentSize if zero.
+	SegmentSize int64
+
+	Sync SyncPolicy
+	// SyncEvery is the interval of SyncInterval, DefaultSyncEvery if
+	// zero.
+	SyncEvery time.Duration
+}
+
+// WAL is an append-only, segmented, write-ahead log of queue messages.
+// A message is logged when it is sent, and a tombstone when it is acked,
+// so on reopening the messages sent but not acked are recovered.
+//
+// Sealed segments are compacted, rewriting their live messages, once
+// most of their messages are acked.
+type WAL struct {
+	options WALOptions
+
+	mu       sync.Mutex
+	segments []*segment
+	file     *os.File
+	size     int64
+	closed   bool
+	// failed is set when a torn record could not be truncated, and fails
+	// every later write.
+	failed error
+
+	// written counts the records written, and synced those known to be
+	// synced.  syncMu serializes commits' syncs.
+	written uint64
+	synced  uint64
+	syncMu  sync.Mutex
+
+	// live maps the seq of each unacked message to its segment.
+	live      map[uint64]*segment
+	recovered []*message
+	// lastSeq is the highest seq logged, by a message or a tombstone.
+	lastSeq uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type segment struct {
+	n        int
+	messages int
+	live     int
+}
+
+func (w *WAL) path(n int, ext string) string {
+	return filepath.Join(w.options.Dir, fmt.Sprintf("%016d", n)+ext)
+}
+
+// OpenWAL opens the WAL in options.Dir, recovering its unacked messages.
+// A record torn by a crash, at the end of the last segment, is discarded.
+func OpenWAL(options WALOptions) (*WAL, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = DefaultSegmentSize
+	}
+	if options.SyncEvery <= 0 {
+		options.SyncEvery = DefaultSyncEvery
+	}
+
+	if err := os.MkdirAll(options.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed creating wal dir: %s", err)
+	}
+
+	w := &WAL{
+		options: options,
+		live:    map[uint64]*segment{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := w.finishCompaction(); err != nil {
+		return nil, err
+	}
+
+	nums, err := w.segmentNumbers()
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := map[uint64]*message{}
+	for i, n := range nums {
+		seg := &segment{n: n}
+		w.segments = append(w.segments, seg)
+
+		last := i == len(nums)-1
+		if err := w.replay(seg, msgs, last); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(w.segments) == 0 {
+		if err := w.newSegment(1); err != nil {
+			return nil, err
+		}
+	} else {
+		active := w.segments[len(w.segments)-1]
+		f, err := os.OpenFile(w.path(active.n, segmentExt), os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed opening wal segment: %s", err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed opening wal segment: %s", err)
+		}
+		w.file = f
+		w.size = fi.Size()
+	}
+
+	for _, m := range msgs {
+		w.recovered = append(w.recovered, m)
+	}
+	sort.Slice(w.recovered, func(i, j int) bool { return w.recovered[i].seq < w.recovered[j].seq })
+
+	if options.Sync == SyncInterval {
+		go w.syncLoop()
+	} else {
+		close(w.done)
+	}
+
+	return w, nil
+}
+
+// finishCompaction completes, or discards, a compaction interrupted by a
+// crash.  A compacted segment is only renamed into place once written
+// and synced, so when one exists it replaces every segment up to its
+// number.
+func (w *WAL) finishCompaction() error {
+	entries, err := os.ReadDir(w.options.Dir)
+	if err != nil {
+		return fmt.Errorf("failed reading wal dir: %s", err)
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasSuffix(name, tmpExt):
+			os.Remove(filepath.Join(w.options.Dir, name))
+
+		case strings.HasSuffix(name, compactedExt):
+			n, err := strconv.Atoi(strings.TrimSuffix(name, compactedExt))
+			if err != nil {
+				continue
+			}
+
+			nums, err := w.segmentNumbers()
+			if err != nil {
+				return err
+			}
+			for _, old := range nums {
+				if old <= n {
+					if err := os.Remove(w.path(old, segmentExt)); err != nil {
+						return fmt.Errorf("failed removing compacted wal segment: %s", err)
+					}
+				}
+			}
+			if err := os.Rename(w.path(n, compactedExt), w.path(n, segmentExt)); err != nil {
+				return fmt.Errorf("failed renaming compacted wal segment: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (w *WAL) segmentNumbers() ([]int, error) {
+	entries, err := os.ReadDir(w.options.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading wal dir: %s", err)
+	}
+
+	var nums []int
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), segmentExt) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), segmentExt))
+		if err == nil {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+
+	return nums, nil
+}
+
+// replay reads a segment's records into msgs.  In the last segment, a
+// torn or corrupt record ends the log, and is truncated.
+func (w *WAL) replay(seg *segment, msgs map[uint64]*message, last bool) error {
+	path := w.path(seg.n, segmentExt)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed opening wal segment: %s", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+
+	for {
+		typ, payload, n, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = w.apply(seg, typ, payload, msgs)
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("failed reading wal segment %s: %s", path, err)
+			}
+			if err := os.Truncate(path, offset); err != nil {
+				return fmt.Errorf("failed truncating torn wal record: %s", err)
+			}
+			return nil
+		}
+		offset += n
+	}
+}
+
+func (w *WAL) apply(seg *segment, typ byte, payload []byte, msgs map[uint64]*message) error {
+	switch typ {
+	case recordMessage:
+		m, err := decodeMessage(payload)
+		if err != nil {
+			return err
+		}
+		seg.messages++
+		seg.live++
+		msgs[m.seq] = m
+		w.live[m.seq] = seg
+		w.lastSeq = max(w.lastSeq, m.seq)
+
+	case recordTombstone:
+		seq, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return errBadRecord
+		}
+		delete(msgs, seq)
+		if s, ok := w.live[seq]; ok {
+			s.live--
+			delete(w.live, seq)
+		}
+		w.lastSeq = max(w.lastSeq, seq)
+
+	default:
+		return errBadRecord
+	}
+
+	return nil
+}
+
+// recoveredMessages returns the unacked messages found on opening, oldest
+// first.
+func (w *WAL) recoveredMessages() []*message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.recovered
+}
+
+// lastSequence returns the highest seq logged, acked or not, so seqs are
+// not reused after reopening.
+func (w *WAL) lastSequence() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.lastSeq
+}
+
+// appendMessage logs a message, which must have its seq set.
+func (w *WAL) appendMessage(m *message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.write(recordMessage, encodeMessage(m)); err != nil {
+		return err
+	}
+
+	seg := w.segments[len(w.segments)-1]
+	seg.messages++
+	seg.live++
+	w.live[m.seq] = seg
+	w.lastSeq = max(w.lastSeq, m.seq)
+
+	return w.maybeRotate()
+}
+
+// appendTombstone logs that the message with seq was acked.
+func (w *WAL) appendTombstone(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.write(recordTombstone, binary.AppendUvarint(nil, seq)); err != nil {
+		return err
+	}
+
+	if seg, ok := w.live[seq]; ok {
+		seg.live--
+		delete(w.live, seq)
+	}
+	w.lastSeq = max(w.lastSeq, seq)
+
+	return w.maybeRotate()
+}
+
+func (w *WAL) write(typ byte, payload []byte) error {
+	if w.closed {
+		return ErrWALClosed
+	}
+	if w.failed != nil {
+		return w.failed
+	}
+
+	b := appendRecord(nil, typ, payload)
+	if _, err := w.file.Write(b); err != nil {
+		// A partly written record would end the log on replay, losing
+		// the records written after it, so it is cut off.
+		if terr := w.file.Truncate(w.size); terr != nil {
+			w.failed = fmt.Errorf("failed truncating torn wal record: %s", terr)
+		}
+		return fmt.Errorf("failed writing wal record: %s", err)
+	}
+	w.size += int64(len(b))
+	w.written++
+
+	return nil
+}
+
+// sync syncs the active segment.  The WAL's lock must be held.
+func (w *WAL) sync() error {
+	if w.synced == w.written {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed syncing wal: %s", err)
+	}
+	w.synced = w.written
+	return nil
+}
+
+// commit syncs the records written so far, under SyncAlways.  The sync is
+// made without holding the WAL's lock, so records may be written
+// meanwhile, and is shared with concurrent commits, which wait for it.
+func (w *WAL) commit() error {
+	if w.options.Sync != SyncAlways {
+		return nil
+	}
+
+	w.mu.Lock()
+	target := w.written
+	w.mu.Unlock()
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	w.mu.Lock()
+	if w.synced >= target || w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	f, written := w.file, w.written
+	w.mu.Unlock()
+
+	err := f.Sync()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// A rotation syncs, and closes, the segment being synced.
+	if w.synced >= target {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed syncing wal: %s", err)
+	}
+	w.synced = max(w.synced, written)
+
+	return nil
+}
+
+func (w *WAL) syncLoop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.options.SyncEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		if !w.closed {
+			w.sync()
+		}
+		w.mu.Unlock()
+	}
+}
+
+// maybeRotate starts a new segment once the active one is full, then
+// compacts the sealed segments if most of their messages are acked.
+func (w *WAL) maybeRotate() error {
+	if w.size < w.options.SegmentSize {
+		return nil
+	}
+
+	if err := w.sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed closing wal segment: %s", err)
+	}
+
+	if err := w.newSegment(w.segments[len(w.segments)-1].n + 1); err != nil {
+		return err
+	}
+
+	total, live := 0, 0
+	for _, seg := range w.segments[:len(w.segments)-1] {
+		total += seg.messages
+		live += seg.live
+	}
+	if live*2 <= total {
+		return w.compact()
+	}
+
+	return nil
+}
+
+func (w *WAL) newSegment(n int) error {
+	f, err := os.OpenFile(w.path(n, segmentExt), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed creating wal segment: %s", err)
+	}
+	if err := syncDir(w.options.Dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = 0
+	w.segments = append(w.segments, &segment{n: n})
+
+	return nil
+}
+
+// Compact rewrites the sealed segments as one, holding only their
+// unacked messages.
+func (w *WAL) Compact() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
+
+	return w.compact()
+}
+
+func (w *WAL) compact() error {
+	sealed := w.segments[:len(w.segments)-1]
+	if len(sealed) == 0 {
+		return nil
+	}
+	n := sealed[len(sealed)-1].n
+
+	tmp := w.path(n, tmpExt)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed creating compacted wal segment: %s", err)
+	}
+	bw := bufio.NewWriter(f)
+
+	compacted := &segment{n: n}
+	moved := map[uint64]bool{}
+
+	// The last seq is kept, by a tombstone, in case every message it
+	// replaces was acked.
+	bw.Write(appendRecord(nil, recordTombstone, binary.AppendUvarint(nil, w.lastSeq)))
+
+	for _, seg := range sealed {
+		if seg.live == 0 {
+			continue
+		}
+		err := w.each(seg, func(typ byte, payload []byte) error {
+			if typ != recordMessage {
+				return nil
+			}
+			m, err := decodeMessage(payload)
+			if err != nil {
+				return err
+			}
+			if w.live[m.seq] != seg {
+				return nil
+			}
+			moved[m.seq] = true
+			compacted.messages++
+			_, err = bw.Write(appendRecord(nil, typ, payload))
+			return err
+		})
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("failed compacting wal: %s", err)
+		}
+	}
+
+	if err := bw.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed writing compacted wal segment: %s", err)
+	}
+
+	// The rename is the commit point, see finishCompaction.
+	if err := os.Rename(tmp, w.path(n, compactedExt)); err != nil {
+		return fmt.Errorf("failed renaming compacted wal segment: %s", err)
+	}
+	if err := syncDir(w.options.Dir); err != nil {
+		return err
+	}
+	if err := w.finishCompaction(); err != nil {
+		return err
+	}
+	if err := syncDir(w.options.Dir); err != nil {
+		return err
+	}
+
+	compacted.live = compacted.messages
+	for seq := range moved {
+		w.live[seq] = compacted
+	}
+	w.segments = append([]*segment{compacted}, w.segments[len(sealed):]...)
+
+	return nil
+}
+
+// each calls fn with each record of a sealed segment.
+func (w *WAL) each(seg *segment, fn func(typ byte, payload []byte) error) error {
+	f, err := os.Open(w.path(seg.n, segmentExt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		typ, payload, _, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(typ, payload); err != nil {
+			return err
+		}
+	}
+}
+
+// Segments returns the number of segment files.
+func (w *WAL) Segments() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.segments)
+}
+
+// Close syncs and closes the WAL.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	err := w.sync()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.mu.Unlock()
+
+	if w.options.Sync == SyncInterval {
+		close(w.stop)
+	}
+	<-w.done
+
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed syncing wal dir: %s", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed syncing wal dir: %s", err)
+	}
+	return nil
+}
+
+// appendRecord appends a record: its payload's length and CRC-32C, then
+// the record type and payload.
+func appendRecord(b []byte, typ byte, payload []byte) []byte {
+	crc := crc32.Update(crc32.Checksum([]byte{typ}, castagnoliCRC), castagnoliCRC, payload)
+
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)+1))
+	b = binary.BigEndian.AppendUint32(b, crc)
+	b = append(b, typ)
+	return append(b, payload...)
+}
+
+// readRecord reads a record, returning its type, payload and size.  An
+// end of file at a record boundary is io.EOF, any other short or corrupt
+// record is an error.
+func readRecord(r *bufio.Reader) (byte, []byte, int64, error) {
+	var h [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, 0, io.EOF
+		}
+		return 0, nil, 0, errBadRecord
+	}
+
+	size := binary.BigEndian.Uint32(h[:4])
+	if size == 0 || size > maxRecordSize {
+		return 0, nil, 0, errBadRecord
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, 0, errBadRecord
+	}
+	if crc32.Checksum(b, castagnoliCRC) != binary.BigEndian.Uint32(h[4:]) {
+		return 0, nil, 0, errBadRecord
+	}
+
+	return b[0], b[1:], int64(recordHeaderSize) + int64(size), nil
+}
+
+func encodeMessage(m *message) []byte {
+	b := binary.AppendUvarint(nil, m.seq)
+	b = appendBytes(b, []byte(m.destination))
+
+	keys := make([]string, 0, len(m.headers))
+	for k := range m.headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b = binary.AppendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendBytes(b, []byte(k))
+		b = appendBytes(b, m.headers[k])
+	}
+
+	b = appendBytes(b, m.body)
+
+	// Scheduled messages end with when they are due.
+	if !m.deliverAt.IsZero() {
+		b = binary.AppendUvarint(b, uint64(m.deliverAt.UnixMilli()))
+	}
+
+	return b
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func decodeMessage(b []byte) (*message, error) {
+	d := decoder{b: b}
+
+	m := &message{seq: d.uvarint()}
+	m.id = messageID(m.seq)
+	m.destination = string(d.bytes())
+
+	n := d.uvarint()
+	if n > uint64(len(b)) {
+		return nil, errBadRecord
+	}
+	m.headers = make(map[string][]byte, n)
+	for i := uint64(0); i < n; i++ {
+		k := string(d.bytes())
+		m.headers[k] = d.bytes()
+	}
+	m.body = d.bytes()
+	if len(d.b) > 0 {
+		m.deliverAt = time.UnixMilli(int64(d.uvarint()))
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return m, nil
+}
+
+// decoder reads uvarints and length prefixed bytes, recording the first
+// error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errBadRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)) {
+		d.err = errBadRecord
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"testing"
+
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	stomper "github.com/russmack/stompingophers"
+)
+
+func openTestWAL(t *testing.T, dir string, sync SyncPolicy) *WAL {
+	t.Helper()
+
+	wal, err := OpenWAL(WALOptions{Dir: dir, SegmentSize: 512, Sync: sync})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wal
+}
+
+func testWALMessage(seq uint64) *message {
+	return &message{
+		seq:         seq,
+		id:          messageID(seq),
+		destination: "/queue/work",
+		headers:     map[string][]byte{"k": []byte("v:" + strconv.FormatUint(seq, 10))},
+		body:        []byte("body " + strconv.FormatUint(seq, 10)),
+	}
+}
+
+// lastSegment returns the path of the WAL's active segment.
+func lastSegment(t *testing.T, wal *WAL) string {
+	nums, err := wal.segmentNumbers()
+	if err != nil || len(nums) == 0 {
+		t.Fatal("Expected segments, got:", nums, err)
+	}
+	return wal.path(nums[len(nums)-1], segmentExt)
+}
+
+func Test_WALKillAndRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	wal1 := openTestWAL(t, dir, SyncAlways)
+	srv1 := New(&Options{WAL: wal1})
+
+	producer := connect(t, srv1, nil)
+	for i := 0; i < 20; i++ {
+		if _, err := producer.Send("/queue/work", []byte(strconv.Itoa(i)), "r", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, r := rawConnect(t, srv1, "0,0")
+	conn.Write([]byte("SUBSCRIBE\nid:0\ndestination:/queue/work\nack:client-individual\n\n\x00"))
+
+	var ackIDs []string
+	for i := 0; i < 20; i++ {
+		sf := readServerFrame(t, r)
+		if string(sf.Body) != strconv.Itoa(i) {
+			t.Fatal("Expected:", i, "\nGot:", sf.String())
+		}
+		ackIDs = append(ackIDs, string(sf.Headers[stomper.HeaderAck]))
+	}
+
+	// The first 8 are acked, the rest were delivered but not acked.
+	for i, id := range ackIDs[:8] {
+		receipt := ""
+		if i == 7 {
+			receipt = "receipt:acked\n"
+		}
+		conn.Write([]byte("ACK\nid:" + id + "\n" + receipt + "\n\x00"))
+	}
+	if sf := readServerFrame(t, r); sf.Command != stomper.CmdReceipt {
+		t.Fatal("Expected: RECEIPT\nGot:", sf.String())
+	}
+
+	// Killed, without closing the WAL, mid-way through writing a record.
+	srv1.Close()
+	f, err := os.OpenFile(lastSegment(t, wal1), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 40, 1, 2})
+	f.Close()
+
+	wal2 := openTestWAL(t, dir, SyncAlways)
+	defer wal2.Close()
+	srv2 := New(&Options{WAL: wal2})
+	defer srv2.Close()
+
+	frames := subscribe(t, connect(t, srv2, nil), "/queue/work", stomper.AckModeAuto)
+	for i := 8; i < 20; i++ {
+		sf := next(t, frames)
+		if string(sf.Payload()) != strconv.Itoa(i) {
+			t.Error("Expected:", i, "\nGot:", string(sf.Payload()))
+		}
+		if string(sf.Headers[stomper.HeaderRedelivered]) != "true" {
+			t.Error("Expected: redelivered\nGot:", sf.Headers)
+		}
+	}
+	nothing(t, frames)
+
+	// New message ids do not reuse recovered ones.
+	producer = connect(t, srv2, nil)
+	producer.Send("/queue/work", []byte("new"), "", "")
+	sf := next(t, frames)
+	seq, err := strconv.Atoi(strings.TrimPrefix(string(sf.Headers[stomper.HeaderMessageID]), "msg-"))
+	if err != nil || seq <= 20 {
+		t.Error("Expected: a message id after msg-20\nGot:", string(sf.Headers[stomper.HeaderMessageID]))
+	}
+}
+
+func Test_WALTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	wal := openTestWAL(t, dir, SyncNever)
+	wal.appendMessage(testWALMessage(1))
+	wal.appendMessage(testWALMessage(2))
+	wal.Close()
+
+	path := lastSegment(t, wal)
+	fi, _ := os.Stat(path)
+	size := fi.Size()
+
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	f.Write(appendRecord(nil, recordMessage, encodeMessage(testWALMessage(3)))[:20])
+	f.Close()
+
+	wal = openTestWAL(t, dir, SyncNever)
+	if fi, _ := os.Stat(path); fi.Size() != size {
+		t.Error("Expected torn record truncated to:", size, "\nGot:", fi.Size())
+	}
+	if n := len(wal.recoveredMessages()); n != 2 {
+		t.Error("Expected: 2\nGot:", n)
+	}
+
+	wal.appendMessage(testWALMessage(4))
+	wal.Close()
+
+	wal = openTestWAL(t, dir, SyncNever)
+	defer wal.Close()
+
+	msgs := wal.recoveredMessages()
+	if len(msgs) != 3 || msgs[2].seq != 4 || string(msgs[2].headers["k"]) != "v:4" || string(msgs[2].body) != "body 4" {
+		t.Error("Expected: messages 1, 2 and 4\nGot:", msgs)
+	}
+}
+
+func Test_WALCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	wal, err := OpenWAL(WALOptions{Dir: dir, SegmentSize: 512, Sync: SyncInterval, SyncEvery: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for seq := uint64(1); seq <= 100; seq++ {
+		if err := wal.appendMessage(testWALMessage(seq)); err != nil {
+			t.Fatal(err)
+		}
+		// All but every 25th are acked.
+		if seq%25 != 0 {
+			if err := wal.appendTombstone(seq); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := wal.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := wal.Segments(); n != 2 {
+		t.Error("Expected: 2 segments after compaction\nGot:", n)
+	}
+	wal.Close()
+
+	// An interrupted compaction's temporary file is discarded.
+	os.WriteFile(filepath.Join(dir, "0000000000000099"+tmpExt), []byte("partial"), 0o644)
+
+	wal = openTestWAL(t, dir, SyncAlways)
+	defer wal.Close()
+
+	msgs := wal.recoveredMessages()
+	if len(msgs) != 4 {
+		t.Fatal("Expected: 4 messages\nGot:", len(msgs))
+	}
+	for i, m := range msgs {
+		if m.seq != uint64(i+1)*25 {
+			t.Error("Expected:", (i+1)*25, "\nGot:", m.seq)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "0000000000000099"+tmpExt)); !os.IsNotExist(err) {
+		t.Error("Expected temporary file removed, got:", err)
+	}
+}
+
+func Test_WALInterruptedCompactionCommitted(t *testing.T) {
+	dir := t.TempDir()
+
+	wal := openTestWAL(t, dir, SyncNever)
+	for seq := uint64(1); seq <= 3; seq++ {
+		wal.appendMessage(testWALMessage(seq))
+	}
+	wal.appendTombstone(2)
+	wal.Close()
+
+	// A compacted segment renamed into place, before the segments it
+	// replaces were removed.
+	b := appendRecord(nil, recordMessage, encodeMessage(testWALMessage(1)))
+	b = appendRecord(b, recordMessage, encodeMessage(testWALMessage(3)))
+	os.WriteFile(filepath.Join(dir, "0000000000000001"+compactedExt), b, 0o644)
+
+	wal = openTestWAL(t, dir, SyncNever)
+	defer wal.Close()
+
+	msgs := wal.recoveredMessages()
+	if len(msgs) != 2 || msgs[0].seq != 1 || msgs[1].seq != 3 {
+		t.Error("Expected: messages 1 and 3\nGot:", msgs)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "0000000000000001"+compactedExt)); !os.IsNotExist(err) {
+		t.Error("Expected compacted segment renamed, got:", err)
+	}
+}
+
+func Test_WALIDsNotReusedAfterAllAcked(t *testing.T) {
+	dir := t.TempDir()
+
+	wal1 := openTestWAL(t, dir, SyncAlways)
+	srv1 := New(&Options{WAL: wal1})
+
+	frames := subscribe(t, connect(t, srv1, nil), "/queue/work", stomper.AckModeAuto)
+	producer := connect(t, srv1, nil)
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		producer.Send("/queue/work", []byte(strconv.Itoa(i)), "", "")
+		seen[string(next(t, frames).Headers[stomper.HeaderMessageID])] = true
+	}
+	srv1.Close()
+	wal1.Close()
+
+	wal2 := openTestWAL(t, dir, SyncAlways)
+	defer wal2.Close()
+	srv2 := New(&Options{WAL: wal2})
+	defer srv2.Close()
+
+	frames = subscribe(t, connect(t, srv2, nil), "/queue/work", stomper.AckModeAuto)
+	producer = connect(t, srv2, nil)
+	for i := 0; i < 3; i++ {
+		producer.Send("/queue/work", []byte(strconv.Itoa(i)), "", "")
+		id := string(next(t, frames).Headers[stomper.HeaderMessageID])
+		if seen[id] {
+			t.Error("Expected: a new message id\nGot:", id)
+		}
+	}
+}
+
+func Test_WALCompactionKeepsLastSeq(t *testing.T) {
+	dir := t.TempDir()
+
+	// Every record fills a segment, so the active segment is left empty,
+	// and the sealed ones compacted away.
+	wal, err := OpenWAL(WALOptions{Dir: dir, SegmentSize: 1, Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := uint64(1); seq <= 20; seq++ {
+		wal.appendMessage(testWALMessage(seq))
+		wal.appendTombstone(seq)
+	}
+	wal.Close()
+
+	wal = openTestWAL(t, dir, SyncNever)
+	defer wal.Close()
+
+	if seq := wal.lastSequence(); seq != 20 {
+		t.Error("Expected: 20\nGot:", seq)
+	}
+}
+
+func Test_WALWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	wal := openTestWAL(t, dir, SyncAlways)
+	wal.appendMessage(testWALMessage(1))
+
+	// A write which fails, and cannot be truncated, fails the WAL, rather
+	// than later records following a torn one.
+	f := wal.file
+	ro, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.file = ro
+	if err := wal.appendMessage(testWALMessage(2)); err == nil {
+		t.Error("Expected: write error\nGot: nil")
+	}
+	wal.file = f
+	ro.Close()
+	if err := wal.appendMessage(testWALMessage(3)); err == nil || !strings.Contains(err.Error(), "truncating") {
+		t.Error("Expected: failed truncating\nGot:", err)
+	}
+	wal.Close()
+
+	wal = openTestWAL(t, dir, SyncAlways)
+	defer wal.Close()
+
+	if msgs := wal.recoveredMessages(); len(msgs) != 1 || msgs[0].seq != 1 {
+		t.Error("Expected: message 1\nGot:", msgs)
+	}
+}
+
+func Test_WALCommit(t *testing.T) {
+	wal := openTestWAL(t, t.TempDir(), SyncAlways)
+	defer wal.Close()
+
+	wal.appendMessage(testWALMessage(1))
+	wal.appendTombstone(1)
+	if err := wal.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if wal.synced != 2 {
+		t.Error("Expected: 2 records synced\nGot:", wal.synced)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -40,6 +42,8 @@ const (
 	HeaderAck           = "ack"
 	HeaderTransaction   = "transaction"
 	HeaderHeartBeat     = "heart-beat"
+	HeaderLogin         = "login"
+	HeaderPasscode      = "passcode"
 
 	HeaderVersion      = "version"
 	HeaderSession      = "session"
@@ -76,9 +80,26 @@ func parseAckModeInt(n int) (string, error) {
 }
 
 type Client struct {
-	connection    net.Conn
-	subscriptions []Subscription
-	heartBeat     HeartBeat
+	connection      net.Conn
+	subscriptions   []Subscription
+	heartBeat       HeartBeat
+	codec           Codec
+	compression     *Compression
+	envelope        *Envelope
+	maxDecompressed int
+	subscribed      int
+	maxUnacked      int
+	windows         *windowSet
+	ackers          *ackerSet
+
+	sendInterceptors    []SendInterceptor
+	receiveInterceptors []ReceiveInterceptor
+
+	logger    *slog.Logger
+	metrics   Metrics
+	lastRead  *int64
+	closed    chan struct{}
+	closeOnce *sync.Once
 }
 
 type Subscription struct {
@@ -110,6 +131,25 @@ func (sf *ServerFrame) String() string {
 	return fmt.Sprintf("COMMAND: %s ; HEADERS: %+v ; BODY: %s", sf.Command, sf.Headers, sf.Body)
 }
 
+// Payload returns the body without the frame's terminating null, limited
+// to content-length bytes when that header is present.
+func (sf *ServerFrame) Payload() []byte {
+	b := sf.Body
+
+	if v, ok := sf.Headers[HeaderContentLength]; ok {
+		n, err := strconv.Atoi(string(v))
+		if err == nil && n >= 0 && n <= len(b) {
+			return b[:n]
+		}
+	}
+
+	if i := bytes.IndexByte(b, byteNull); i >= 0 {
+		return b[:i]
+	}
+
+	return b
+}
+
 type headers struct {
 	AcceptVersion []byte
 	Host          []byte
@@ -219,9 +259,13 @@ func newCmdConnect(host string, options *Options) *frame {
 	f.headers.Host = []byte(host)
 
 	// May
-	// login
-	// passcode
-	// heartbeat
+	if options.Login != "" {
+		f.headers.UserDefined = map[string][]byte{
+			HeaderLogin:    []byte(options.Login),
+			HeaderPasscode: []byte(options.Passcode),
+		}
+	}
+
 	var tx, rx int
 	if options.HeartBeat != nil {
 		tx = options.HeartBeat.SendInterval
@@ -272,7 +316,7 @@ func newCmdSend(queueName string, body []byte, rcpt, txn string, userDef ...Head
 
 	// Should
 	f.headers.ContentType = []byte(ContentTypeText)
-	f.headers.ContentLength = []byte(strconv.Itoa(len(body) + 1))
+	f.headers.ContentLength = []byte(strconv.Itoa(len(body)))
 
 	// Allows
 	if rcpt != "" {
@@ -284,7 +328,14 @@ func newCmdSend(queueName string, body []byte, rcpt, txn string, userDef ...Head
 	}
 
 	// User-defined.
+	if len(userDef) > 0 {
+		f.headers.UserDefined = make(map[string][]byte, len(userDef))
+	}
 	for _, j := range userDef {
+		if j.Key == HeaderContentType {
+			f.headers.ContentType = []byte(j.Value)
+			continue
+		}
 		f.headers.UserDefined[j.Key] = []byte(j.Value)
 	}
 
@@ -337,7 +388,7 @@ func newCmdNack(msgID, txn, rcpt string) *frame {
 	return &f
 }
 
-func newCmdSubscribe(queueName, subID, rcpt string, am int) (*frame, error) {
+func newCmdSubscribe(queueName, subID, rcpt string, am int, userDef ...Header) (*frame, error) {
 	f := frame{
 		command:        CmdSubscribe,
 		headers:        headers{},
@@ -362,6 +413,14 @@ func newCmdSubscribe(queueName, subID, rcpt string, am int) (*frame, error) {
 		f.expectResponse = true
 	}
 
+	// User-defined, such as broker prefetch settings.
+	if len(userDef) > 0 {
+		f.headers.UserDefined = make(map[string][]byte, len(userDef))
+	}
+	for _, j := range userDef {
+		f.headers.UserDefined[j.Key] = []byte(j.Value)
+	}
+
 	return &f, nil
 }
 
@@ -446,91 +505,102 @@ func newCmdCommit(txn, rcpt string) *frame {
 }
 
 func formatRequest(f *frame, b *bytes.Buffer) {
+	// Headers are escaped in all frames but CONNECT.
+	escaped := f.command != CmdConnect
+
 	b.WriteString(f.command)
 	b.WriteByte(byteLineFeed)
 
 	if f.headers.AcceptVersion != nil {
 		b.WriteString(HeaderAcceptVersion)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.AcceptVersion)
+		writeEscaped(b, f.headers.AcceptVersion, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 	if f.headers.Host != nil {
 		b.WriteString(HeaderHost)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.Host)
+		writeEscaped(b, f.headers.Host, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 	if f.headers.ContentLength != nil {
 		b.WriteString(HeaderContentLength)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.ContentLength)
+		writeEscaped(b, f.headers.ContentLength, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 	if f.headers.Receipt != nil {
 		b.WriteString(HeaderReceipt)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.Receipt)
+		writeEscaped(b, f.headers.Receipt, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 	if f.headers.ReceiptID != nil {
 		b.WriteString(HeaderReceiptID)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.ReceiptID)
+		writeEscaped(b, f.headers.ReceiptID, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 	if f.headers.Destination != nil {
 		b.WriteString(HeaderDestination)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.Destination)
+		writeEscaped(b, f.headers.Destination, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 	if f.headers.ContentType != nil {
 		b.WriteString(HeaderContentType)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.ContentType)
+		writeEscaped(b, f.headers.ContentType, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 	if f.headers.ID != nil {
 		b.WriteString(HeaderID)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.ID)
+		writeEscaped(b, f.headers.ID, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 	if f.headers.Ack != nil {
 		b.WriteString(HeaderAck)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.Ack)
+		writeEscaped(b, f.headers.Ack, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 	if f.headers.Transaction != nil {
 		b.WriteString(HeaderTransaction)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.Transaction)
+		writeEscaped(b, f.headers.Transaction, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 	if f.headers.HeartBeat != nil {
 		b.WriteString(HeaderHeartBeat)
 		b.WriteByte(byteColon)
-		b.Write(f.headers.HeartBeat)
+		writeEscaped(b, f.headers.HeartBeat, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 
 	for k, v := range f.headers.UserDefined {
-		b.WriteString(k)
+		writeEscaped(b, []byte(k), escaped)
 		b.WriteByte(byteColon)
-		b.Write(v)
+		writeEscaped(b, v, escaped)
 		b.WriteByte(byteLineFeed)
 	}
 
 	b.WriteByte(byteLineFeed)
 	b.Write(f.body)
-	b.WriteByte(byteLineFeed)
 
+	// The body is exactly content-length bytes, so the end of line goes
+	// after the null, where it is permitted as padding between frames.
 	b.WriteByte(byteNull)
+	b.WriteByte(byteLineFeed)
 }
 
 func sendRequest(c io.ReadWriter, f *frame) ([]byte, error) {
+	r, _, err := sendRequestN(c, f)
+	return r, err
+}
+
+// sendRequestN is sendRequest, also returning the number of bytes sent.
+func sendRequestN(c io.ReadWriter, f *frame) ([]byte, int, error) {
 	var b bytes.Buffer
 
 	if f != nil {
@@ -540,21 +610,21 @@ func sendRequest(c io.ReadWriter, f *frame) ([]byte, error) {
 		b.WriteByte(byteNull)
 	}
 
-	_, err := c.Write(b.Bytes())
+	n, err := c.Write(b.Bytes())
 	if err != nil {
-		return nil, err
+		return nil, n, err
 	}
 
 	if f == nil || !f.expectResponse {
-		return nil, nil
+		return nil, n, nil
 	}
 
 	r, err := bufio.NewReader(c).ReadBytes(byteNull)
 	if err != nil {
-		return nil, err
+		return nil, n, err
 	}
 
-	return r, nil
+	return r, n, nil
 }
 
 func NewConnection(host string, port int) (net.Conn, error) {
@@ -572,31 +642,128 @@ type HeartBeat struct {
 
 type Options struct {
 	HeartBeat *HeartBeat
+
+	// Login and Passcode, if Login is set, authenticate the connection.
+	Login    string
+	Passcode string
+
+	// Codec encodes values given to SendValue, defaults to JSON.
+	Codec Codec
+
+	// Compression, if set, compresses sent bodies.  Received bodies are
+	// decompressed by ReceiveFrames regardless.
+	Compression *Compression
+
+	// MaxDecompressedSize limits the size received bodies are decompressed
+	// to, DefaultMaxDecompressedSize if zero.  Larger bodies are delivered
+	// compressed.
+	MaxDecompressedSize int
+
+	// Envelope, if set, encrypts and signs sent bodies, and verifies and
+	// decrypts bodies received by ReceiveFrames.
+	Envelope *Envelope
+
+	// MaxUnacked is the flow control window of each subscription, see
+	// SubscribeWindow, which in the auto ack mode needs messages to be
+	// released.  Zero is unlimited.
+	MaxUnacked int
+
+	// SendInterceptors see each frame sent, in order, before it is
+	// compressed or sealed.  ReceiveInterceptors see each frame received
+	// by ReceiveFrames, in order, after it is opened and decompressed.
+	SendInterceptors    []SendInterceptor
+	ReceiveInterceptors []ReceiveInterceptor
+
+	// Logger, if set, receives connection events, heart-beat misses and
+	// errors, and at debug level each frame sent and received, without
+	// bodies.
+	Logger *slog.Logger
+
+	// Metrics, if set, is told of frames, receipts, heart-beats and
+	// handlers, see PrometheusMetrics.
+	Metrics Metrics
 }
 
 func Connect(conn net.Conn, options *Options) (Client, []byte, error) {
-	resp, err := sendRequest(conn, newCmdConnect(conn.RemoteAddr().String(), options))
+	if options == nil {
+		options = &Options{}
+	}
+
+	cli := Client{
+		connection:          conn,
+		codec:               options.Codec,
+		compression:         options.Compression,
+		maxDecompressed:     options.MaxDecompressedSize,
+		envelope:            options.Envelope,
+		maxUnacked:          options.MaxUnacked,
+		windows:             newWindowSet(),
+		ackers:              newAckerSet(),
+		sendInterceptors:    options.SendInterceptors,
+		receiveInterceptors: options.ReceiveInterceptors,
+		logger:              options.Logger,
+		metrics:             options.Metrics,
+		closed:              make(chan struct{}),
+		closeOnce:           &sync.Once{},
+	}
+
+	host := conn.RemoteAddr().String()
+
+	resp, err := cli.send(newCmdConnect(host, options))
 	if err != nil {
+		cli.log(slog.LevelError, "stomp connect failed", slog.String("host", host), slog.Any("error", err))
 		return Client{}, nil, fmt.Errorf("failed connecting: %s", err)
 	}
 
-	cli := Client{connection: conn, heartBeat: *options.HeartBeat}
+	var connected ServerFrame
+	if len(resp) > 0 {
+		connected, err = ParseResponse(resp)
+		if err != nil {
+			cli.log(slog.LevelError, "stomp connect response invalid", slog.Any("error", err))
+		}
+	}
+	if connected.Command == CmdError {
+		cli.log(slog.LevelError, "stomp connect refused",
+			slog.String("message", string(connected.Headers[HeaderMessage])))
+	} else {
+		if cli.metrics != nil {
+			cli.metrics.Connected()
+		}
+		cli.log(slog.LevelInfo, "stomp connected",
+			slog.String("host", host),
+			slog.String("version", string(connected.Headers[HeaderVersion])),
+			slog.String("server", string(connected.Headers[HeaderServer])),
+			slog.String("heart-beat", string(connected.Headers[HeaderHeartBeat])))
+	}
+
+	if options.HeartBeat != nil {
+		cli.heartBeat = *options.HeartBeat
 
-	if options != nil && options.HeartBeat != nil {
 		// Send heartbeat
-		go func() {
-			tChan := time.Tick(time.Duration(options.HeartBeat.SendInterval) * time.Millisecond)
-			for _ = range tChan {
-				// Response is empty.
-				_, err := cli.SendHeartBeat()
-				if err != nil {
-					// TODO: handle this err
+		if options.HeartBeat.SendInterval > 0 {
+			go func() {
+				ticker := time.NewTicker(time.Duration(options.HeartBeat.SendInterval) * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-cli.closed:
+						return
+					case <-ticker.C:
+					}
+					// Response is empty.
+					_, err := cli.SendHeartBeat()
+					if err != nil {
+						cli.log(slog.LevelError, "stomp heart-beat send failed", slog.Any("error", err))
+					}
 				}
-			}
-		}()
-
-		// TODO: handle receive heartbeat timeout
+			}()
+		}
 
+		// Receive heartbeat, checked while the client is reading.
+		interval := negotiateHeartBeat(cli.heartBeat, connected.Headers[HeaderHeartBeat])
+		if interval > 0 {
+			cli.lastRead = new(int64)
+			go cli.monitorHeartBeat(interval)
+		}
 	}
 
 	return cli, resp, nil
@@ -606,8 +773,18 @@ func (c *Client) Disconnect() error {
 	// Graceful shutdown: send disconnect frame, check rcpt received, then close socket.
 	// Do not send any more frames after the DISCONNECT frame has been sent.
 
+	err := c.ackers.flush("")
+	if err != nil {
+		return fmt.Errorf("failed flushing batched acks: %s", err)
+	}
+
+	if c.closeOnce != nil {
+		c.closeOnce.Do(func() { close(c.closed) })
+	}
+	c.log(slog.LevelInfo, "stomp disconnecting")
+
 	rcptID := "rcpt-disconnect-123"
-	resp, err := sendRequest(c.connection, newCmdDisconnect(rcptID))
+	resp, err := c.send(newCmdDisconnect(rcptID))
 	if err != nil {
 		return fmt.Errorf("failed sending disconnect: %s", err)
 	}
@@ -631,7 +808,7 @@ func (c *Client) Disconnect() error {
 }
 
 func (c *Client) SendHeartBeat() ([]byte, error) {
-	resp, err := sendRequest(c.connection, nil)
+	resp, err := c.send(nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed sending heart-beat: %s", err)
 	}
@@ -645,8 +822,8 @@ func (c *Client) Send(queue string, msg []byte, rcpt, txn string, userDef ...Hea
 	// a - receipt header is set.
 	// b - the server sends an ERROR response and disconnects.
 
-	resp, err := sendRequest(
-		c.connection, newCmdSend(
+	resp, err := c.send(
+		newCmdSend(
 			queue,
 			msg,
 			rcpt,
@@ -662,20 +839,24 @@ func (c *Client) Send(queue string, msg []byte, rcpt, txn string, userDef ...Hea
 }
 
 func (c *Client) Ack(msgID, rcpt, transactionID string) error {
-	_, err := sendRequest(c.connection, newCmdAck(msgID, rcpt, transactionID))
+	_, err := c.send(newCmdAck(msgID, rcpt, transactionID))
 	if err != nil {
 		return fmt.Errorf("failed sending ack: %s", err)
 	}
 
+	c.windows.release(msgID)
+
 	return nil
 }
 
 func (c *Client) Nack(msgID, transactionID, rcpt string) error {
-	_, err := sendRequest(c.connection, newCmdNack(msgID, transactionID, rcpt))
+	_, err := c.send(newCmdNack(msgID, transactionID, rcpt))
 	if err != nil {
 		return fmt.Errorf("failed sending nack: %s", err)
 	}
 
+	c.windows.release(msgID)
+
 	return nil
 }
 
@@ -683,10 +864,23 @@ func intToByteSlice(n int) []byte {
 	return []byte(strconv.Itoa(n))
 }
 
-func (c *Client) Subscribe(queueName, rcpt string, am int) (Subscription, []byte, error) {
-	// Simple approach of setting subscription id to list index.
-	// Might need to be enhanced in future.
-	subID := strconv.Itoa(len(c.subscriptions))
+// Subscribe subscribes with the client's flow control window, see
+// SubscribeWindow.
+func (c *Client) Subscribe(queueName, rcpt string, am int, userDef ...Header) (Subscription, []byte, error) {
+	return c.SubscribeWindow(queueName, rcpt, am, c.maxUnacked, userDef...)
+}
+
+// SubscribeWindow subscribes with a flow control window of maxUnacked
+// messages, see FlowStats.  Zero is unlimited.  Acking or nacking a
+// message frees its slot.  In the auto ack mode, Consume and WorkerPool
+// free it once the handler returns, but a caller of ReceiveFrames must
+// call Release for each message, or no more are received once the window
+// is full.
+func (c *Client) SubscribeWindow(queueName, rcpt string, am, maxUnacked int, userDef ...Header) (Subscription, []byte, error) {
+	// Subscription ids are a count of subscriptions made, so they are
+	// not reused after unsubscribing.
+	subID := strconv.Itoa(c.subscribed)
+	c.subscribed++
 
 	sub := Subscription{
 		ID: subID,
@@ -697,12 +891,23 @@ func (c *Client) Subscribe(queueName, rcpt string, am int) (Subscription, []byte
 		AckMode: am,
 	}
 
-	f, err := newCmdSubscribe(queueName, subID, rcpt, am)
+	if maxUnacked > 0 {
+		userDef = withPrefetch(userDef, maxUnacked)
+	}
+
+	f, err := newCmdSubscribe(queueName, subID, rcpt, am, userDef...)
 	if err != nil {
 		return sub, nil, fmt.Errorf("failed creating subscribe command: %s", err)
 	}
 
-	resp, err := sendRequest(c.connection, f)
+	if maxUnacked > 0 {
+		if c.windows == nil {
+			c.windows = newWindowSet()
+		}
+		c.windows.add(subID, am, maxUnacked)
+	}
+
+	resp, err := c.send(f)
 	if err != nil {
 		return sub, nil, fmt.Errorf("failed subscribing: %s", err)
 	}
@@ -713,15 +918,22 @@ func (c *Client) Subscribe(queueName, rcpt string, am int) (Subscription, []byte
 }
 
 func (c *Client) Unsubscribe(subID, rcpt string) ([]byte, error) {
-	resp, err := sendRequest(c.connection, newCmdUnsubscribe(subID, rcpt))
+	err := c.ackers.flush(subID)
+	if err != nil {
+		return nil, fmt.Errorf("failed flushing batched acks: %s", err)
+	}
+	c.ackers.remove(subID)
+
+	resp, err := c.send(newCmdUnsubscribe(subID, rcpt))
 	if err != nil {
 		return nil, fmt.Errorf("failed unsubscribing: %s", err)
 	}
 
+	c.windows.remove(subID)
+
 	for i := 0; i < len(c.subscriptions); i++ {
 		if c.subscriptions[i].ID == subID {
-			// TODO: validate this delete, for memory errors
-			c.subscriptions = append(c.subscriptions[:i-1], c.subscriptions[i:]...)
+			c.subscriptions = append(c.subscriptions[:i], c.subscriptions[i+1:]...)
 			break
 		}
 	}
@@ -730,41 +942,173 @@ func (c *Client) Unsubscribe(subID, rcpt string) ([]byte, error) {
 }
 
 func (c *Client) Receive() (chan []byte, chan error) {
-	reader := bufio.NewReader(c.connection)
+	reader := bufio.NewReader(c.reader())
 
 	recvChan := make(chan []byte)
 	errChan := make(chan error)
 
 	go func() {
 		for {
-			resp, err := reader.ReadBytes(byteNull)
+			resp, err := readFrame(reader)
 			if err != nil {
+				c.log(slog.LevelError, "stomp read failed", slog.Any("error", err))
 				errChan <- fmt.Errorf("failed reading response: %s :: %s", err, resp)
 				continue
 			}
 
+			// Parsed only to be logged, the frame is delivered as read.
+			sf := ServerFrame{Command: frameCommand(resp)}
+			if c.logger != nil {
+				if parsed, err := ParseResponse(resp); err == nil {
+					sf = parsed
+				}
+			}
+			c.received(sf, len(resp))
+
 			recvChan <- resp
+		}
+	}()
+
+	return recvChan, errChan
+}
+
+// ReceiveFrames is like Receive, but delivers parsed frames, and skips
+// heart-beats.  It stops at the first read error, which is sent on the
+// error channel before the frame channel is closed.
+//
+// Message bodies are verified and decrypted, when the client has an
+// Envelope, then decompressed.  Messages failing the envelope are not
+// delivered.  A body which cannot be decompressed is delivered as
+// received, with its content-encoding header.
+//
+// Frames rejected by a receive interceptor are not delivered.
+//
+// When a subscription's flow control window is full, reading pauses until
+// one of its messages is acked, nacked, or released.
+func (c *Client) ReceiveFrames() (chan ServerFrame, chan error) {
+	reader := bufio.NewReader(c.reader())
+
+	frameChan := make(chan ServerFrame)
+	errChan := make(chan error, 1)
 
-			// Remove end of packet newline,
-			// otherwise next packet starts with newline.
-			b, err := reader.Peek(1)
+	go func() {
+		defer close(frameChan)
+
+		for {
+			resp, err := readFrame(reader)
+			if err != nil {
+				c.log(slog.LevelError, "stomp read failed", slog.Any("error", err))
+				errChan <- fmt.Errorf("failed reading frame: %s", err)
+				return
+			}
+
+			sf, err := ParseResponse(resp)
 			if err != nil {
-				errChan <- fmt.Errorf("failed reading bytes after \\x0: %s", err)
+				c.log(slog.LevelError, "stomp frame invalid", slog.Any("error", err))
+				errChan <- fmt.Errorf("failed parsing frame: %s", err)
+				return
 			}
-			if b[0] == byteLineFeed {
-				_, err := reader.ReadByte()
-				if err != nil {
-					errChan <- fmt.Errorf("failed reading final newline: %s", err)
+
+			c.received(sf, len(resp))
+
+			if sf.Command == CmdMessage {
+				if err := c.envelope.open(&sf); err != nil {
+					c.log(slog.LevelWarn, "stomp message rejected by envelope",
+						slog.String("message-id", string(sf.Headers[HeaderMessageID])),
+						slog.Any("error", err))
+					c.envelope.reject(sf, err)
+					continue
 				}
 			}
+
+			// A body that fails decompressing is delivered as received.
+			if err := decompressFrame(&sf, c.maxDecompressedSize()); err != nil {
+				c.log(slog.LevelWarn, "stomp body not decompressed",
+					slog.String("message-id", string(sf.Headers[HeaderMessageID])),
+					slog.Any("error", err))
+			}
+
+			if err := c.interceptReceive(&sf); err != nil {
+				// Rejected, the interceptor is responsible for acking.
+				c.log(slog.LevelDebug, "stomp frame rejected by interceptor",
+					slog.String("command", sf.Command), slog.Any("error", err))
+				continue
+			}
+
+			if sf.Command == CmdMessage {
+				c.windows.acquire(sf)
+			}
+
+			frameChan <- sf
 		}
 	}()
 
-	return recvChan, errChan
+	return frameChan, errChan
 }
 
-func (c *Client) Begin(transactionID, rcpt string) ([]byte, error) {
-	resp, err := sendRequest(c.connection, newCmdBegin(transactionID, rcpt))
+// readFrame reads the next frame, discarding any heart-beat end of lines
+// preceding it.  When the frame has a content-length header, the body is
+// read by length, so it may contain nulls.
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != byteLineFeed && b[0] != '\r' {
+			break
+		}
+		if _, err := reader.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+
+	var frame []byte
+	contentLength := -1
+	lengthPrefix := []byte(HeaderContentLength + ":")
+
+	// Command and headers, up to and including the blank line.
+	for i := 0; ; i++ {
+		line, err := reader.ReadBytes(byteLineFeed)
+		frame = append(frame, line...)
+		if err != nil {
+			return frame, err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if i > 0 && len(line) == 0 {
+			break
+		}
+		if bytes.IndexByte(line, byteNull) >= 0 {
+			// Malformed, the frame ended before the blank line.
+			return frame, nil
+		}
+		if contentLength < 0 && bytes.HasPrefix(line, lengthPrefix) {
+			n, err := strconv.Atoi(string(line[len(lengthPrefix):]))
+			if err == nil && n >= 0 {
+				contentLength = n
+			}
+		}
+	}
+
+	if contentLength >= 0 {
+		body := make([]byte, contentLength)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return frame, err
+		}
+		frame = append(frame, body...)
+	}
+
+	rest, err := reader.ReadBytes(byteNull)
+	frame = append(frame, rest...)
+
+	return frame, err
+}
+
+// BeginID begins a transaction with the given id.  Begin is usually more
+// convenient, as the returned Tx threads the id through each frame.
+func (c *Client) BeginID(transactionID, rcpt string) ([]byte, error) {
+	resp, err := c.send(newCmdBegin(transactionID, rcpt))
 	if err != nil {
 		return nil, fmt.Errorf("failed transaction begin: %s", err)
 	}
@@ -773,7 +1117,7 @@ func (c *Client) Begin(transactionID, rcpt string) ([]byte, error) {
 }
 
 func (c *Client) Abort(transactionID, rcpt string) ([]byte, error) {
-	resp, err := sendRequest(c.connection, newCmdAbort(transactionID, rcpt))
+	resp, err := c.send(newCmdAbort(transactionID, rcpt))
 	if err != nil {
 		return nil, fmt.Errorf("failed abort: %s", err)
 	}
@@ -782,7 +1126,7 @@ func (c *Client) Abort(transactionID, rcpt string) ([]byte, error) {
 }
 
 func (c *Client) Commit(transactionID, rcpt string) ([]byte, error) {
-	resp, err := sendRequest(c.connection, newCmdCommit(transactionID, rcpt))
+	resp, err := c.send(newCmdCommit(transactionID, rcpt))
 	if err != nil {
 		return nil, fmt.Errorf("failed commit: %s", err)
 	}
@@ -791,62 +1135,52 @@ func (c *Client) Commit(transactionID, rcpt string) ([]byte, error) {
 }
 
 func ParseResponse(s []byte) (ServerFrame, error) {
-	var cmd string
-
-	sz := len(s)
-
-	headerStart := 0
-	for i := 0; i < sz; i++ {
-		if s[i] == byteLineFeed {
-			cmd = string(s[:i])
-			headerStart = i + 1
-			break
-		}
+	i := bytes.IndexByte(s, byteLineFeed)
+	if i <= 0 {
+		return ServerFrame{}, errors.New("failed parsing invalid message, no lines")
 	}
 
+	cmd := string(bytes.TrimSuffix(s[:i], []byte{'\r'}))
 	if cmd == "" {
-		return ServerFrame{}, errors.New("failed parsing invalid message, no lines")
+		return ServerFrame{}, errors.New("failed parsing invalid message, no command")
 	}
 
 	f := newServerFrame(cmd)
 
-	// Rest of f, without command.
-	msg := s[headerStart:]
+	// Headers are escaped in all frames but CONNECTED.
+	escaped := cmd != CmdConnected
 
-	tokStart := 0
-	var k []byte
-	var v []byte
-	i := 0
+	// Rest of f, without command.
+	msg := s[i+1:]
 
-Headers:
 	for {
-	Key:
-		for {
-			if msg[i] == byteColon {
-				k = msg[tokStart:i]
-				tokStart = i + 1
-				break Key
-			}
-			i++
+		i := bytes.IndexByte(msg, byteLineFeed)
+		if i < 0 {
+			return f, errors.New("failed parsing invalid message, headers not terminated")
 		}
-	Val:
-		for {
-			if msg[i] == byteLineFeed {
-				v = msg[tokStart:i]
-				f.Headers[string(k)] = v
-				i++
-				tokStart = i
-				if msg[i] == byteLineFeed {
-					i++
-					break Headers
-				}
-				break Val
-			}
-			i++
+
+		line := bytes.TrimSuffix(msg[:i], []byte{'\r'})
+		msg = msg[i+1:]
+
+		if len(line) == 0 {
+			break
+		}
+
+		k, v, ok := bytes.Cut(line, []byte{byteColon})
+		if !ok {
+			return f, errors.New("failed parsing invalid message, header without colon")
+		}
+		if escaped {
+			k, v = UnescapeHeader(k), UnescapeHeader(v)
+		}
+
+		// Only the first of repeated headers is used.
+		if _, ok := f.Headers[string(k)]; !ok {
+			f.Headers[string(k)] = v
 		}
 	}
 
-	f.Body = msg[i:]
+	f.Body = msg
 
 	return f, nil
 }
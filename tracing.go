@@ -0,0 +1,252 @@
+package stompingophers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// W3C trace context headers.
+const (
+	HeaderTraceparent = "traceparent"
+	HeaderTracestate  = "tracestate"
+)
+
+var ErrBadTraceparent = errors.New("malformed traceparent")
+
+// SpanContext identifies a span, as propagated in W3C trace context.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	State   string
+}
+
+// IsValid reports whether sc has non-zero trace and span ids.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Sampled reports whether the sampled flag is set.
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&0x01 != 0
+}
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" +
+		hex.EncodeToString(sc.SpanID[:]) + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// ParseTraceparent parses a traceparent header value.  Versions after 00
+// are accepted, as the spec requires, reading only the version 00 fields.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return sc, ErrBadTraceparent
+	}
+
+	var version [1]byte
+	if _, err := hex.Decode(version[:], []byte(parts[0])); err != nil {
+		return sc, ErrBadTraceparent
+	}
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil {
+		return sc, err
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil {
+		return sc, err
+	}
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return sc, err
+	}
+	sc.Flags = flags[0]
+
+	if !sc.IsValid() {
+		return SpanContext{}, ErrBadTraceparent
+	}
+
+	return sc, nil
+}
+
+// decodeHex decodes lowercase hex s, which must exactly fill dst.
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return ErrBadTraceparent
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return ErrBadTraceparent
+	}
+	return nil
+}
+
+// extractSpanContext reads the trace context from frame headers.
+func extractSpanContext(h map[string][]byte) (SpanContext, bool) {
+	tp, ok := h[HeaderTraceparent]
+	if !ok {
+		return SpanContext{}, false
+	}
+
+	sc, err := ParseTraceparent(string(tp))
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.State = string(h[HeaderTracestate])
+
+	return sc, true
+}
+
+// injectSpanContext writes sc into frame headers.
+func injectSpanContext(h map[string][]byte, sc SpanContext) {
+	h[HeaderTraceparent] = []byte(sc.Traceparent())
+	if sc.State != "" {
+		h[HeaderTracestate] = []byte(sc.State)
+	} else {
+		delete(h, HeaderTracestate)
+	}
+}
+
+// TraceContext returns the trace context carried by a message, if any.
+func TraceContext(msg ServerFrame) (SpanContext, bool) {
+	return extractSpanContext(msg.Headers)
+}
+
+// TraceHeaders returns user headers propagating sc, to pass to Send when
+// continuing a trace, eg. from a received message.
+func TraceHeaders(sc SpanContext) []Header {
+	h := []Header{{Key: HeaderTraceparent, Value: sc.Traceparent()}}
+	if sc.State != "" {
+		h = append(h, Header{Key: HeaderTracestate, Value: sc.State})
+	}
+	return h
+}
+
+type SpanKind int
+
+const (
+	SpanKindProducer SpanKind = iota + 1
+	SpanKindConsumer
+)
+
+// Tracer starts spans.  It is small enough for an OpenTelemetry adapter
+// to implement, by starting a span on a context carrying the parent as
+// its remote span context.
+type Tracer interface {
+	// Start begins a span, parent is the zero SpanContext for a new trace.
+	Start(name string, kind SpanKind, parent SpanContext, attrs map[string]string) Span
+}
+
+type Span interface {
+	Context() SpanContext
+	RecordError(err error)
+	End()
+}
+
+// NewSpanContext returns a span context for a new span, child of parent,
+// or the root of a new sampled trace if parent is not valid.  Tracers
+// without their own id generation may use it.
+func NewSpanContext(parent SpanContext) SpanContext {
+	sc := parent
+	if !parent.IsValid() {
+		sc = SpanContext{Flags: 0x01}
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+	return sc
+}
+
+// TraceSend returns a send interceptor starting a producer span for each
+// SEND frame, and injecting its context into the frame's headers.  A
+// traceparent already among the user headers is the span's parent.  The
+// span ends once the frame is sent, recording the error if it failed.
+func TraceSend(t Tracer) SendInterceptor {
+	return &sendTracer{tracer: t, spans: map[*OutboundFrame]Span{}}
+}
+
+// sendTracer holds the producer spans of the frames being sent.
+type sendTracer struct {
+	tracer Tracer
+
+	mu    sync.Mutex
+	spans map[*OutboundFrame]Span
+}
+
+func (st *sendTracer) InterceptSend(f *OutboundFrame) error {
+	if f.Command != CmdSend {
+		return nil
+	}
+
+	parent, _ := extractSpanContext(f.Headers)
+	dest := string(f.Headers[HeaderDestination])
+
+	span := st.tracer.Start("send "+dest, SpanKindProducer, parent, map[string]string{
+		"messaging.system":      "stomp",
+		"messaging.destination": dest,
+		"messaging.operation":   "publish",
+	})
+	injectSpanContext(f.Headers, span.Context())
+
+	st.mu.Lock()
+	st.spans[f] = span
+	st.mu.Unlock()
+
+	return nil
+}
+
+func (st *sendTracer) Sent(f *OutboundFrame, err error) {
+	st.mu.Lock()
+	span, ok := st.spans[f]
+	delete(st.spans, f)
+	st.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// Trace returns middleware running each message's handler in a consumer
+// span, the child of the trace context extracted from the message.  The
+// handler sees the consumer span's context in the message's headers, so
+// TraceContext(msg) continues the trace.
+func Trace(t Tracer) Middleware {
+	return func(next Handler) Handler {
+		return func(msg ServerFrame) error {
+			parent, _ := extractSpanContext(msg.Headers)
+			dest := string(msg.Headers[HeaderDestination])
+
+			attrs := map[string]string{
+				"messaging.system":      "stomp",
+				"messaging.destination": dest,
+				"messaging.operation":   "process",
+			}
+			if id, ok := msg.Headers[HeaderMessageID]; ok {
+				attrs["messaging.message_id"] = string(id)
+			}
+
+			span := t.Start("process "+dest, SpanKindConsumer, parent, attrs)
+			defer span.End()
+
+			hs := make(map[string][]byte, len(msg.Headers)+2)
+			for k, v := range msg.Headers {
+				hs[k] = v
+			}
+			injectSpanContext(hs, span.Context())
+			msg.Headers = hs
+
+			err := next(msg)
+			if err != nil {
+				span.RecordError(err)
+			}
+			return err
+		}
+	}
+}
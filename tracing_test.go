@@ -0,0 +1,168 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"sync"
+	"time"
+)
+
+// memorySpan is a finished span, as recorded by memoryTracer.
+type memorySpan struct {
+	name   string
+	kind   SpanKind
+	parent SpanContext
+	sc     SpanContext
+	attrs  map[string]string
+	err    error
+	ended  bool
+}
+
+func (s *memorySpan) Context() SpanContext  { return s.sc }
+func (s *memorySpan) RecordError(err error) { s.err = err }
+func (s *memorySpan) End()                  { s.ended = true }
+
+// memoryTracer is an in-memory exporter, keeping every span started.
+type memoryTracer struct {
+	mu    sync.Mutex
+	spans []*memorySpan
+}
+
+func (m *memoryTracer) Start(name string, kind SpanKind, parent SpanContext, attrs map[string]string) Span {
+	s := &memorySpan{name: name, kind: kind, parent: parent, sc: NewSpanContext(parent), attrs: attrs}
+
+	m.mu.Lock()
+	m.spans = append(m.spans, s)
+	m.mu.Unlock()
+
+	return s
+}
+
+func (m *memoryTracer) finished() []*memorySpan {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*memorySpan(nil), m.spans...)
+}
+
+func Test_ParseTraceparent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, err := ParseTraceparent(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled() {
+		t.Error("Expected sampled flag")
+	}
+	if sc.Traceparent() != tp {
+		t.Error("Expected:", tp, "\nGot:", sc.Traceparent())
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, err := ParseTraceparent(bad); err != ErrBadTraceparent {
+			t.Error("Expected:", ErrBadTraceparent, "\nGot:", err, "for", bad)
+		}
+	}
+
+	if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Error("Expected future versions to parse, got:", err)
+	}
+}
+
+func Test_TracePropagation(t *testing.T) {
+	tracer := &memoryTracer{}
+
+	client, frames := recordCommands(t)
+	client.sendInterceptors = []SendInterceptor{TraceSend(tracer)}
+
+	parent := NewSpanContext(SpanContext{})
+	parent.State = "vendor=abc"
+
+	_, err := client.Send("/queue/work", []byte("job"), "", "", TraceHeaders(parent)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent ServerFrame
+	select {
+	case sent = <-frames:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a SEND frame")
+	}
+
+	spans := tracer.finished()
+	if len(spans) != 1 || spans[0].kind != SpanKindProducer || !spans[0].ended {
+		t.Fatal("Expected one ended producer span, got:", spans)
+	}
+	producer := spans[0]
+	if producer.parent.SpanID != parent.SpanID || producer.sc.TraceID != parent.TraceID {
+		t.Error("Expected producer span to be the child of:", parent, "\nGot:", producer.parent)
+	}
+
+	sc, ok := TraceContext(sent)
+	if !ok || sc.SpanID != producer.sc.SpanID || sc.State != "vendor=abc" {
+		t.Error("Expected sent trace context:", producer.sc, "\nGot:", sc, ok)
+	}
+
+	// The message, as delivered to a consumer.
+	msg := testMessage("1")
+	msg.Headers[HeaderTraceparent] = sent.Headers[HeaderTraceparent]
+	msg.Headers[HeaderTracestate] = sent.Headers[HeaderTracestate]
+
+	var seen SpanContext
+	h := Chain(func(msg ServerFrame) error {
+		seen, _ = TraceContext(msg)
+		return errJob
+	}, Trace(tracer))
+
+	if err := h(msg); err != errJob {
+		t.Error("Expected:", errJob, "\nGot:", err)
+	}
+
+	spans = tracer.finished()
+	if len(spans) != 2 {
+		t.Fatal("Expected two spans, got:", len(spans))
+	}
+	consumer := spans[1]
+	if consumer.kind != SpanKindConsumer || !consumer.ended || consumer.err != errJob {
+		t.Error("Expected ended consumer span with error, got:", consumer)
+	}
+	if consumer.parent.SpanID != producer.sc.SpanID || consumer.sc.TraceID != parent.TraceID {
+		t.Error("Expected consumer span to be the child of:", producer.sc, "\nGot:", consumer.parent)
+	}
+	if consumer.attrs["messaging.message_id"] != "1" {
+		t.Error("Expected: message id attribute\nGot:", consumer.attrs)
+	}
+	if seen.SpanID != consumer.sc.SpanID {
+		t.Error("Expected handler to see:", consumer.sc, "\nGot:", seen)
+	}
+	if string(msg.Headers[HeaderTraceparent]) != producer.sc.Traceparent() {
+		t.Error("Expected the delivered message's headers to be unchanged")
+	}
+}
+
+func Test_TraceSendError(t *testing.T) {
+	tracer := &memoryTracer{}
+
+	client, _ := recordCommands(t)
+	client.sendInterceptors = []SendInterceptor{TraceSend(tracer)}
+	client.connection.Close()
+
+	_, err := client.Send("/queue/work", []byte("job"), "", "")
+	if err == nil {
+		t.Fatal("Expected a send error")
+	}
+
+	spans := tracer.finished()
+	if len(spans) != 1 || !spans[0].ended || spans[0].err == nil {
+		t.Error("Expected an ended span recording:", err, "\nGot:", spans)
+	}
+}
@@ -0,0 +1,154 @@
+package stompingophers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrTxDone = errors.New("transaction has already been committed or aborted")
+
+// Tx is a transaction begun on a client.  Frames sent through it are
+// part of the transaction until it is committed or aborted.
+type Tx struct {
+	ID string
+
+	client *Client
+
+	mu   sync.Mutex
+	done bool
+	err  error
+	stop chan struct{}
+}
+
+// Begin begins a transaction with a generated id.
+func (c *Client) Begin() (*Tx, error) {
+	return c.BeginContext(context.Background())
+}
+
+// BeginContext begins a transaction which is aborted if ctx is cancelled
+// before it is committed.
+func (c *Client) BeginContext(ctx context.Context) (*Tx, error) {
+	tx := &Tx{
+		ID:     newID("tx-"),
+		client: c,
+		stop:   make(chan struct{}),
+	}
+
+	_, err := c.BeginID(tx.ID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				tx.finish(CmdAbort, ctx.Err())
+			case <-tx.stop:
+			}
+		}()
+	}
+
+	return tx, nil
+}
+
+// InTx runs fn in a new transaction, committing if fn returns nil, and
+// aborting if it returns an error or panics.
+func (c *Client) InTx(fn func(tx *Tx) error) (err error) {
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Abort()
+			panic(p)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		if aerr := tx.Abort(); aerr != nil && aerr != ErrTxDone {
+			return fmt.Errorf("%s (and %s)", err, aerr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// active returns an error if the transaction can no longer be used.
+func (tx *Tx) active() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		if tx.err != nil {
+			return tx.err
+		}
+		return ErrTxDone
+	}
+
+	return nil
+}
+
+func (tx *Tx) Send(queue string, msg []byte, rcpt string, userDef ...Header) ([]byte, error) {
+	if err := tx.active(); err != nil {
+		return nil, err
+	}
+
+	return tx.client.Send(queue, msg, rcpt, tx.ID, userDef...)
+}
+
+func (tx *Tx) Ack(msgID, rcpt string) error {
+	if err := tx.active(); err != nil {
+		return err
+	}
+
+	return tx.client.Ack(msgID, rcpt, tx.ID)
+}
+
+func (tx *Tx) Nack(msgID, rcpt string) error {
+	if err := tx.active(); err != nil {
+		return err
+	}
+
+	return tx.client.Nack(msgID, tx.ID, rcpt)
+}
+
+func (tx *Tx) Commit() error {
+	return tx.finish(CmdCommit, nil)
+}
+
+func (tx *Tx) Abort() error {
+	return tx.finish(CmdAbort, nil)
+}
+
+// finish commits or aborts the transaction, once.  cause, if set, is
+// returned by any later use of the transaction.
+func (tx *Tx) finish(cmd string, cause error) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		if tx.err != nil {
+			return tx.err
+		}
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.err = cause
+	close(tx.stop)
+
+	var err error
+	if cmd == CmdCommit {
+		_, err = tx.client.Commit(tx.ID, "")
+	} else {
+		_, err = tx.client.Abort(tx.ID, "")
+	}
+
+	return err
+}
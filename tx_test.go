@@ -0,0 +1,134 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// recordCommands returns a client whose frames' commands are sent on the
+// returned channel.
+func recordCommands(t *testing.T) (*Client, chan ServerFrame) {
+	cliconn, srvconn := net.Pipe()
+	t.Cleanup(func() {
+		cliconn.Close()
+		srvconn.Close()
+	})
+
+	frames := make(chan ServerFrame, 16)
+
+	go func() {
+		r := bufio.NewReader(srvconn)
+		for {
+			b, err := readFrame(r)
+			if err != nil {
+				return
+			}
+			sf, err := ParseResponse(b)
+			if err != nil {
+				return
+			}
+			frames <- sf
+		}
+	}()
+
+	return &Client{connection: cliconn}, frames
+}
+
+func expectCommand(t *testing.T, frames chan ServerFrame, cmd, txn string) {
+	select {
+	case sf := <-frames:
+		if sf.Command != cmd || string(sf.Headers[HeaderTransaction]) != txn {
+			t.Error("Expected:", cmd, txn, "\nGot:", sf.Command, string(sf.Headers[HeaderTransaction]))
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected:", cmd, "\nGot: nothing")
+	}
+}
+
+func Test_InTxCommit(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	var id string
+	err := client.InTx(func(tx *Tx) error {
+		id = tx.ID
+		_, err := tx.Send("/queue/nooq", []byte("hi"), "")
+		if err != nil {
+			return err
+		}
+		return tx.Ack("m1", "")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectCommand(t, frames, CmdBegin, id)
+	expectCommand(t, frames, CmdSend, id)
+	expectCommand(t, frames, CmdAck, id)
+	expectCommand(t, frames, CmdCommit, id)
+}
+
+func Test_InTxAbort(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	failed := errors.New("handler failed")
+
+	var tx *Tx
+	err := client.InTx(func(x *Tx) error {
+		tx = x
+		return failed
+	})
+	if err != failed {
+		t.Error("Expected:", failed, "\nGot:", err)
+	}
+
+	expectCommand(t, frames, CmdBegin, tx.ID)
+	expectCommand(t, frames, CmdAbort, tx.ID)
+
+	if _, err := tx.Send("/queue/nooq", nil, ""); err != ErrTxDone {
+		t.Error("Expected:", ErrTxDone, "\nGot:", err)
+	}
+}
+
+func Test_InTxPanic(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	var id string
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected panic to propagate")
+			}
+		}()
+		client.InTx(func(tx *Tx) error {
+			id = tx.ID
+			panic("boom")
+		})
+	}()
+
+	expectCommand(t, frames, CmdBegin, id)
+	expectCommand(t, frames, CmdAbort, id)
+}
+
+func Test_BeginContextCancel(t *testing.T) {
+	client, frames := recordCommands(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	tx, err := client.BeginContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	expectCommand(t, frames, CmdBegin, tx.ID)
+	expectCommand(t, frames, CmdAbort, tx.ID)
+
+	if err := tx.Commit(); err != context.Canceled {
+		t.Error("Expected:", context.Canceled, "\nGot:", err)
+	}
+}
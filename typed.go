@@ -0,0 +1,138 @@
+package stompingophers
+
+import (
+	"fmt"
+)
+
+// Publisher sends values of type T to a destination.
+type Publisher[T any] struct {
+	client *Client
+	queue  string
+	codec  Codec
+}
+
+// NewPublisher returns a publisher for queue.  If codec is nil the
+// client's codec is used.
+func NewPublisher[T any](c *Client, queue string, codec Codec) *Publisher[T] {
+	return &Publisher[T]{
+		client: c,
+		queue:  queue,
+		codec:  codec,
+	}
+}
+
+func (p *Publisher[T]) Publish(v T, userDef ...Header) error {
+	var err error
+	if p.codec == nil {
+		_, err = p.client.SendValue(p.queue, v, "", "", userDef...)
+	} else {
+		_, err = p.client.SendValueWith(p.codec, p.queue, v, "", "", userDef...)
+	}
+
+	return err
+}
+
+// PublishTx sends v as part of tx.
+func (p *Publisher[T]) PublishTx(tx *Tx, v T, userDef ...Header) error {
+	if err := tx.active(); err != nil {
+		return err
+	}
+
+	var err error
+	if p.codec == nil {
+		_, err = p.client.SendValue(p.queue, v, "", tx.ID, userDef...)
+	} else {
+		_, err = p.client.SendValueWith(p.codec, p.queue, v, "", tx.ID, userDef...)
+	}
+
+	return err
+}
+
+// PoisonFunc is given messages which could not be decoded.  If it returns
+// nil the message is acked, otherwise it is nacked.
+type PoisonFunc func(msg ServerFrame, err error) error
+
+// Consumer receives values of type T from a destination.
+type Consumer[T any] struct {
+	client  *Client
+	queue   string
+	ackMode int
+	codec   Codec
+	handler func(v T, msg ServerFrame) error
+	sub     Subscription
+
+	// Poison handles messages that fail decoding.  When nil they are
+	// nacked, leaving them to the broker's redelivery policy.
+	Poison PoisonFunc
+
+	// Middleware wraps the decoding handler, outermost first.
+	Middleware []Middleware
+}
+
+// NewConsumer returns a consumer for queue.  If codec is nil each message
+// is decoded with the codec registered for its content-type.
+func NewConsumer[T any](c *Client, queue string, ackMode int, codec Codec, h func(v T, msg ServerFrame) error) *Consumer[T] {
+	return &Consumer[T]{
+		client:  c,
+		queue:   queue,
+		ackMode: ackMode,
+		codec:   codec,
+		handler: h,
+	}
+}
+
+// Run subscribes, and passes each decoded message to the handler, until
+// the connection fails.  In the client ack modes a message is acked when
+// the handler returns nil, and nacked when it returns an error.
+func (cn *Consumer[T]) Run() error {
+	sub, _, err := cn.client.Subscribe(cn.queue, "", cn.ackMode)
+	if err != nil {
+		return err
+	}
+	cn.sub = sub
+
+	h := Chain(cn.handle, cn.Middleware...)
+
+	frameChan, errChan := cn.client.ReceiveFrames()
+
+	for sf := range frameChan {
+		if sf.Command == CmdError {
+			return fmt.Errorf("server error: %s", sf.Headers[HeaderMessage])
+		}
+		if sf.Command != CmdMessage {
+			continue
+		}
+
+		err := cn.client.settle(sf, cn.ackMode, cn.client.runHandler(h, sf))
+		if err != nil {
+			return err
+		}
+	}
+
+	return <-errChan
+}
+
+func (cn *Consumer[T]) handle(sf ServerFrame) error {
+	var v T
+
+	var err error
+	if cn.codec == nil {
+		err = sf.Decode(&v)
+	} else {
+		err = cn.codec.Unmarshal(sf.Payload(), &v)
+	}
+	if err != nil {
+		if cn.Poison == nil {
+			return err
+		}
+		return cn.Poison(sf, err)
+	}
+
+	return cn.handler(v, sf)
+}
+
+// Close unsubscribes the consumer.
+func (cn *Consumer[T]) Close() error {
+	_, err := cn.client.Unsubscribe(cn.sub.ID, "")
+	return err
+}
@@ -0,0 +1,95 @@
+package stompingophers
+
+import (
+	"testing"
+
+	"bufio"
+	"errors"
+	"net"
+)
+
+func Test_PublisherConsumer(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+
+	acks := make(chan ServerFrame, 4)
+
+	go func() {
+		defer srvconn.Close()
+
+		r := bufio.NewReader(srvconn)
+		readTestFrame(t, r) // SUBSCRIBE
+
+		srvconn.Write([]byte("MESSAGE\nack:a1\ncontent-type:application/json\n\n{\"ID\":3}\000\n"))
+		acks <- readTestFrame(t, r)
+
+		srvconn.Write([]byte("MESSAGE\nack:a2\ncontent-type:application/json\n\nnot json\000\n"))
+		acks <- readTestFrame(t, r)
+
+		srvconn.Write([]byte("MESSAGE\nack:a3\ncontent-type:application/json\n\n{\"ID\":4}\000\n"))
+		acks <- readTestFrame(t, r)
+	}()
+
+	client := Client{connection: cliconn}
+
+	var got []testOrder
+	var poisoned []string
+
+	cn := NewConsumer[testOrder](&client, "/queue/orders", AckModeClientIndividual, nil,
+		func(v testOrder, msg ServerFrame) error {
+			got = append(got, v)
+			if v.ID == 4 {
+				return errors.New("not today")
+			}
+			return nil
+		})
+	cn.Poison = func(msg ServerFrame, err error) error {
+		poisoned = append(poisoned, string(msg.Headers[HeaderAck]))
+		return nil
+	}
+
+	cn.Run()
+
+	if len(got) != 2 || got[0].ID != 3 {
+		t.Error("Expected two decoded orders, got:", got)
+	}
+	if len(poisoned) != 1 || poisoned[0] != "a2" {
+		t.Error("Expected a2 poisoned, got:", poisoned)
+	}
+
+	expected := []struct{ cmd, id string }{{CmdAck, "a1"}, {CmdAck, "a2"}, {CmdNack, "a3"}}
+	for _, e := range expected {
+		sf := <-acks
+		if sf.Command != e.cmd || string(sf.Headers[HeaderID]) != e.id {
+			t.Error("Expected:", e.cmd, e.id, "\nGot:", sf.Command, string(sf.Headers[HeaderID]))
+		}
+	}
+}
+
+func Test_PublisherCodec(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+
+	frames := make(chan ServerFrame, 1)
+	go func() {
+		frames <- readTestFrame(t, bufio.NewReader(srvconn))
+	}()
+
+	client := Client{connection: cliconn}
+
+	p := NewPublisher[testOrder](&client, "/queue/orders", GobCodec{})
+	if err := p.Publish(testOrder{ID: 9}); err != nil {
+		t.Fatal(err)
+	}
+
+	sf := <-frames
+
+	var v testOrder
+	if err := sf.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.ID != 9 {
+		t.Error("Expected: 9\nGot:", v.ID)
+	}
+}